@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	batchModeStopOnFailure = "stop_on_failure"
+	batchModeContinue      = "continue"
+	batchModeParallel      = "parallel"
+
+	maxBatchSteps        = 50
+	defaultBatchParallel = 4
+	maxBatchParallel     = 16
+)
+
+func parseBatchMode(value string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", batchModeStopOnFailure:
+		return batchModeStopOnFailure, nil
+	case batchModeContinue:
+		return batchModeContinue, nil
+	case batchModeParallel:
+		return batchModeParallel, nil
+	default:
+		return "", fmt.Errorf("invalid mode %q (expected stop_on_failure|continue|parallel)", value)
+	}
+}
+
+func (server *daemonServer) handleBatch(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writeJSON(writer, http.StatusMethodNotAllowed, batchResponse{MustUseSmartsh: true, Error: "method not allowed"})
+		return
+	}
+	if !server.authorize(request) {
+		writeJSON(writer, http.StatusUnauthorized, batchResponse{MustUseSmartsh: true, Error: "unauthorized"})
+		return
+	}
+	batch := batchRequest{}
+	if decodeError := json.NewDecoder(request.Body).Decode(&batch); decodeError != nil {
+		writeJSON(writer, http.StatusBadRequest, batchResponse{MustUseSmartsh: true, Error: fmt.Sprintf("invalid request body: %v", decodeError)})
+		return
+	}
+	mode, modeError := parseBatchMode(batch.Mode)
+	if modeError != nil {
+		writeJSON(writer, http.StatusBadRequest, batchResponse{MustUseSmartsh: true, Error: modeError.Error()})
+		return
+	}
+	batch.Steps = expandBatchSteps(batch)
+	if len(batch.Steps) == 0 || len(batch.Steps) > maxBatchSteps {
+		writeJSON(writer, http.StatusBadRequest, batchResponse{MustUseSmartsh: true, Mode: mode, Error: fmt.Sprintf("steps must contain 1-%d commands", maxBatchSteps)})
+		return
+	}
+	priority, priorityError := parseJobPriority(batch.Priority, priorityInteractive)
+	if priorityError != nil {
+		writeJSON(writer, http.StatusBadRequest, batchResponse{MustUseSmartsh: true, Mode: mode, Error: priorityError.Error()})
+		return
+	}
+
+	response := server.executeBatch(request.Context(), batch, mode, priority)
+	writeJSON(writer, http.StatusOK, response)
+}
+
+// executeBatch runs the steps in order, or concurrently in parallel mode. In
+// stop_on_failure mode the remaining steps are reported as skipped after the
+// first step that does not complete. Every step takes its own scheduler slot,
+// so a parallel batch stays within the global and per-workspace limits.
+func (server *daemonServer) executeBatch(ctx context.Context, batch batchRequest, mode string, priority jobPriority) batchResponse {
+	startedAt := time.Now()
+	response := batchResponse{MustUseSmartsh: true, Status: "completed", Mode: mode}
+	batchID := fmt.Sprintf("batch_%d", startedAt.UnixNano())
+	if mode == batchModeParallel {
+		response.Steps = server.executeBatchParallel(ctx, batch, batchID, priority)
+	} else {
+		response.Steps = server.executeBatchSequential(ctx, batch, mode, batchID, priority)
+	}
+	for _, step := range response.Steps {
+		if step.Status != "completed" && step.Status != "skipped" {
+			response.FailedStep = step.Step
+			response.Status = step.Status
+			break
+		}
+	}
+	mergeBatchSummaries(&response)
+	response.Summary = summarizeBatch(response)
+	response.DurationMS = time.Since(startedAt).Milliseconds()
+	return response
+}
+
+func (server *daemonServer) executeBatchSequential(ctx context.Context, batch batchRequest, mode string, batchID string, priority jobPriority) []batchStepResult {
+	results := make([]batchStepResult, 0, len(batch.Steps))
+	stopped := false
+	for index, step := range batch.Steps {
+		stepRequest := applyBatchDefaults(step, batch)
+		if stopped {
+			results = append(results, skippedBatchStep(index, stepRequest, "skipped after an earlier step failed"))
+			continue
+		}
+		if ctx.Err() != nil {
+			results = append(results, skippedBatchStep(index, stepRequest, "skipped because the batch was abandoned"))
+			continue
+		}
+		result := server.executeBatchStep(ctx, index, stepRequest, batchID, priority)
+		results = append(results, result)
+		if result.Status != "completed" && mode == batchModeStopOnFailure {
+			stopped = true
+		}
+	}
+	return results
+}
+
+func (server *daemonServer) executeBatchParallel(ctx context.Context, batch batchRequest, batchID string, priority jobPriority) []batchStepResult {
+	limit := batch.MaxParallel
+	if limit <= 0 {
+		limit = defaultBatchParallel
+	}
+	limit = min(limit, maxBatchParallel)
+	results := make([]batchStepResult, len(batch.Steps))
+	slots := make(chan struct{}, limit)
+	var group sync.WaitGroup
+	for index, step := range batch.Steps {
+		stepRequest := applyBatchDefaults(step, batch)
+		group.Add(1)
+		go func(index int, stepRequest runRequest) {
+			defer group.Done()
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				results[index] = skippedBatchStep(index, stepRequest, "skipped because the batch was abandoned")
+				return
+			}
+			defer func() { <-slots }()
+			results[index] = server.executeBatchStep(ctx, index, stepRequest, batchID, priority)
+		}(index, stepRequest)
+	}
+	group.Wait()
+	return results
+}
+
+func (server *daemonServer) executeBatchStep(ctx context.Context, index int, stepRequest runRequest, batchID string, priority jobPriority) batchStepResult {
+	ticket := server.scheduler.enqueue(fmt.Sprintf("%s_step_%d", batchID, index+1), resolveWorkspaceKey(stepRequest.Cwd), priority)
+	if waitError := server.scheduler.wait(ctx, ticket); waitError != nil {
+		return skippedBatchStep(index, stepRequest, "skipped because the batch was abandoned")
+	}
+	defer server.scheduler.release(ticket)
+	result := server.executeRequest(ctx, stepRequest, "")
+	result.outputChunks = nil
+	server.metrics.recordRun(result)
+	return batchStepResult{Step: index + 1, runResponse: result, cwd: stepRequest.Cwd}
+}
+
+func skippedBatchStep(index int, stepRequest runRequest, reason string) batchStepResult {
+	return batchStepResult{Step: index + 1, cwd: stepRequest.Cwd, runResponse: runResponse{
+		MustUseSmartsh:  true,
+		Status:          "skipped",
+		ResolvedCommand: strings.TrimSpace(stepRequest.Command),
+		Summary:         reason,
+	}}
+}
+
+// expandBatchSteps turns the fan-out shorthand (one command, many cwds) into
+// steps. Explicit steps take precedence.
+func expandBatchSteps(batch batchRequest) []runRequest {
+	if len(batch.Steps) > 0 || strings.TrimSpace(batch.Command) == "" {
+		return batch.Steps
+	}
+	steps := make([]runRequest, 0, len(batch.Cwds))
+	for _, cwd := range batch.Cwds {
+		steps = append(steps, runRequest{Command: batch.Command, Cwd: cwd})
+	}
+	return steps
+}
+
+// applyBatchDefaults fills a step's unset fields from the batch. Step env
+// entries override batch env entries with the same name.
+func applyBatchDefaults(step runRequest, batch batchRequest) runRequest {
+	if strings.TrimSpace(step.Cwd) == "" {
+		step.Cwd = batch.Cwd
+	}
+	if step.TimeoutSec <= 0 {
+		step.TimeoutSec = batch.TimeoutSec
+	}
+	if len(batch.Env) > 0 {
+		merged := make(map[string]string, len(batch.Env)+len(step.Env))
+		for key, value := range batch.Env {
+			merged[key] = value
+		}
+		for key, value := range step.Env {
+			merged[key] = value
+		}
+		step.Env = merged
+	}
+	step.Unsafe = step.Unsafe || batch.Unsafe
+	step.RequireApproval = step.RequireApproval || batch.RequireApproval
+	if step.AllowlistMode == "" {
+		step.AllowlistMode = batch.AllowlistMode
+	}
+	if step.AllowlistFile == "" {
+		step.AllowlistFile = batch.AllowlistFile
+	}
+	if step.Sandbox == "" {
+		step.Sandbox = batch.Sandbox
+	}
+	step.Async = false
+	step.OpenExternalTerminal = false
+	return step
+}
+
+// mergeBatchSummaries unions the parsed failing tests and files of all
+// sub-runs and groups them by the sub-run that reported them.
+func mergeBatchSummaries(response *batchResponse) {
+	seenTests := map[string]bool{}
+	seenFiles := map[string]bool{}
+	distinctCwds := map[string]bool{}
+	for _, step := range response.Steps {
+		distinctCwds[step.cwd] = true
+	}
+	for _, step := range response.Steps {
+		if step.Status == "completed" || step.Status == "skipped" {
+			continue
+		}
+		label := step.ResolvedCommand
+		if len(distinctCwds) > 1 && step.cwd != "" {
+			label = step.cwd
+		}
+		response.Failures = append(response.Failures, batchFailureGroup{
+			Step:         step.Step,
+			Label:        label,
+			Status:       step.Status,
+			ErrorType:    step.ErrorType,
+			PrimaryError: step.PrimaryError,
+			FailingTests: step.FailingTests,
+			FailedFiles:  step.FailedFiles,
+		})
+		for _, test := range step.FailingTests {
+			if !seenTests[test] {
+				seenTests[test] = true
+				response.FailingTests = append(response.FailingTests, test)
+			}
+		}
+		for _, file := range step.FailedFiles {
+			if !seenFiles[file] {
+				seenFiles[file] = true
+				response.FailedFiles = append(response.FailedFiles, file)
+			}
+		}
+	}
+}
+
+func summarizeBatch(response batchResponse) string {
+	total := len(response.Steps)
+	if response.FailedStep == 0 {
+		return fmt.Sprintf("all %d steps completed", total)
+	}
+	if response.Mode == batchModeParallel {
+		labels := make([]string, 0, len(response.Failures))
+		for _, failure := range response.Failures {
+			labels = append(labels, failure.Label)
+		}
+		headline := fmt.Sprintf("%d of %d runs did not complete (%s)", len(response.Failures), total, strings.Join(labels, ", "))
+		if len(response.FailingTests) > 0 || len(response.FailedFiles) > 0 {
+			headline += fmt.Sprintf(": %d failing tests, %d failed files", len(response.FailingTests), len(response.FailedFiles))
+		}
+		return headline
+	}
+	failed := response.Steps[response.FailedStep-1]
+	headline := fmt.Sprintf("step %d/%d %s (%s)", response.FailedStep, total, failed.Status, failed.ResolvedCommand)
+	if response.Mode == batchModeContinue {
+		failures := 0
+		for _, step := range response.Steps {
+			if step.Status != "completed" {
+				failures++
+			}
+		}
+		headline = fmt.Sprintf("%d of %d steps did not complete; first: %s", failures, total, headline)
+	} else if response.FailedStep < total {
+		headline += fmt.Sprintf("; %d remaining skipped", total-response.FailedStep)
+	}
+	detail := failed.Summary
+	if detail == "" {
+		detail = failed.Error
+	}
+	if detail == "" {
+		return headline
+	}
+	return headline + ": " + detail
+}
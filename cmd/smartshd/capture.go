@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	streamStdout = "stdout"
+	streamStderr = "stderr"
+
+	// defaultOutputHeadDivisor reserves a quarter of the capture budget for the
+	// start of the output; the rest keeps the end, where failures are reported.
+	defaultOutputHeadDivisor = 4
+
+	// trailingOutputSize is how much of the latest output is kept for prompt
+	// detection, independent of the capture budget.
+	trailingOutputSize = 512
+)
+
+type outputChunk struct {
+	Stream string    `json:"stream"`
+	At     time.Time `json:"at"`
+	Data   string    `json:"data"`
+}
+
+// commandOutput is everything captured from one command execution.
+type commandOutput struct {
+	Combined     string
+	Stdout       string
+	Stderr       string
+	Chunks       []outputChunk
+	OmittedLines int64
+	OmittedBytes int64
+	// Signal names the signal that ended the command, if one did.
+	Signal string
+	// Termination is why the command stopped.
+	Termination *termination
+	// Cgroup holds kernel accounting when the command ran in a job cgroup.
+	Cgroup *cgroupUsage
+	// Sandbox is the confinement actually applied (strict or landlock).
+	Sandbox string
+	// InputPrompt is the prompt the command was stopped at while waiting
+	// for input.
+	InputPrompt string
+	// OutputBytes counts everything written to stdout and stderr, including
+	// what was omitted from the capture.
+	OutputBytes int64
+	// Usage is the rusage of the command's shell and reaped descendants.
+	Usage *resourceUsage
+}
+
+// outputSink receives command output as it is produced, tagged with its stream.
+type outputSink func(stream string, data []byte)
+
+// headTailBuffer keeps the first headMax bytes and the last tailMax bytes of a
+// stream in bounded memory, counting whatever falls in between.
+type headTailBuffer struct {
+	headMax    int
+	tailMax    int
+	head       bytes.Buffer
+	headLines  int64
+	ring       []byte
+	ringStart  int
+	ringLen    int
+	totalBytes int64
+	totalLines int64
+}
+
+func newHeadTailBuffer(headMax int, tailMax int) *headTailBuffer {
+	return &headTailBuffer{headMax: max(0, headMax), tailMax: max(0, tailMax), ring: make([]byte, max(0, tailMax))}
+}
+
+func (buffer *headTailBuffer) Write(data []byte) (int, error) {
+	buffer.totalBytes += int64(len(data))
+	buffer.totalLines += int64(bytes.Count(data, []byte{'\n'}))
+	remaining := data
+	if headRoom := buffer.headMax - buffer.head.Len(); headRoom > 0 {
+		taken := remaining[:min(headRoom, len(remaining))]
+		buffer.head.Write(taken)
+		buffer.headLines += int64(bytes.Count(taken, []byte{'\n'}))
+		remaining = remaining[len(taken):]
+	}
+	if buffer.tailMax == 0 || len(remaining) == 0 {
+		return len(data), nil
+	}
+	if len(remaining) > buffer.tailMax {
+		remaining = remaining[len(remaining)-buffer.tailMax:]
+	}
+	for len(remaining) > 0 {
+		if buffer.ringLen < buffer.tailMax {
+			copied := copy(buffer.ring[buffer.ringLen:], remaining)
+			buffer.ringLen += copied
+			remaining = remaining[copied:]
+			continue
+		}
+		// Full ring: overwrite the oldest bytes and advance the start.
+		copied := copy(buffer.ring[buffer.ringStart:], remaining)
+		buffer.ringStart = (buffer.ringStart + copied) % buffer.tailMax
+		remaining = remaining[copied:]
+	}
+	return len(data), nil
+}
+
+func (buffer *headTailBuffer) tail() []byte {
+	tail := make([]byte, 0, buffer.ringLen)
+	end := buffer.ringStart + buffer.ringLen
+	if end <= buffer.tailMax {
+		return append(tail, buffer.ring[buffer.ringStart:end]...)
+	}
+	tail = append(tail, buffer.ring[buffer.ringStart:]...)
+	return append(tail, buffer.ring[:end-buffer.tailMax]...)
+}
+
+// omitted reports the bytes and (newline-delimited) lines dropped between the
+// head and the tail.
+func (buffer *headTailBuffer) omitted() (int64, int64) {
+	tail := buffer.tail()
+	omittedBytes := buffer.totalBytes - int64(buffer.head.Len()) - int64(len(tail))
+	if omittedBytes <= 0 {
+		return 0, 0
+	}
+	omittedLines := buffer.totalLines - buffer.headLines - int64(bytes.Count(tail, []byte{'\n'}))
+	return max64(0, omittedLines), omittedBytes
+}
+
+func (buffer *headTailBuffer) String() string {
+	omittedLines, omittedBytes := buffer.omitted()
+	if omittedBytes == 0 {
+		return buffer.head.String() + string(buffer.tail())
+	}
+	return buffer.head.String() +
+		fmt.Sprintf("\n[smartshd omitted %d lines (%d bytes)]\n", omittedLines, omittedBytes) +
+		string(buffer.tail())
+}
+
+// streamCapture records stdout and stderr separately while also keeping the
+// interleaved combined output. All streams share one lock so chunk order and
+// the combined buffer always agree with each other.
+type streamCapture struct {
+	mu             sync.Mutex
+	combined       *headTailBuffer
+	stdout         *headTailBuffer
+	stderr         *headTailBuffer
+	headChunks     []outputChunk
+	headChunkBytes int
+	tailChunks     []outputChunk
+	tailChunkBytes int
+	headMax        int
+	tailMax        int
+	sink           outputSink
+	lastWriteAt    time.Time
+	trailing       []byte
+}
+
+type streamCaptureWriter struct {
+	capture *streamCapture
+	stream  string
+}
+
+// newStreamCapture bounds every stream to maxBytes, split into headBytes kept
+// from the start and the remainder kept from the end.
+func newStreamCapture(maxBytes int, headBytes int, sink outputSink) *streamCapture {
+	maxBytes = max(1, maxBytes)
+	if headBytes < 0 || headBytes > maxBytes {
+		headBytes = maxBytes / defaultOutputHeadDivisor
+	}
+	tailBytes := maxBytes - headBytes
+	return &streamCapture{
+		combined:    newHeadTailBuffer(headBytes, tailBytes),
+		stdout:      newHeadTailBuffer(headBytes, tailBytes),
+		stderr:      newHeadTailBuffer(headBytes, tailBytes),
+		headMax:     headBytes,
+		tailMax:     tailBytes,
+		sink:        sink,
+		lastWriteAt: time.Now(),
+	}
+}
+
+func (capture *streamCapture) writer(stream string) *streamCaptureWriter {
+	return &streamCaptureWriter{capture: capture, stream: stream}
+}
+
+func (writer *streamCaptureWriter) Write(data []byte) (int, error) {
+	capture := writer.capture
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	_, _ = capture.combined.Write(data)
+	if writer.stream == streamStderr {
+		_, _ = capture.stderr.Write(data)
+	} else {
+		_, _ = capture.stdout.Write(data)
+	}
+	capture.recordChunk(writer.stream, data)
+	capture.lastWriteAt = time.Now()
+	capture.trailing = append(capture.trailing, data...)
+	if len(capture.trailing) > trailingOutputSize {
+		capture.trailing = capture.trailing[len(capture.trailing)-trailingOutputSize:]
+	}
+	if capture.sink != nil {
+		capture.sink(writer.stream, data)
+	}
+	return len(data), nil
+}
+
+// recordChunk keeps timestamped chunks under the same head/tail budget as the
+// text buffers, dropping the oldest tail chunks first.
+func (capture *streamCapture) recordChunk(stream string, data []byte) {
+	now := time.Now()
+	remaining := data
+	if headRoom := capture.headMax - capture.headChunkBytes; headRoom > 0 {
+		taken := remaining[:min(headRoom, len(remaining))]
+		capture.headChunks = append(capture.headChunks, outputChunk{Stream: stream, At: now, Data: string(taken)})
+		capture.headChunkBytes += len(taken)
+		remaining = remaining[len(taken):]
+	}
+	if capture.tailMax == 0 || len(remaining) == 0 {
+		return
+	}
+	if len(remaining) > capture.tailMax {
+		remaining = remaining[len(remaining)-capture.tailMax:]
+	}
+	capture.tailChunks = append(capture.tailChunks, outputChunk{Stream: stream, At: now, Data: string(remaining)})
+	capture.tailChunkBytes += len(remaining)
+	for capture.tailChunkBytes > capture.tailMax && len(capture.tailChunks) > 1 {
+		capture.tailChunkBytes -= len(capture.tailChunks[0].Data)
+		capture.tailChunks = capture.tailChunks[1:]
+	}
+}
+
+// idleState returns when output was last written and the latest output.
+func (capture *streamCapture) idleState() (time.Time, string) {
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	return capture.lastWriteAt, string(capture.trailing)
+}
+
+func (capture *streamCapture) result() commandOutput {
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	omittedLines, omittedBytes := capture.combined.omitted()
+	chunks := make([]outputChunk, 0, len(capture.headChunks)+len(capture.tailChunks))
+	chunks = append(chunks, capture.headChunks...)
+	chunks = append(chunks, capture.tailChunks...)
+	return commandOutput{
+		Combined:     capture.combined.String(),
+		Stdout:       capture.stdout.String(),
+		Stderr:       capture.stderr.String(),
+		Chunks:       chunks,
+		OmittedLines: omittedLines,
+		OmittedBytes: omittedBytes,
+		OutputBytes:  capture.combined.totalBytes,
+	}
+}
+
+func max64(a int64, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,11 @@
+package main
+
+// cgroupUsage is what the kernel accounted for a job's transient cgroup.
+type cgroupUsage struct {
+	Path             string `json:"-"`
+	MemoryLimitBytes int64  `json:"memory_limit_bytes,omitempty"`
+	PeakMemoryBytes  int64  `json:"peak_memory_bytes,omitempty"`
+	CPUUsageMS       int64  `json:"cpu_usage_ms"`
+	PeakPids         int64  `json:"peak_pids,omitempty"`
+	OOMKills         int64  `json:"oom_kills,omitempty"`
+}
@@ -0,0 +1,223 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	cgroupV2Mount      = "/sys/fs/cgroup"
+	cgroupCPUPeriodUS  = 100000
+	cgroupDaemonLeaf   = "smartshd-daemon"
+	cgroupJobDirPrefix = "smartsh-job-"
+)
+
+var (
+	cgroupRootOnce  sync.Once
+	cgroupRootPath  string
+	cgroupRootError error
+	cgroupJobSeq    atomic.Int64
+)
+
+// cgroupJob is a transient cgroup v2 directory holding one command's process
+// tree.
+type cgroupJob struct {
+	path string
+	dir  *os.File
+}
+
+// startCgroupJob creates a cgroup for one isolated command and applies its
+// limits. It returns nil when cgroup v2 is not delegated to smartshd, in which
+// case callers fall back to ulimits.
+func startCgroupJob(isolation isolationOptions) *cgroupJob {
+	if parseBooleanEnv("SMARTSH_DISABLE_CGROUPS") {
+		return nil
+	}
+	root, err := delegatedCgroupRoot()
+	if err != nil {
+		return nil
+	}
+	path := filepath.Join(root, fmt.Sprintf("%s%d-%d", cgroupJobDirPrefix, os.Getpid(), cgroupJobSeq.Add(1)))
+	if err := os.Mkdir(path, 0o755); err != nil {
+		return nil
+	}
+	job := &cgroupJob{path: path}
+	limits := map[string]string{}
+	if isolation.MaxMemoryMB > 0 {
+		limits["memory.max"] = strconv.FormatInt(int64(isolation.MaxMemoryMB)*1024*1024, 10)
+		// Fail fast with an OOM kill instead of swapping the machine to a halt.
+		limits["memory.swap.max"] = "0"
+	}
+	if isolation.MaxCPUPercent > 0 {
+		limits["cpu.max"] = fmt.Sprintf("%d %d", isolation.MaxCPUPercent*cgroupCPUPeriodUS/100, cgroupCPUPeriodUS)
+	}
+	if isolation.MaxPids > 0 {
+		limits["pids.max"] = strconv.Itoa(isolation.MaxPids)
+	}
+	for file, value := range limits {
+		if err := os.WriteFile(filepath.Join(path, file), []byte(value), 0o644); err != nil && file != "memory.swap.max" {
+			job.remove()
+			return nil
+		}
+	}
+	dir, err := os.Open(path)
+	if err != nil {
+		job.remove()
+		return nil
+	}
+	job.dir = dir
+	return job
+}
+
+// attach makes the child start directly inside the job cgroup, so nothing it
+// forks can escape the limits before being moved.
+func (job *cgroupJob) attach(execCommand *exec.Cmd) {
+	if job == nil {
+		return
+	}
+	if execCommand.SysProcAttr == nil {
+		execCommand.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	execCommand.SysProcAttr.UseCgroupFD = true
+	execCommand.SysProcAttr.CgroupFD = int(job.dir.Fd())
+}
+
+// finish reads peak usage back and removes the cgroup, killing anything left
+// in it first.
+func (job *cgroupJob) finish() *cgroupUsage {
+	if job == nil {
+		return nil
+	}
+	usage := &cgroupUsage{
+		Path:             job.path,
+		MemoryLimitBytes: readCgroupInt(job.path, "memory.max"),
+		PeakMemoryBytes:  readCgroupInt(job.path, "memory.peak"),
+		CPUUsageMS:       readCgroupKeyed(job.path, "cpu.stat", "usage_usec") / 1000,
+		PeakPids:         readCgroupInt(job.path, "pids.peak"),
+		OOMKills:         readCgroupKeyed(job.path, "memory.events", "oom_kill"),
+	}
+	job.remove()
+	return usage
+}
+
+func (job *cgroupJob) remove() {
+	if job.dir != nil {
+		_ = job.dir.Close()
+	}
+	_ = os.WriteFile(filepath.Join(job.path, "cgroup.kill"), []byte("1"), 0o644)
+	for attempt := 0; attempt < 20; attempt++ {
+		if err := os.Remove(job.path); err == nil || errors.Is(err, os.ErrNotExist) {
+			return
+		}
+		time.Sleep(25 * time.Millisecond)
+	}
+}
+
+// delegatedCgroupRoot finds a cgroup v2 directory smartshd may create job
+// cgroups under: SMARTSH_CGROUP_ROOT, or the daemon's own cgroup. Because
+// cgroup v2 forbids enabling controllers for children of a cgroup that still
+// holds processes, the daemon moves itself into a leaf child first.
+func delegatedCgroupRoot() (string, error) {
+	cgroupRootOnce.Do(func() {
+		cgroupRootPath, cgroupRootError = prepareCgroupRoot()
+	})
+	return cgroupRootPath, cgroupRootError
+}
+
+func prepareCgroupRoot() (string, error) {
+	root := strings.TrimSpace(os.Getenv("SMARTSH_CGROUP_ROOT"))
+	ownCgroup := root == ""
+	if ownCgroup {
+		content, err := os.ReadFile("/proc/self/cgroup")
+		if err != nil {
+			return "", err
+		}
+		relative, ok := parseCgroupV2Path(string(content))
+		if !ok {
+			return "", errors.New("cgroup v2 unified hierarchy not in use")
+		}
+		root = filepath.Join(cgroupV2Mount, relative)
+	}
+	controllersContent, err := os.ReadFile(filepath.Join(root, "cgroup.controllers"))
+	if err != nil {
+		return "", fmt.Errorf("cgroup v2 not available at %s: %w", root, err)
+	}
+	available := strings.Fields(string(controllersContent))
+	wanted := make([]string, 0, 3)
+	for _, controller := range []string{"memory", "cpu", "pids"} {
+		for _, candidate := range available {
+			if candidate == controller {
+				wanted = append(wanted, "+"+controller)
+			}
+		}
+	}
+	if len(wanted) == 0 {
+		return "", errors.New("no cgroup controllers delegated")
+	}
+	subtreeControl := filepath.Join(root, "cgroup.subtree_control")
+	enableErr := os.WriteFile(subtreeControl, []byte(strings.Join(wanted, " ")), 0o644)
+	if enableErr != nil && ownCgroup && errors.Is(enableErr, syscall.EBUSY) {
+		leaf := filepath.Join(root, cgroupDaemonLeaf)
+		if err := os.MkdirAll(leaf, 0o755); err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0o644); err != nil {
+			return "", err
+		}
+		enableErr = os.WriteFile(subtreeControl, []byte(strings.Join(wanted, " ")), 0o644)
+	}
+	if enableErr != nil {
+		return "", fmt.Errorf("enable cgroup controllers: %w", enableErr)
+	}
+	return root, nil
+}
+
+// parseCgroupV2Path extracts the unified hierarchy entry ("0::/path") from
+// /proc/self/cgroup.
+func parseCgroupV2Path(content string) (string, bool) {
+	for _, line := range splitNonEmptyLines(content) {
+		if strings.HasPrefix(line, "0::") {
+			return strings.TrimPrefix(line, "0::"), true
+		}
+	}
+	return "", false
+}
+
+func readCgroupInt(path string, file string) int64 {
+	content, err := os.ReadFile(filepath.Join(path, file))
+	if err != nil {
+		return 0
+	}
+	value, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		// "max" and other non-numeric values mean no limit.
+		return 0
+	}
+	return value
+}
+
+func readCgroupKeyed(path string, file string, key string) int64 {
+	content, err := os.ReadFile(filepath.Join(path, file))
+	if err != nil {
+		return 0
+	}
+	for _, line := range splitNonEmptyLines(string(content)) {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == key {
+			value, _ := strconv.ParseInt(fields[1], 10, 64)
+			return value
+		}
+	}
+	return 0
+}
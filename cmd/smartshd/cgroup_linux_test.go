@@ -0,0 +1,50 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func TestParseCgroupV2Path(t *testing.T) {
+	hybrid := "4:memory:/user.slice\n1:name=systemd:/user.slice\n0::/user.slice/smartshd.service\n"
+	path, ok := parseCgroupV2Path(hybrid)
+	if !ok || path != "/user.slice/smartshd.service" {
+		t.Fatalf("unexpected cgroup path %q (ok=%v)", path, ok)
+	}
+	if _, ok := parseCgroupV2Path("4:memory:/\n1:cpu:/\n"); ok {
+		t.Fatalf("expected v1-only hierarchy to be rejected")
+	}
+}
+
+func TestWrapWithULimits_SkipsVirtualMemoryInCgroup(t *testing.T) {
+	isolation := isolationOptions{MaxMemoryMB: 256, MaxCPUSeconds: 10}
+	if wrapped := wrapWithULimits("go test ./...", isolation, false); wrapped != "ulimit -t 10; ulimit -v 262144; go test ./..." {
+		t.Fatalf("unexpected ulimit wrapping: %q", wrapped)
+	}
+	if wrapped := wrapWithULimits("go test ./...", isolation, true); wrapped != "ulimit -t 10; go test ./..." {
+		t.Fatalf("unexpected cgroup wrapping: %q", wrapped)
+	}
+}
+
+func TestRunCommandWithCapture_ReportsCgroupUsage(t *testing.T) {
+	isolation := isolationOptions{Isolated: true, MaxOutputKB: 16, MaxMemoryMB: 128, MaxPids: 32}
+	probe := startCgroupJob(isolation)
+	if probe == nil {
+		t.Skip("cgroup v2 is not delegated in this environment")
+	}
+	probe.finish()
+
+	_, output, err := runCommandWithCapture(context.Background(), "echo inside", t.TempDir(), isolation, os.Environ(), nil)
+	if err != nil {
+		t.Fatalf("command failed: %v", err)
+	}
+	if output.Cgroup == nil || output.Cgroup.MemoryLimitBytes != 128*1024*1024 {
+		t.Fatalf("expected cgroup usage with memory limit, got %+v", output.Cgroup)
+	}
+	if _, statErr := os.Stat(output.Cgroup.Path); !os.IsNotExist(statErr) {
+		t.Fatalf("expected job cgroup to be removed, stat err=%v", statErr)
+	}
+}
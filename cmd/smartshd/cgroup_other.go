@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import "os/exec"
+
+// cgroupJob is unavailable outside Linux; isolated commands use ulimits.
+type cgroupJob struct{}
+
+func startCgroupJob(isolation isolationOptions) *cgroupJob { return nil }
+
+func (job *cgroupJob) attach(execCommand *exec.Cmd) {}
+
+func (job *cgroupJob) finish() *cgroupUsage { return nil }
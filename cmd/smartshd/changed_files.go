@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	changedFilesGitTimeout  = 10 * time.Second
+	maxChangedFiles         = 200
+	maxSnapshotFileBytes    = 256 * 1024
+	maxSnapshotContentBytes = 4 * 1024 * 1024
+)
+
+// workTreeEntry is the state of one path that git reports as dirty, captured
+// so that a later snapshot can tell whether the command touched it again.
+type workTreeEntry struct {
+	status  string
+	exists  bool
+	size    int64
+	modTime time.Time
+	hash    [sha256.Size]byte
+	content []byte
+}
+
+type workTreeSnapshot struct {
+	root    string
+	entries map[string]workTreeEntry
+}
+
+// captureWorkTreeSnapshot records git status and the mtime of every dirty
+// path under cwd's work tree. With keepContent it also keeps the content of
+// small tracked files with uncommitted edits, which is what line counts need;
+// untracked files are only stat'ed. It returns nil outside a git work tree.
+func captureWorkTreeSnapshot(cwd string, keepContent bool) *workTreeSnapshot {
+	if parseBooleanEnv("SMARTSH_DISABLE_CHANGED_FILES") {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), changedFilesGitTimeout)
+	defer cancel()
+	topLevel, err := exec.CommandContext(ctx, "git", "-C", cwd, "rev-parse", "--show-toplevel").Output()
+	if err != nil {
+		return nil
+	}
+	root := strings.TrimSpace(string(topLevel))
+	status, err := exec.CommandContext(ctx, "git", "--no-optional-locks", "-C", root, "status", "--porcelain=v1", "-z", "--untracked-files=all").Output()
+	if err != nil {
+		return nil
+	}
+	snapshot := &workTreeSnapshot{root: root, entries: map[string]workTreeEntry{}}
+	keptBytes := int64(0)
+	records := bytes.Split(status, []byte{0})
+	for index := 0; index < len(records); index++ {
+		record := string(records[index])
+		if len(record) < 4 {
+			continue
+		}
+		code := record[:2]
+		path := record[3:]
+		if code[0] == 'R' || code[0] == 'C' {
+			// Renames and copies are followed by the original path.
+			index++
+		}
+		entry := workTreeEntry{status: code}
+		if info, statErr := os.Stat(filepath.Join(root, path)); statErr == nil && !info.IsDir() {
+			entry.exists = true
+			entry.size = info.Size()
+			entry.modTime = info.ModTime()
+			if keepContent && code != "??" && info.Size() <= maxSnapshotFileBytes && keptBytes+info.Size() <= maxSnapshotContentBytes {
+				if content, readErr := os.ReadFile(filepath.Join(root, path)); readErr == nil {
+					entry.content = content
+					entry.hash = sha256.Sum256(content)
+					keptBytes += int64(len(content))
+				}
+			}
+		}
+		snapshot.entries[path] = entry
+	}
+	return snapshot
+}
+
+// diffWorkTreeSnapshots lists the paths whose status, mtime or size changed
+// between two snapshots, with line counts against their previous content.
+// Paths that were clean before are compared with HEAD. The second return value
+// is the number of changes left out of the list.
+func diffWorkTreeSnapshots(before *workTreeSnapshot, after *workTreeSnapshot) ([]changedFile, int) {
+	if before == nil || after == nil || before.root != after.root {
+		return nil, 0
+	}
+	paths := make([]string, 0)
+	for path := range after.entries {
+		paths = append(paths, path)
+	}
+	for path := range before.entries {
+		if _, ok := after.entries[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	changes := make([]changedFile, 0)
+	cleanBefore := make([]string, 0)
+	for _, path := range paths {
+		previous, wasDirty := before.entries[path]
+		current, isDirty := after.entries[path]
+		if wasDirty && isDirty && previous.status == current.status && previous.exists == current.exists &&
+			previous.size == current.size && previous.modTime.Equal(current.modTime) {
+			continue
+		}
+		if !isDirty {
+			// The command restored a dirty path to its committed state.
+			current = workTreeEntry{exists: fileExists(filepath.Join(after.root, path))}
+		}
+		change := changedFile{Path: path}
+		switch {
+		case !current.exists:
+			change.Change = "deleted"
+		case (!wasDirty && strings.Contains(current.status, "?")) || (wasDirty && !previous.exists) || (!wasDirty && strings.HasPrefix(current.status, "A")):
+			change.Change = "added"
+		default:
+			change.Change = "modified"
+		}
+		if change.Change == "modified" && wasDirty && previous.content != nil {
+			if content, err := os.ReadFile(filepath.Join(after.root, path)); err == nil && sha256.Sum256(content) == previous.hash {
+				// Touched but not changed.
+				continue
+			}
+		}
+		if !wasDirty && current.status != "??" {
+			cleanBefore = append(cleanBefore, path)
+		} else {
+			fillLineStats(&change, after.root, previous)
+		}
+		changes = append(changes, change)
+	}
+	if len(cleanBefore) > 0 {
+		fillNumStats(changes, after.root, cleanBefore)
+	}
+	omitted := 0
+	if len(changes) > maxChangedFiles {
+		omitted = len(changes) - maxChangedFiles
+		changes = changes[:maxChangedFiles]
+	}
+	return changes, omitted
+}
+
+// fillNumStats fills insertions and deletions from git diff for paths that
+// matched HEAD before the run.
+func fillNumStats(changes []changedFile, root string, paths []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), changedFilesGitTimeout)
+	defer cancel()
+	args := append([]string{"--no-optional-locks", "-C", root, "diff", "--numstat", "HEAD", "--"}, paths...)
+	output, err := exec.CommandContext(ctx, "git", args...).Output()
+	if err != nil {
+		return
+	}
+	byPath := map[string]int{}
+	for index, change := range changes {
+		byPath[change.Path] = index
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		index, ok := byPath[fields[2]]
+		if !ok {
+			continue
+		}
+		if fields[0] == "-" {
+			changes[index].Binary = true
+			continue
+		}
+		changes[index].Insertions, _ = strconv.Atoi(fields[0])
+		changes[index].Deletions, _ = strconv.Atoi(fields[1])
+	}
+}
+
+// fillLineStats compares the current content of a path with its snapshot.
+// Lines are matched as a multiset, which is exact for appends and removals
+// and close enough for the diffstat of edits.
+func fillLineStats(change *changedFile, root string, previous workTreeEntry) {
+	if previous.exists && previous.content == nil {
+		// Too large to snapshot; the change is reported without line counts.
+		return
+	}
+	current, _ := os.ReadFile(filepath.Join(root, change.Path))
+	if bytes.IndexByte(current, 0) >= 0 || bytes.IndexByte(previous.content, 0) >= 0 {
+		change.Binary = true
+		return
+	}
+	remaining := map[string]int{}
+	for _, line := range splitContentLines(previous.content) {
+		remaining[line]++
+	}
+	for _, line := range splitContentLines(current) {
+		if remaining[line] > 0 {
+			remaining[line]--
+			continue
+		}
+		change.Insertions++
+	}
+	for _, count := range remaining {
+		change.Deletions += count
+	}
+}
+
+func splitContentLines(content []byte) []string {
+	if len(content) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// summarizeChangedFiles renders a one-line diffstat such as
+// "3 files changed (1 added, 2 modified), +10 -4".
+func summarizeChangedFiles(changes []changedFile, omitted int) string {
+	if len(changes) == 0 {
+		return ""
+	}
+	counts := map[string]int{}
+	insertions, deletions := 0, 0
+	for _, change := range changes {
+		counts[change.Change]++
+		insertions += change.Insertions
+		deletions += change.Deletions
+	}
+	parts := make([]string, 0, 3)
+	for _, kind := range []string{"added", "modified", "deleted"} {
+		if counts[kind] > 0 {
+			parts = append(parts, strconv.Itoa(counts[kind])+" "+kind)
+		}
+	}
+	total := len(changes) + omitted
+	noun := "files"
+	if total == 1 {
+		noun = "file"
+	}
+	return strconv.Itoa(total) + " " + noun + " changed (" + strings.Join(parts, ", ") + "), +" + strconv.Itoa(insertions) + " -" + strconv.Itoa(deletions)
+}
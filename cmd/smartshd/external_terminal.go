@@ -30,7 +30,7 @@ func runCommandViaExternalTerminal(
 
 	effectiveCommand := command
 	if isolation.Isolated {
-		effectiveCommand = wrapWithULimits(command, isolation)
+		effectiveCommand = wrapWithULimits(command, isolation, false)
 	}
 
 	tempDir, err := os.MkdirTemp("", "smartsh-ext-terminal-*")
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	defaultInputIdleSec = 5
+	inputWaitPoll       = 250 * time.Millisecond
+	maxInputPromptChars = 300
+)
+
+// strongPromptPattern matches lines that ask for input even when followed by
+// a newline; weakPromptPattern only counts on an unterminated last line. They
+// only pick the prompt text to report: ordinary logs mention passwords and
+// end lines in colons, so they never stop a command on their own.
+var (
+	strongPromptPattern = regexp.MustCompile(`(?i)(\[y/n\]|\(y/n\)|\[yes/no\]|\(yes/no\)|password|passphrase|press (enter|return|any key)|\bcontinue\?)`)
+	weakPromptPattern   = regexp.MustCompile(`(?i)([?:>]|\([yn]\)|\[[yn]\])\s*$`)
+)
+
+// waitingForInputError ends a command that sat idle on a prompt; it is the
+// cancellation cause of the command's context.
+type waitingForInputError struct {
+	Prompt string
+}
+
+func (err *waitingForInputError) Error() string {
+	return "command is waiting for input: " + err.Prompt
+}
+
+// watchForInputPrompt polls the capture while the command runs. Once output
+// has been idle for SMARTSH_INPUT_IDLE_SEC and a member of the process group
+// is blocked reading a terminal, it cancels the command with a
+// waitingForInputError carrying the trailing prompt. Where that cannot be
+// checked it never fires. The returned func stops it.
+func watchForInputPrompt(pid int, capture *streamCapture, cancel context.CancelCauseFunc) func() {
+	if parseBooleanEnv("SMARTSH_DISABLE_INPUT_DETECTION") {
+		return func() {}
+	}
+	idle := time.Duration(parsePositiveIntEnv("SMARTSH_INPUT_IDLE_SEC", defaultInputIdleSec)) * time.Second
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(inputWaitPoll)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			lastWriteAt, trailing := capture.idleState()
+			if time.Since(lastWriteAt) < idle || !processGroupAwaitingTerminal(pid) {
+				continue
+			}
+			prompt := firstNonEmpty(detectInputPrompt(trailing), truncatePrompt(lastNonEmptyLine(trailing)), "(no prompt text)")
+			cancel(&waitingForInputError{Prompt: prompt})
+			return
+		}
+	}()
+	return func() { close(done) }
+}
+
+// detectInputPrompt returns the prompt at the end of output, or "" when the
+// output does not look like one.
+func detectInputPrompt(trailing string) string {
+	trailing = strings.ReplaceAll(trailing, "\r", "\n")
+	lastLine := trailing[strings.LastIndex(trailing, "\n")+1:]
+	if strings.TrimSpace(lastLine) != "" {
+		if strongPromptPattern.MatchString(lastLine) || weakPromptPattern.MatchString(lastLine) {
+			return truncatePrompt(lastLine)
+		}
+		return ""
+	}
+	if line := lastNonEmptyLine(trailing); strongPromptPattern.MatchString(line) {
+		return truncatePrompt(line)
+	}
+	return ""
+}
+
+func lastNonEmptyLine(text string) string {
+	lines := splitNonEmptyLines(text)
+	if len(lines) == 0 {
+		return ""
+	}
+	return lines[len(lines)-1]
+}
+
+func truncatePrompt(prompt string) string {
+	prompt = strings.TrimSpace(prompt)
+	if len(prompt) > maxInputPromptChars {
+		prompt = prompt[len(prompt)-maxInputPromptChars:]
+	}
+	return prompt
+}
@@ -0,0 +1,60 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// processGroupAwaitingTerminal reports whether a member of the process group
+// is blocked in a terminal read, or was stopped by SIGTTIN for reading one
+// from the background.
+func processGroupAwaitingTerminal(pgid int) bool {
+	statPaths, _ := filepath.Glob("/proc/[0-9]*/stat")
+	for _, statPath := range statPaths {
+		raw, err := os.ReadFile(statPath)
+		if err != nil {
+			continue
+		}
+		// The command name may contain spaces; fields resume after ") ".
+		closing := strings.LastIndexByte(string(raw), ')')
+		if closing < 0 {
+			continue
+		}
+		fields := strings.Fields(string(raw[closing+1:]))
+		if len(fields) < 3 || fields[2] != strconv.Itoa(pgid) {
+			continue
+		}
+		if fields[0] == "T" || processAwaitingTerminal(filepath.Dir(statPath)) {
+			return true
+		}
+	}
+	return false
+}
+
+// processAwaitingTerminal reports whether the process is sleeping in a
+// terminal read: either its wait channel is the tty line discipline, or it is
+// blocked in read(2) on a descriptor that points at a terminal. Newer kernels
+// report a generic wait channel, so the syscall is what usually decides.
+func processAwaitingTerminal(procDir string) bool {
+	wchan, _ := os.ReadFile(filepath.Join(procDir, "wchan"))
+	if strings.TrimSpace(string(wchan)) == "n_tty_read" {
+		return true
+	}
+	raw, err := os.ReadFile(filepath.Join(procDir, "syscall"))
+	fields := strings.Fields(string(raw))
+	if err != nil || len(fields) < 2 || fields[0] != strconv.Itoa(unix.SYS_READ) {
+		return false
+	}
+	fd, err := strconv.ParseUint(strings.TrimPrefix(fields[1], "0x"), 16, 32)
+	if err != nil {
+		return false
+	}
+	target, err := os.Readlink(filepath.Join(procDir, "fd", strconv.FormatUint(fd, 10)))
+	return err == nil && (strings.HasPrefix(target, "/dev/pts/") || strings.HasPrefix(target, "/dev/tty"))
+}
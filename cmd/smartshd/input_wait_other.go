@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+// processGroupAwaitingTerminal has no portable implementation, so input
+// detection never stops a command on other platforms.
+func processGroupAwaitingTerminal(pgid int) bool {
+	return false
+}
@@ -0,0 +1,154 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const landlockFileWriteAccess = unix.LANDLOCK_ACCESS_FS_WRITE_FILE
+
+// landlockDeviceFiles stay writable under confinement; shells redirect to them
+// constantly.
+var landlockDeviceFiles = []string{"/dev/null", "/dev/zero", "/dev/full", "/dev/tty", "/dev/ptmx", "/dev/pts"}
+
+func landlockABIVersion() int {
+	version, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return 0
+	}
+	return int(version)
+}
+
+// landlockWriteAccess is every filesystem right that modifies something, for
+// the rights the running kernel knows about. Reads and execution stay
+// unrestricted.
+func landlockWriteAccess(abi int) uint64 {
+	access := uint64(unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_FILE |
+		unix.LANDLOCK_ACCESS_FS_MAKE_CHAR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_REG |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_FIFO |
+		unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SYM)
+	if abi >= 2 {
+		access |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+	if abi >= 3 {
+		access |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+	return access
+}
+
+// landlockWriteRules turns the writable roots into the paths to grant,
+// leaving denied paths out. Landlock can only grant access, so a root that
+// contains a denied path is replaced by grants on each of its entries, down
+// the chain of directories that lead to the denied path; new entries cannot
+// be created directly in those directories. Symlinks are never followed.
+func landlockWriteRules(writable []string, denied []string) []string {
+	rules := make([]string, 0, len(writable))
+	var expand func(path string)
+	expand = func(path string) {
+		if pathWithinAny(path, denied) {
+			return
+		}
+		if !deniedBelow(path, denied) {
+			rules = append(rules, path)
+			return
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return
+		}
+		for _, entry := range entries {
+			if entry.Type()&os.ModeSymlink == 0 {
+				expand(filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+	for _, root := range writable {
+		expand(root)
+	}
+	return rules
+}
+
+func deniedBelow(path string, denied []string) bool {
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	for _, deniedPath := range denied {
+		if strings.HasPrefix(deniedPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// restrictWritesWithLandlock confines the calling thread, and everything it
+// execs, to writing beneath the given paths. Files get only the rights that
+// apply to files.
+func restrictWritesWithLandlock(writable []string) error {
+	abi := landlockABIVersion()
+	if abi <= 0 {
+		return fmt.Errorf("landlock unsupported")
+	}
+	handled := landlockWriteAccess(abi)
+	rulesetAttr := unix.LandlockRulesetAttr{Access_fs: handled}
+	rulesetFD, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&rulesetAttr)), unsafe.Sizeof(rulesetAttr), 0)
+	if errno != 0 {
+		return fmt.Errorf("create landlock ruleset: %w", errno)
+	}
+	defer unix.Close(int(rulesetFD))
+
+	fileAccess := uint64(landlockFileWriteAccess)
+	if abi >= 3 {
+		fileAccess |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+	for _, path := range writable {
+		access := handled
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			access = fileAccess
+		}
+		if err := addLandlockPathRule(int(rulesetFD), path, access); err != nil {
+			return err
+		}
+	}
+	for _, path := range landlockDeviceFiles {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		access := fileAccess
+		if info.IsDir() {
+			access = handled
+		}
+		_ = addLandlockPathRule(int(rulesetFD), path, access)
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_LANDLOCK_RESTRICT_SELF, rulesetFD, 0, 0); errno != 0 {
+		return fmt.Errorf("landlock restrict self: %w", errno)
+	}
+	return nil
+}
+
+func addLandlockPathRule(rulesetFD int, path string, access uint64) error {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("open %s for landlock: %w", path, err)
+	}
+	defer unix.Close(fd)
+	rule := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(fd)}
+	if _, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(rulesetFD), unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&rule)), 0, 0, 0); errno != 0 {
+		return fmt.Errorf("landlock rule for %s: %w", path, errno)
+	}
+	return nil
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -27,14 +30,29 @@ func main() {
 	defer store.Close()
 
 	server := newDaemonServer(store)
+	report, recoveryErr := server.recoverInterruptedJobs()
+	if recoveryErr != nil {
+		fmt.Fprintf(os.Stderr, "smartshd job recovery failed: %v\n", recoveryErr)
+	} else if report.Interrupted > 0 || report.ExpiredApprovals > 0 {
+		fmt.Printf("smartshd recovered %d interrupted jobs (%d re-queued), expired %d approvals\n", report.Interrupted, report.Resumed, report.ExpiredApprovals)
+	}
+	go store.pruneOutputLogsPeriodically()
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", server.handleHealth)
 	mux.HandleFunc("/run", server.handleRun)
+	mux.HandleFunc("/batch", server.handleBatch)
 	mux.HandleFunc("/jobs", server.handleJobs)
 	mux.HandleFunc("/jobs/", server.handleJobRoutes)
 	mux.HandleFunc("/approvals/", server.handleApprovalRoutes)
 	mux.HandleFunc("/sessions", server.handleSessions)
 	mux.HandleFunc("/sessions/", server.handleSessionRoutes)
+	mux.HandleFunc("/tasks", server.handleTasks)
+	mux.HandleFunc("/shell-sessions", server.handleShellSessions)
+	mux.HandleFunc("/shell-sessions/", server.handleShellSessionRoutes)
+	mux.HandleFunc("/watches", server.handleWatches)
+	mux.HandleFunc("/watches/", server.handleWatchRoutes)
+	mux.HandleFunc("/services", server.handleServices)
+	mux.HandleFunc("/services/", server.handleServiceRoutes)
 	mux.HandleFunc("/metrics", server.handleMetrics)
 
 	address := strings.TrimSpace(os.Getenv("SMARTSH_DAEMON_ADDR"))
@@ -48,11 +66,25 @@ func main() {
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
+	// Services run in their own process groups; stop them before exiting.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-signals
+		server.stopServices()
+		shutdownContext, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = httpServer.Shutdown(shutdownContext)
+	}()
+
 	fmt.Printf("smartshd listening on http://%s\n", address)
 	if serveError := httpServer.ListenAndServe(); serveError != nil && serveError != http.ErrServerClosed {
 		fmt.Fprintf(os.Stderr, "smartshd failed: %v\n", serveError)
 		os.Exit(1)
 	}
+	<-shutdownDone
 }
 
 func handleControlCommand(args []string) bool {
@@ -3,18 +3,26 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/creack/pty"
 )
 
 func TestDeterministicSummary_Jest(t *testing.T) {
 	output := readFixture(t, "jest_fail.log")
-	result := deterministicSummary("npm test", 1, output, nil)
+	result := deterministicSummary("npm test", 1, output, "", nil)
 	if result.ErrorType != "test" {
 		t.Fatalf("expected test error type, got %q", result.ErrorType)
 	}
@@ -28,7 +36,7 @@ func TestDeterministicSummary_Jest(t *testing.T) {
 
 func TestDeterministicSummary_GoTest(t *testing.T) {
 	output := readFixture(t, "go_test_fail.log")
-	result := deterministicSummary("go test ./...", 1, output, nil)
+	result := deterministicSummary("go test ./...", 1, output, "", nil)
 	if result.ErrorType != "test" {
 		t.Fatalf("expected test error type, got %q", result.ErrorType)
 	}
@@ -39,7 +47,7 @@ func TestDeterministicSummary_GoTest(t *testing.T) {
 
 func TestDeterministicSummary_TypeScript(t *testing.T) {
 	output := readFixture(t, "tsc_fail.log")
-	result := deterministicSummary("npm run build", 1, output, nil)
+	result := deterministicSummary("npm run build", 1, output, "", nil)
 	if result.ErrorType != "compile" {
 		t.Fatalf("expected compile error type, got %q", result.ErrorType)
 	}
@@ -60,7 +68,7 @@ func TestResolveSummary_SuccessIgnoresOllamaFailureText(t *testing.T) {
 	t.Setenv("SMARTSH_OLLAMA_REQUIRED", "true")
 	t.Setenv("SMARTSH_OLLAMA_URL", mockOllama.URL)
 
-	result := resolveSummary("ls -1", 0, "ok", nil, nil)
+	result := resolveSummary("ls -1", "", 0, "ok", "", nil, nil)
 	if result.Source != "deterministic" {
 		t.Fatalf("expected deterministic source for success, got %q", result.Source)
 	}
@@ -85,7 +93,7 @@ func TestResolveSummary_SuccessUsesOllamaWhenAlwaysEnabled(t *testing.T) {
 	t.Setenv("SMARTSH_OLLAMA_ALWAYS", "true")
 	t.Setenv("SMARTSH_OLLAMA_URL", mockOllama.URL)
 
-	result := resolveSummary("ls -1", 0, "ok", nil, nil)
+	result := resolveSummary("ls -1", "", 0, "ok", "", nil, nil)
 	if result.Source != "ollama" {
 		t.Fatalf("expected ollama source when SMARTSH_OLLAMA_ALWAYS=true, got %q", result.Source)
 	}
@@ -294,3 +302,1894 @@ func TestHandleApprovalRoutes_RejectsPendingApproval(t *testing.T) {
 		t.Fatalf("expected rejected approval status, got %+v", updatedApproval)
 	}
 }
+
+func TestHandleApprovalRoutes_SyncApprovalWaitsForSlot(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses posix utilities")
+	}
+	t.Setenv("SMARTSH_DAEMON_DISABLE_AUTH", "true")
+	t.Setenv("SMARTSH_SUMMARY_PROVIDER", "deterministic")
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+	server := newDaemonServer(store)
+	server.scheduler = newJobScheduler(1, 1)
+	if err := os.MkdirAll(filepath.Join(tempDir, "build"), 0o755); err != nil {
+		t.Fatalf("create build dir failed: %v", err)
+	}
+	pending := server.executeRequest(context.Background(), runRequest{Argv: []string{"rm", "-rf", "./build"}, Cwd: tempDir, RequireApproval: true}, "")
+	if pending.Status != "needs_approval" {
+		t.Fatalf("expected run to need approval, got %+v", pending)
+	}
+	busy := server.scheduler.enqueue("busy", "elsewhere", priorityInteractive)
+	if err := server.scheduler.wait(context.Background(), busy); err != nil {
+		t.Fatalf("wait failed: %v", err)
+	}
+
+	approve := func(ctx context.Context) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/approvals/"+pending.ApprovalID, strings.NewReader(`{"approved":true}`)).WithContext(ctx)
+		server.handleApprovalRoutes(recorder, request)
+		return recorder
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if recorder := approve(ctx); recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected the approval to wait for the busy slot, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "build")); err != nil {
+		t.Fatalf("expected nothing to run while queued: %v", err)
+	}
+
+	server.scheduler.release(busy)
+	if recorder := approve(context.Background()); !strings.Contains(recorder.Body.String(), `"status":"completed"`) {
+		t.Fatalf("expected the retried approval to run, got %s", recorder.Body.String())
+	}
+	if server.scheduler.running != 0 {
+		t.Fatalf("expected the slot to be released, %d still running", server.scheduler.running)
+	}
+}
+
+func TestHandleApprovalRoutes_RunsApprovedArgv(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses posix utilities")
+	}
+	t.Setenv("SMARTSH_DAEMON_DISABLE_AUTH", "true")
+	t.Setenv("SMARTSH_SUMMARY_PROVIDER", "deterministic")
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+	server := newDaemonServer(store)
+	buildDir := filepath.Join(tempDir, "build")
+	if err := os.MkdirAll(filepath.Join(buildDir, "cache"), 0o755); err != nil {
+		t.Fatalf("create build dir failed: %v", err)
+	}
+
+	pending := server.executeRequest(context.Background(), runRequest{
+		Argv:            []string{"rm", "-rf", "./build"},
+		Cwd:             tempDir,
+		RequireApproval: true,
+	}, "")
+	if pending.Status != "needs_approval" || pending.ApprovalID == "" {
+		t.Fatalf("expected argv run to need approval, got %+v", pending)
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/approvals/"+pending.ApprovalID, strings.NewReader(`{"approved":true}`))
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	server.handleApprovalRoutes(recorder, request)
+	response := runResponse{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("parse response failed: %v", err)
+	}
+	if response.Status != "completed" || response.ExitCode != 0 || response.Error != "" {
+		t.Fatalf("expected approved argv run to complete, got %+v", response)
+	}
+	if _, err := os.Stat(buildDir); !os.IsNotExist(err) {
+		t.Fatalf("expected approved argv run to remove build dir, got %v", err)
+	}
+	approval, err := store.GetApproval(pending.ApprovalID)
+	if err != nil || approval == nil || approval.Status != "executed" {
+		t.Fatalf("expected executed approval, got %+v (%v)", approval, err)
+	}
+}
+
+func TestHandleJobRoutes_CancelRunningJob(t *testing.T) {
+	t.Setenv("SMARTSH_DAEMON_DISABLE_AUTH", "true")
+	t.Setenv("SMARTSH_SUMMARY_PROVIDER", "deterministic")
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+
+	server := newDaemonServer(store)
+	runRequestBody := `{"command":"sleep 30","cwd":"` + tempDir + `","unsafe":true,"async":true}`
+	runRecorder := httptest.NewRecorder()
+	server.handleRun(runRecorder, httptest.NewRequest(http.MethodPost, "/run", strings.NewReader(runRequestBody)))
+	accepted := runResponse{}
+	if decodeError := json.Unmarshal(runRecorder.Body.Bytes(), &accepted); decodeError != nil {
+		t.Fatalf("parse run response failed: %v", decodeError)
+	}
+	if accepted.JobID == "" {
+		t.Fatalf("expected job id for async run")
+	}
+	waitForJobStatus(t, store, accepted.JobID, "running")
+
+	cancelRecorder := httptest.NewRecorder()
+	server.handleJobRoutes(cancelRecorder, httptest.NewRequest(http.MethodPost, "/jobs/"+accepted.JobID+"/cancel", nil))
+	if cancelRecorder.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", cancelRecorder.Code, cancelRecorder.Body.String())
+	}
+	job := waitForJobStatus(t, store, accepted.JobID, "cancelled")
+	if job.Result.Error == "" {
+		t.Fatalf("expected cancellation error message")
+	}
+
+	conflictRecorder := httptest.NewRecorder()
+	server.handleJobRoutes(conflictRecorder, httptest.NewRequest(http.MethodPost, "/jobs/"+accepted.JobID+"/cancel", nil))
+	if conflictRecorder.Code != http.StatusConflict {
+		t.Fatalf("expected status 409 for already cancelled job, got %d", conflictRecorder.Code)
+	}
+}
+
+func TestHandleJobRoutes_CancelWinsOverLaterCompletion(t *testing.T) {
+	t.Setenv("SMARTSH_DAEMON_DISABLE_AUTH", "true")
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+	server := newDaemonServer(store)
+
+	// The process has exited but its result is not stored yet when the
+	// cancel request arrives.
+	job := daemonJob{ID: "job_finishing", Result: runResponse{MustUseSmartsh: true, JobID: "job_finishing", Status: "running"}}
+	if saveError := store.Save(job); saveError != nil {
+		t.Fatalf("save failed: %v", saveError)
+	}
+	recorder := httptest.NewRecorder()
+	server.handleJobRoutes(recorder, httptest.NewRequest(http.MethodPost, "/jobs/job_finishing/cancel", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	server.updateJobWithApprovalResult(job.ID, runResponse{MustUseSmartsh: true, JobID: job.ID, Status: "completed", Executed: true, OutputTail: "done"})
+	stored, _ := store.Get(job.ID)
+	if stored.Result.Status != "cancelled" || !stored.Result.Executed || stored.Result.OutputTail != "done" {
+		t.Fatalf("expected the accepted cancel to stick with the run's details, got %+v", stored.Result)
+	}
+
+	// A job that finished first is not overwritten by a later cancel.
+	completed := daemonJob{ID: "job_done", Result: runResponse{MustUseSmartsh: true, JobID: "job_done", Status: "completed"}}
+	if saveError := store.Save(completed); saveError != nil {
+		t.Fatalf("save failed: %v", saveError)
+	}
+	recorder = httptest.NewRecorder()
+	server.handleJobRoutes(recorder, httptest.NewRequest(http.MethodPost, "/jobs/job_done/cancel", nil))
+	if recorder.Code != http.StatusConflict {
+		t.Fatalf("expected status 409 for finished job, got %d", recorder.Code)
+	}
+	if stored, _ := store.Get(completed.ID); stored.Result.Status != "completed" {
+		t.Fatalf("expected finished job to stay completed, got %q", stored.Result.Status)
+	}
+}
+
+func waitForJobStatus(t *testing.T, store *jobStore, jobID string, status string) *daemonJob {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := store.Get(jobID)
+		if err != nil {
+			t.Fatalf("get job failed: %v", err)
+		}
+		if job != nil && job.Result.Status == status {
+			return job
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not reach status %q", jobID, status)
+	return nil
+}
+
+func TestExecuteRequest_PublishesLiveOutputEvents(t *testing.T) {
+	t.Setenv("SMARTSH_SUMMARY_PROVIDER", "deterministic")
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+
+	server := newDaemonServer(store)
+	channel := make(chan jobEvent, 64)
+	server.subscribe("job_live", channel)
+	defer server.unsubscribe("job_live", channel)
+
+	response := server.executeRequest(context.Background(), runRequest{
+		Command: "echo first-chunk && echo second-chunk",
+		Cwd:     tempDir,
+		Unsafe:  true,
+	}, "job_live")
+	if response.Status != "completed" {
+		t.Fatalf("expected completed status, got %q", response.Status)
+	}
+
+	streamed := ""
+	lastSeq := int64(0)
+	for len(channel) > 0 {
+		event := <-channel
+		if event.Output == nil {
+			continue
+		}
+		if event.Output.Seq != lastSeq+1 {
+			t.Fatalf("expected sequential output events, got seq %d after %d", event.Output.Seq, lastSeq)
+		}
+		lastSeq = event.Output.Seq
+		streamed += event.Output.Data
+	}
+	if !strings.Contains(streamed, "first-chunk") || !strings.Contains(streamed, "second-chunk") {
+		t.Fatalf("expected streamed output to contain both chunks, got %q", streamed)
+	}
+}
+
+func TestBroadcast_DeliversStatusToSlowSubscribers(t *testing.T) {
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+
+	server := newDaemonServer(store)
+	channel := make(chan jobEvent, 4)
+	server.subscribe("job_slow", channel)
+	defer server.unsubscribe("job_slow", channel)
+
+	writer := &jobOutputWriter{server: server, jobID: "job_slow"}
+	for index := 0; index < 10; index++ {
+		writer.writeStream("stdout", []byte("line\n"))
+	}
+	server.publish("job_slow", runResponse{Status: "completed"})
+
+	var last jobEvent
+	for len(channel) > 0 {
+		last = <-channel
+	}
+	if last.Output != nil || last.Status.Status != "completed" {
+		t.Fatalf("expected the final status to be delivered last, got %+v", last)
+	}
+}
+
+func TestHandleJobOutput_PagesRetainedLog(t *testing.T) {
+	t.Setenv("SMARTSH_DAEMON_DISABLE_AUTH", "true")
+	t.Setenv("SMARTSH_SUMMARY_PROVIDER", "deterministic")
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+
+	server := newDaemonServer(store)
+	job := daemonJob{ID: "job_output", Result: runResponse{MustUseSmartsh: true, JobID: "job_output", Status: "running"}}
+	if saveError := store.Save(job); saveError != nil {
+		t.Fatalf("save failed: %v", saveError)
+	}
+	server.executeRequest(context.Background(), runRequest{
+		Command: "for i in 1 2 3 4 5 6 7 8 9 10; do echo line-$i; done; echo boom-error",
+		Cwd:     tempDir,
+		Unsafe:  true,
+	}, job.ID)
+
+	readPage := func(query string) jobOutputPage {
+		recorder := httptest.NewRecorder()
+		server.handleJobRoutes(recorder, httptest.NewRequest(http.MethodGet, "/jobs/job_output/output?"+query, nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("expected status 200 for %q, got %d: %s", query, recorder.Code, recorder.Body.String())
+		}
+		page := jobOutputPage{}
+		if decodeError := json.Unmarshal(recorder.Body.Bytes(), &page); decodeError != nil {
+			t.Fatalf("parse output page failed: %v", decodeError)
+		}
+		return page
+	}
+
+	first := readPage("offset=2&limit=3")
+	if first.TotalLines != 11 || len(first.Lines) != 3 || first.Lines[0].Text != "line-3" || !first.HasMore || first.NextOffset != 5 {
+		t.Fatalf("unexpected first page: %+v", first)
+	}
+	tail := readPage("offset=-2")
+	if len(tail.Lines) != 2 || tail.Lines[1].Text != "boom-error" || tail.Lines[1].Line != 11 {
+		t.Fatalf("unexpected tail page: %+v", tail)
+	}
+	grepped := readPage("grep=error")
+	if grepped.TotalLines != 1 || grepped.Lines[0].Line != 11 {
+		t.Fatalf("unexpected grep page: %+v", grepped)
+	}
+}
+
+func TestOutputLogWriter_FlushesOpenLogPeriodically(t *testing.T) {
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+
+	outputLog, err := store.CreateOutputLog("job_open")
+	if err != nil {
+		t.Fatalf("create output log failed: %v", err)
+	}
+	defer outputLog.Close()
+	for index := 1; index <= 3; index++ {
+		_, _ = outputLog.Write([]byte(fmt.Sprintf("line-%d\n", index)))
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, total, readErr := readOutputLogPage(store.OutputLogPath("job_open"), 0, 10, nil)
+		if readErr == nil && total == 3 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the open log to be readable, got %d lines (%v)", total, readErr)
+		}
+		time.Sleep(outputLogFlushInterval / 5)
+	}
+}
+
+func TestPruneOutputLogs_RemovesOnlyStaleLogs(t *testing.T) {
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+
+	for _, id := range []string{"job_old", "svc_old", "job_new"} {
+		outputLog, err := store.CreateOutputLog(id)
+		if err != nil {
+			t.Fatalf("create output log failed: %v", err)
+		}
+		_, _ = outputLog.Write([]byte("output\n"))
+		_ = outputLog.Close()
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	for _, id := range []string{"job_old", "svc_old"} {
+		if err := os.Chtimes(store.OutputLogPath(id), old, old); err != nil {
+			t.Fatalf("chtimes failed: %v", err)
+		}
+	}
+	if err := store.Save(daemonJob{ID: "job_old", Result: runResponse{Status: "completed"}}); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	removed, err := store.pruneOutputLogs(time.Now().Add(-24 * time.Hour))
+	if err != nil || removed != 2 {
+		t.Fatalf("expected two stale logs removed, got %d (%v)", removed, err)
+	}
+	if _, err := os.Stat(store.OutputLogPath("job_new")); err != nil {
+		t.Fatalf("expected recent log to be kept: %v", err)
+	}
+	if job, _ := store.Get("job_old"); job == nil {
+		t.Fatalf("expected the job record to be kept")
+	}
+}
+
+func TestDeterministicSummary_ParserHintRunsFirst(t *testing.T) {
+	output := "--- FAIL: TestWrapper (0.00s)\nFAIL\texample.com/wrapper\t0.01s\nFAILURE: Build failed with an exception.\nExecution failed for task ':app:compileJava'.\nBUILD FAILED in 3s\n"
+	if result := deterministicSummary("./build.sh", 1, output, "", nil); result.ErrorType != "test" {
+		t.Fatalf("expected go test parser to win without a hint, got %q", result.ErrorType)
+	}
+	result := deterministicSummaryWithParser("./build.sh", "gradle", 1, output, "", nil)
+	if result.ErrorType != "compile" || !strings.Contains(result.NextAction, "Gradle") {
+		t.Fatalf("expected gradle hint to classify the failure, got %+v", result)
+	}
+}
+
+func TestDeterministicSummary_PrefersStderrForPrimaryError(t *testing.T) {
+	stderr := "error: pathspec 'main' did not match\n"
+	output := "note: this is an error-free status line\n" + stderr
+	result := deterministicSummary("git checkout main", 1, output, stderr, nil)
+	if result.PrimaryError != "error: pathspec 'main' did not match" {
+		t.Fatalf("expected stderr issue line as primary error, got %q", result.PrimaryError)
+	}
+
+	result = deterministicSummary("git status", 128, "fatal: not a git repository\n", "fatal: not a git repository\n", nil)
+	if result.PrimaryError != "fatal: not a git repository" {
+		t.Fatalf("expected last stderr line when nothing matches, got %q", result.PrimaryError)
+	}
+}
+
+func TestExecuteRequest_CapturesStreamsSeparately(t *testing.T) {
+	t.Setenv("SMARTSH_SUMMARY_PROVIDER", "deterministic")
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+
+	server := newDaemonServer(store)
+	response := server.executeRequest(context.Background(), runRequest{
+		Command: "echo to-stdout; echo to-stderr 1>&2; exit 3",
+		Cwd:     tempDir,
+		Unsafe:  true,
+	}, "")
+	if response.Status != "failed" {
+		t.Fatalf("expected failed status, got %q", response.Status)
+	}
+	if strings.TrimSpace(response.StderrTail) != "to-stderr" {
+		t.Fatalf("expected stderr tail with only stderr output, got %q", response.StderrTail)
+	}
+	if !strings.Contains(response.OutputTail, "to-stdout") || !strings.Contains(response.OutputTail, "to-stderr") {
+		t.Fatalf("expected combined output tail, got %q", response.OutputTail)
+	}
+	streams := map[string]string{}
+	for _, chunk := range response.outputChunks {
+		if chunk.At.IsZero() {
+			t.Fatalf("expected timestamped output chunk, got %+v", chunk)
+		}
+		streams[chunk.Stream] += chunk.Data
+	}
+	if strings.TrimSpace(streams[streamStdout]) != "to-stdout" || strings.TrimSpace(streams[streamStderr]) != "to-stderr" {
+		t.Fatalf("expected chunks tagged by stream, got %+v", streams)
+	}
+}
+
+func TestHeadTailBuffer_KeepsStartAndEnd(t *testing.T) {
+	buffer := newHeadTailBuffer(16, 32)
+	for index := 1; index <= 100; index++ {
+		_, _ = buffer.Write([]byte(fmt.Sprintf("line-%03d\n", index)))
+	}
+	rendered := buffer.String()
+	if !strings.HasPrefix(rendered, "line-001\n") {
+		t.Fatalf("expected head to keep first line, got %q", rendered)
+	}
+	if !strings.HasSuffix(rendered, "line-100\n") {
+		t.Fatalf("expected tail to keep last line, got %q", rendered)
+	}
+	omittedLines, omittedBytes := buffer.omitted()
+	if omittedBytes != 900-16-32 {
+		t.Fatalf("expected %d omitted bytes, got %d", 900-16-32, omittedBytes)
+	}
+	if omittedLines <= 0 || omittedLines >= 100 {
+		t.Fatalf("expected omitted line count between 1 and 99, got %d", omittedLines)
+	}
+	if !strings.Contains(rendered, fmt.Sprintf("[smartshd omitted %d lines (%d bytes)]", omittedLines, omittedBytes)) {
+		t.Fatalf("expected omission marker, got %q", rendered)
+	}
+
+	small := newHeadTailBuffer(16, 32)
+	_, _ = small.Write([]byte("short output\n"))
+	if small.String() != "short output\n" {
+		t.Fatalf("expected untouched short output, got %q", small.String())
+	}
+}
+
+func TestExecuteRequest_FailureTailShowsEndOfLongOutput(t *testing.T) {
+	t.Setenv("SMARTSH_SUMMARY_PROVIDER", "deterministic")
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+
+	server := newDaemonServer(store)
+	response := server.executeRequest(context.Background(), runRequest{
+		Command:     "i=0; while [ $i -lt 2000 ]; do echo noisy-progress-line-$i; i=$((i+1)); done; echo final-compile-error; exit 2",
+		Cwd:         tempDir,
+		Unsafe:      true,
+		MaxOutputKB: 4,
+	}, "")
+	if response.Status != "failed" {
+		t.Fatalf("expected failed status, got %q", response.Status)
+	}
+	if !strings.Contains(response.OutputTail, "final-compile-error") {
+		t.Fatalf("expected output tail to include the final line, got %q", response.OutputTail)
+	}
+	if response.OmittedBytes == 0 || response.OmittedLines == 0 {
+		t.Fatalf("expected omitted counts for long output, got lines=%d bytes=%d", response.OmittedLines, response.OmittedBytes)
+	}
+}
+
+func TestHandleJobChunks_KeptOutOfJobList(t *testing.T) {
+	t.Setenv("SMARTSH_DAEMON_DISABLE_AUTH", "true")
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+	server := newDaemonServer(store)
+
+	job := daemonJob{
+		ID:     "job_chunks",
+		Result: runResponse{MustUseSmartsh: true, JobID: "job_chunks", Status: "failed"},
+		OutputChunks: []outputChunk{
+			{Stream: "stdout", At: time.Now(), Data: "building\n"},
+			{Stream: "stderr", At: time.Now(), Data: "error: boom\n"},
+		},
+	}
+	if saveError := store.Save(job); saveError != nil {
+		t.Fatalf("save failed: %v", saveError)
+	}
+	// A later save without chunks, such as a status update, keeps them.
+	job.OutputChunks = nil
+	job.Result.Summary = "updated"
+	if saveError := store.Save(job); saveError != nil {
+		t.Fatalf("save failed: %v", saveError)
+	}
+
+	recorder := httptest.NewRecorder()
+	server.handleJobs(recorder, httptest.NewRequest(http.MethodGet, "/jobs", nil))
+	if recorder.Code != http.StatusOK || strings.Contains(recorder.Body.String(), "error: boom") {
+		t.Fatalf("expected job list without output chunks, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	server.handleJobRoutes(recorder, httptest.NewRequest(http.MethodGet, "/jobs/job_chunks/chunks", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	payload := struct {
+		JobID  string        `json:"job_id"`
+		Chunks []outputChunk `json:"chunks"`
+	}{}
+	if decodeError := json.Unmarshal(recorder.Body.Bytes(), &payload); decodeError != nil {
+		t.Fatalf("parse chunks response failed: %v", decodeError)
+	}
+	if payload.JobID != job.ID || len(payload.Chunks) != 2 || payload.Chunks[1].Stream != "stderr" || payload.Chunks[1].Data != "error: boom\n" {
+		t.Fatalf("unexpected chunks response: %+v", payload)
+	}
+
+	recorder = httptest.NewRecorder()
+	server.handleJobRoutes(recorder, httptest.NewRequest(http.MethodGet, "/jobs/job_missing/chunks", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404 for unknown job, got %d", recorder.Code)
+	}
+}
+
+func TestJobScheduler_PrioritiesAndWorkspaceLimits(t *testing.T) {
+	scheduler := newJobScheduler(2, 1)
+	first := scheduler.enqueue("first", "/repo-a", priorityNormal)
+	blockedSameWorkspace := scheduler.enqueue("same-workspace", "/repo-a", priorityNormal)
+	otherWorkspace := scheduler.enqueue("other-workspace", "/repo-b", priorityBackground)
+	if !first.granted || !otherWorkspace.granted {
+		t.Fatalf("expected first and other-workspace tickets to run immediately")
+	}
+	if blockedSameWorkspace.granted {
+		t.Fatalf("expected per-workspace limit to hold back second repo-a ticket")
+	}
+
+	background := scheduler.enqueue("background", "/repo-c", priorityBackground)
+	interactive := scheduler.enqueue("interactive", "/repo-d", priorityInteractive)
+	if position, _, queued := scheduler.position("interactive"); !queued || position != 1 {
+		t.Fatalf("expected interactive ticket at queue position 1, got %d (queued=%v)", position, queued)
+	}
+
+	scheduler.release(otherWorkspace)
+	if !interactive.granted || background.granted {
+		t.Fatalf("expected interactive ticket to be dispatched before background")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if waitError := scheduler.wait(ctx, background); waitError == nil {
+		t.Fatalf("expected cancelled wait to return an error")
+	}
+	if _, _, queued := scheduler.position("background"); queued {
+		t.Fatalf("expected abandoned ticket to leave the queue")
+	}
+	metrics := scheduler.renderPrometheus()
+	if !strings.Contains(metrics, "smartsh_queue_depth 1") || !strings.Contains(metrics, "# TYPE smartsh_queue_depth_by_priority gauge\n") {
+		t.Fatalf("expected queue depth metrics, got:\n%s", metrics)
+	}
+}
+
+func TestRecoverInterruptedJobs_MarksResumesAndExpires(t *testing.T) {
+	t.Setenv("SMARTSH_DAEMON_DISABLE_AUTH", "true")
+	t.Setenv("SMARTSH_SUMMARY_PROVIDER", "deterministic")
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+
+	now := time.Now()
+	saveJob := func(id string, status string, request runRequest) {
+		job := daemonJob{ID: id, Request: request, CreatedAt: now, UpdatedAt: now, Result: runResponse{MustUseSmartsh: true, JobID: id, Status: status}}
+		if saveErr := store.Save(job); saveErr != nil {
+			t.Fatalf("save job failed: %v", saveErr)
+		}
+	}
+	saveJob("job_running", "running", runRequest{Command: "sleep 30", Cwd: tempDir, Unsafe: true})
+	saveJob("job_resume", "queued", runRequest{Command: "echo resumed", Cwd: tempDir, Unsafe: true, ResumeOnRestart: true})
+	saveJob("job_waiting", "needs_approval", runRequest{Command: "rm -rf build", Cwd: tempDir})
+	saveJob("job_approved_running", "running", runRequest{Command: "rm -rf dist", Cwd: tempDir})
+	saveJob("job_approved_done", "completed", runRequest{Command: "rm -rf out", Cwd: tempDir})
+	for _, approval := range []commandApproval{
+		{ID: "approval_orphan", JobID: "job_missing", Status: "pending", CreatedAt: now, UpdatedAt: now},
+		{ID: "approval_waiting", JobID: "job_waiting", Status: "pending", CreatedAt: now, UpdatedAt: now},
+		{ID: "approval_interrupted", JobID: "job_approved_running", Status: "approved", CreatedAt: now, UpdatedAt: now},
+		{ID: "approval_used", JobID: "job_approved_done", Status: "approved", CreatedAt: now, UpdatedAt: now},
+	} {
+		if saveErr := store.SaveApproval(approval); saveErr != nil {
+			t.Fatalf("save approval failed: %v", saveErr)
+		}
+	}
+
+	server := newDaemonServer(store)
+	report, err := server.recoverInterruptedJobs()
+	if err != nil {
+		t.Fatalf("recovery failed: %v", err)
+	}
+	if report.Interrupted != 3 || report.Resumed != 1 || report.ExpiredApprovals != 2 {
+		t.Fatalf("unexpected recovery report: %+v", report)
+	}
+
+	interrupted, _ := store.Get("job_running")
+	if interrupted.Result.Status != "interrupted" || interrupted.Result.Error == "" {
+		t.Fatalf("expected interrupted job with error, got %+v", interrupted.Result)
+	}
+	resumed := waitForJobStatus(t, store, "job_resume", "completed")
+	if resumed.ResumeCount != 1 {
+		t.Fatalf("expected resume count 1, got %d", resumed.ResumeCount)
+	}
+	orphan, _ := store.GetApproval("approval_orphan")
+	if orphan.Status != "expired" {
+		t.Fatalf("expected orphaned approval to expire, got %q", orphan.Status)
+	}
+	waiting, _ := store.GetApproval("approval_waiting")
+	if waiting.Status != "pending" {
+		t.Fatalf("expected approval of waiting job to stay pending, got %q", waiting.Status)
+	}
+	approvedInterrupted, _ := store.GetApproval("approval_interrupted")
+	if approvedInterrupted.Status != "expired" {
+		t.Fatalf("expected approval of interrupted job to expire, got %q", approvedInterrupted.Status)
+	}
+	used, _ := store.GetApproval("approval_used")
+	if used.Status != "approved" {
+		t.Fatalf("expected approval of finished job to stay approved, got %q", used.Status)
+	}
+}
+
+func TestRunCommandWithCapture_TimeoutKillsProcessGroup(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("process groups are not used on windows")
+	}
+	t.Setenv("SMARTSH_KILL_GRACE_SEC", "1")
+	testCases := []struct {
+		name           string
+		command        string
+		expectedSignal string
+	}{
+		{name: "grandchild holding pipes", command: "sleep 30 & sleep 30", expectedSignal: "SIGTERM"},
+		{name: "ignores sigterm", command: "trap '' TERM; sleep 30", expectedSignal: "SIGKILL"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+			defer cancel()
+			startedAt := time.Now()
+			_, output, err := runCommandWithCapture(ctx, testCase.command, t.TempDir(), isolationOptions{MaxOutputKB: 16}, os.Environ(), nil)
+			if elapsed := time.Since(startedAt); elapsed > 5*time.Second {
+				t.Fatalf("expected process group to be killed promptly, took %s", elapsed)
+			}
+			if err == nil || !strings.Contains(err.Error(), "timed out") {
+				t.Fatalf("expected timeout error, got %v", err)
+			}
+			if output.Signal != testCase.expectedSignal {
+				t.Fatalf("expected signal %s, got %q", testCase.expectedSignal, output.Signal)
+			}
+		})
+	}
+}
+
+func TestRunCommandWithCapture_CleanExitWithBackgroundChildSucceeds(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("process groups are not used on windows")
+	}
+	t.Setenv("SMARTSH_KILL_GRACE_SEC", "1")
+	exitCode, output, err := runCommandWithCapture(context.Background(), "echo done; sleep 4 &", t.TempDir(), isolationOptions{MaxOutputKB: 16}, os.Environ(), nil)
+	if err != nil || exitCode != 0 {
+		t.Fatalf("expected a clean exit, got exit code %d: %v", exitCode, err)
+	}
+	if !strings.Contains(output.Combined, "done") {
+		t.Fatalf("expected output before the wait delay, got %q", output.Combined)
+	}
+}
+
+func TestRunCommandWithCapture_ReportsTermination(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("signals are not reported on windows")
+	}
+	t.Setenv("SMARTSH_KILL_GRACE_SEC", "1")
+	testCases := []struct {
+		name              string
+		command           string
+		timeout           time.Duration
+		expectedReason    string
+		expectedSignal    string
+		expectedExitCode  int
+		expectedErrorType string
+		expectedSummary   string
+	}{
+		{name: "exited", command: "exit 3", timeout: 10 * time.Second, expectedReason: "exited", expectedExitCode: 3, expectedErrorType: "runtime", expectedSummary: "command failed (exit code 3)"},
+		{name: "signaled", command: "kill -SEGV $$", timeout: 10 * time.Second, expectedReason: "signaled", expectedSignal: "SIGSEGV", expectedExitCode: 139, expectedErrorType: "runtime", expectedSummary: "command killed by signal SIGSEGV"},
+		{name: "timeout", command: "sleep 30", timeout: time.Second, expectedReason: "timeout", expectedSignal: "SIGTERM", expectedExitCode: 143, expectedErrorType: "timeout", expectedSummary: "command killed by timeout after 1s (SIGTERM)"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), testCase.timeout)
+			defer cancel()
+			exitCode, output, err := runCommandWithCapture(ctx, testCase.command, t.TempDir(), isolationOptions{MaxOutputKB: 16}, os.Environ(), nil)
+			if output.Termination == nil || output.Termination.Reason != testCase.expectedReason || output.Termination.Signal != testCase.expectedSignal {
+				t.Fatalf("expected termination %s/%s, got %+v", testCase.expectedReason, testCase.expectedSignal, output.Termination)
+			}
+			if exitCode != testCase.expectedExitCode {
+				t.Fatalf("expected exit code %d, got %d", testCase.expectedExitCode, exitCode)
+			}
+			summary := deterministicSummary(testCase.command, exitCode, output.Combined, output.Stderr, err)
+			if summary.ErrorType != testCase.expectedErrorType || summary.Summary != testCase.expectedSummary {
+				t.Fatalf("expected %s summary %q, got %s %q", testCase.expectedErrorType, testCase.expectedSummary, summary.ErrorType, summary.Summary)
+			}
+		})
+	}
+}
+
+func TestHandleBatch_StopOnFailureAndContinue(t *testing.T) {
+	t.Setenv("SMARTSH_DAEMON_DISABLE_AUTH", "true")
+	t.Setenv("SMARTSH_SUMMARY_PROVIDER", "deterministic")
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+	server := newDaemonServer(store)
+
+	testCases := []struct {
+		mode             string
+		expectedStatuses []string
+	}{
+		{mode: "stop_on_failure", expectedStatuses: []string{"completed", "failed", "skipped"}},
+		{mode: "continue", expectedStatuses: []string{"completed", "failed", "completed"}},
+	}
+	for _, testCase := range testCases {
+		body := `{"mode":"` + testCase.mode + `","cwd":"` + tempDir + `","unsafe":true,"env":{"STEP_NAME":"batch"},"steps":[` +
+			`{"command":"echo first"},` +
+			`{"command":"echo broken >&2; exit 3"},` +
+			`{"command":"echo $STEP_NAME","env":{"STEP_NAME":"override"}}]}`
+		recorder := httptest.NewRecorder()
+		server.handleBatch(recorder, httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(body)))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d: %s", testCase.mode, recorder.Code, recorder.Body.String())
+		}
+		response := batchResponse{}
+		if decodeError := json.Unmarshal(recorder.Body.Bytes(), &response); decodeError != nil {
+			t.Fatalf("parse batch response failed: %v", decodeError)
+		}
+		if response.Status != "failed" || response.FailedStep != 2 {
+			t.Fatalf("%s: expected failure at step 2, got status=%s failed_step=%d", testCase.mode, response.Status, response.FailedStep)
+		}
+		if len(response.Steps) != len(testCase.expectedStatuses) {
+			t.Fatalf("%s: expected %d steps, got %d", testCase.mode, len(testCase.expectedStatuses), len(response.Steps))
+		}
+		for index, expected := range testCase.expectedStatuses {
+			if response.Steps[index].Step != index+1 || response.Steps[index].Status != expected {
+				t.Fatalf("%s: step %d expected %s, got %+v", testCase.mode, index+1, expected, response.Steps[index])
+			}
+		}
+		if !strings.Contains(response.Summary, "step 2/3") {
+			t.Fatalf("%s: expected summary to name the failing step, got %q", testCase.mode, response.Summary)
+		}
+	}
+}
+
+func TestHandleBatch_ParallelFanOutMergesFailures(t *testing.T) {
+	t.Setenv("SMARTSH_DAEMON_DISABLE_AUTH", "true")
+	t.Setenv("SMARTSH_SUMMARY_PROVIDER", "deterministic")
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+	server := newDaemonServer(store)
+
+	packageDirs := make([]string, 0, 3)
+	for _, name := range []string{"alpha", "beta", "gamma"} {
+		dir := filepath.Join(tempDir, name)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatalf("mkdir failed: %v", err)
+		}
+		if name != "beta" {
+			if err := os.WriteFile(filepath.Join(dir, "fail"), []byte(name), 0o644); err != nil {
+				t.Fatalf("write marker failed: %v", err)
+			}
+		}
+		packageDirs = append(packageDirs, dir)
+	}
+	command := `if [ -f fail ]; then echo "--- FAIL: Test$(cat fail) (0.00s)"; exit 1; fi; echo ok`
+	payload, _ := json.Marshal(map[string]any{"mode": "parallel", "max_parallel": 2, "unsafe": true, "command": command, "cwds": packageDirs})
+	recorder := httptest.NewRecorder()
+	server.handleBatch(recorder, httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(string(payload))))
+	response := batchResponse{}
+	if decodeError := json.Unmarshal(recorder.Body.Bytes(), &response); decodeError != nil {
+		t.Fatalf("parse batch response failed: %v (%s)", decodeError, recorder.Body.String())
+	}
+	if response.Status != "failed" || len(response.Steps) != 3 || response.Steps[1].Status != "completed" {
+		t.Fatalf("unexpected fan-out result: %+v", response)
+	}
+	if len(response.Failures) != 2 || response.Failures[0].Label != packageDirs[0] || response.Failures[1].Label != packageDirs[2] {
+		t.Fatalf("expected failures grouped by package dir, got %+v", response.Failures)
+	}
+	if len(response.FailingTests) != 2 {
+		t.Fatalf("expected union of failing tests from both packages, got %v", response.FailingTests)
+	}
+	if !strings.HasPrefix(response.Summary, "2 of 3 runs did not complete") {
+		t.Fatalf("unexpected headline: %q", response.Summary)
+	}
+}
+
+func TestHandleBatch_ParallelStepsShareSchedulerLimits(t *testing.T) {
+	t.Setenv("SMARTSH_DAEMON_DISABLE_AUTH", "true")
+	t.Setenv("SMARTSH_SUMMARY_PROVIDER", "deterministic")
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+	server := newDaemonServer(store)
+	server.scheduler = newJobScheduler(4, 1)
+
+	logPath := filepath.Join(tempDir, "overlap.log")
+	command := "echo start >> " + logPath + "; sleep 0.2; echo end >> " + logPath
+	payload, _ := json.Marshal(map[string]any{"mode": "parallel", "max_parallel": 3, "unsafe": true, "cwd": tempDir, "steps": []map[string]string{{"command": command}, {"command": command}, {"command": command}}})
+	recorder := httptest.NewRecorder()
+	server.handleBatch(recorder, httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(string(payload))))
+	response := batchResponse{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || response.Status != "completed" {
+		t.Fatalf("expected batch to complete, got %s (%v)", recorder.Body.String(), err)
+	}
+	content, _ := os.ReadFile(logPath)
+	if got := strings.Fields(string(content)); strings.Join(got, " ") != "start end start end start end" {
+		t.Fatalf("expected steps in one workspace to run one at a time, got %v", got)
+	}
+}
+
+func TestHandleRun_AnswersWithoutSlotWhenNothingRuns(t *testing.T) {
+	t.Setenv("SMARTSH_DAEMON_DISABLE_AUTH", "true")
+	t.Setenv("SMARTSH_SUMMARY_PROVIDER", "deterministic")
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+	server := newDaemonServer(store)
+	server.scheduler = newJobScheduler(1, 1)
+	busy := server.scheduler.enqueue("busy", "elsewhere", priorityInteractive)
+	if err := server.scheduler.wait(context.Background(), busy); err != nil {
+		t.Fatalf("wait failed: %v", err)
+	}
+
+	testCases := []struct {
+		name           string
+		payload        map[string]any
+		expectedStatus string
+	}{
+		{name: "dry run", payload: map[string]any{"command": "echo hi", "dry_run": true}, expectedStatus: "completed"},
+		{name: "blocked", payload: map[string]any{"command": "rm -rf build"}, expectedStatus: "blocked"},
+		{name: "needs approval", payload: map[string]any{"command": "rm -rf build", "require_approval": true}, expectedStatus: "needs_approval"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.payload["cwd"] = tempDir
+			body, _ := json.Marshal(testCase.payload)
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			recorder := httptest.NewRecorder()
+			server.handleRun(recorder, httptest.NewRequest(http.MethodPost, "/run", strings.NewReader(string(body))).WithContext(ctx))
+			response := runResponse{}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || response.Status != testCase.expectedStatus || response.Executed {
+				t.Fatalf("expected %s without running, got %d %s", testCase.expectedStatus, recorder.Code, recorder.Body.String())
+			}
+		})
+	}
+
+	server.scheduler.release(busy)
+	body, _ := json.Marshal(map[string]any{"command": "echo ran", "cwd": tempDir, "unsafe": true})
+	recorder := httptest.NewRecorder()
+	server.handleRun(recorder, httptest.NewRequest(http.MethodPost, "/run", strings.NewReader(string(body))))
+	if !strings.Contains(recorder.Body.String(), `"status":"completed"`) {
+		t.Fatalf("expected the run to complete, got %s", recorder.Body.String())
+	}
+	if server.scheduler.running != 0 {
+		t.Fatalf("expected the slot to be released, %d still running", server.scheduler.running)
+	}
+}
+
+func TestExecuteRequest_RetryFlagsFlakyRuns(t *testing.T) {
+	t.Setenv("SMARTSH_SUMMARY_PROVIDER", "deterministic")
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+	server := newDaemonServer(store)
+
+	flakyCommand := `n=$(cat count 2>/dev/null || echo 0); n=$((n+1)); echo $n > count; if [ $n -lt 2 ]; then echo "connection refused" >&2; exit 1; fi; echo ok`
+	testCases := []struct {
+		name             string
+		retryOn          []string
+		expectedAttempts int
+		expectedStatus   string
+		expectedFlaky    bool
+	}{
+		{name: "matching error type", retryOn: []string{"runtime"}, expectedAttempts: 2, expectedStatus: "completed", expectedFlaky: true},
+		{name: "other error type", retryOn: []string{"dependency"}, expectedAttempts: 1, expectedStatus: "failed", expectedFlaky: false},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			cwd := t.TempDir()
+			response := server.executeRequest(context.Background(), runRequest{
+				Command: flakyCommand,
+				Cwd:     cwd,
+				Unsafe:  true,
+				Retry:   &retryPolicy{MaxAttempts: 3, RetryOn: testCase.retryOn},
+			}, "")
+			if response.Status != testCase.expectedStatus || response.Flaky != testCase.expectedFlaky {
+				t.Fatalf("expected status=%s flaky=%v, got status=%s flaky=%v", testCase.expectedStatus, testCase.expectedFlaky, response.Status, response.Flaky)
+			}
+			if len(response.Attempts) != testCase.expectedAttempts {
+				t.Fatalf("expected %d attempts, got %+v", testCase.expectedAttempts, response.Attempts)
+			}
+			if response.Attempts[0].ExitCode != 1 || response.Attempts[0].Attempt != 1 {
+				t.Fatalf("expected first attempt to record exit code 1, got %+v", response.Attempts[0])
+			}
+		})
+	}
+}
+
+func TestExecuteRequest_CacheHitsUntilInputsChange(t *testing.T) {
+	t.Setenv("SMARTSH_SUMMARY_PROVIDER", "deterministic")
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+	server := newDaemonServer(store)
+
+	cwd := t.TempDir()
+	counterPath := filepath.Join(tempDir, "runs")
+	inputPath := filepath.Join(cwd, "src", "input.txt")
+	if err := os.MkdirAll(filepath.Dir(inputPath), 0o755); err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+	if err := os.WriteFile(inputPath, []byte("one"), 0o644); err != nil {
+		t.Fatalf("write input failed: %v", err)
+	}
+	request := runRequest{
+		Command:     "echo run >> " + counterPath + "; cat src/input.txt",
+		Cwd:         cwd,
+		Unsafe:      true,
+		Cache:       true,
+		CacheInputs: []string{"src/**/*.txt"},
+	}
+	countRuns := func() int {
+		content, _ := os.ReadFile(counterPath)
+		return strings.Count(string(content), "run")
+	}
+
+	first := server.executeRequest(context.Background(), request, "")
+	second := server.executeRequest(context.Background(), request, "")
+	if first.CacheHit || !second.CacheHit {
+		t.Fatalf("expected miss then hit, got %v then %v", first.CacheHit, second.CacheHit)
+	}
+	if countRuns() != 1 || second.Status != first.Status || second.Summary != first.Summary {
+		t.Fatalf("expected cached response without rerun, runs=%d first=%+v second=%+v", countRuns(), first, second)
+	}
+
+	if err := os.WriteFile(inputPath, []byte("two"), 0o644); err != nil {
+		t.Fatalf("write input failed: %v", err)
+	}
+	third := server.executeRequest(context.Background(), request, "")
+	if third.CacheHit || countRuns() != 2 {
+		t.Fatalf("expected changed input to rerun, hit=%v runs=%d", third.CacheHit, countRuns())
+	}
+
+	for index, variant := range []runRequest{{Stdin: "y\n"}, {Stdin: "n\n"}, {Parser: "go"}} {
+		varied := request
+		varied.Stdin, varied.Parser = variant.Stdin, variant.Parser
+		if response := server.executeRequest(context.Background(), varied, ""); response.CacheHit || countRuns() != 3+index {
+			t.Fatalf("expected stdin %q and parser %q to miss the cache, hit=%v runs=%d", variant.Stdin, variant.Parser, response.CacheHit, countRuns())
+		}
+	}
+
+	uncached := request
+	uncached.Cache = false
+	if response := server.executeRequest(context.Background(), uncached, ""); response.CacheHit || countRuns() != 6 {
+		t.Fatalf("expected cache to be opt-in, hit=%v runs=%d", response.CacheHit, countRuns())
+	}
+}
+
+func TestPutCachedRun_EvictsOldestBeyondSize(t *testing.T) {
+	store, err := newJobStore(filepath.Join(t.TempDir(), "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+
+	response := runResponse{Status: "completed", Summary: strings.Repeat("x", 400)}
+	for _, key := range []string{"first", "second", "third"} {
+		if err := store.PutCachedRun(key, response, time.Hour, 1200); err != nil {
+			t.Fatalf("put %s failed: %v", key, err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	if entry, _ := store.GetCachedRun("first", time.Hour); entry != nil {
+		t.Fatalf("expected oldest entry to be evicted")
+	}
+	if entry, _ := store.GetCachedRun("third", time.Hour); entry == nil {
+		t.Fatalf("expected newest entry to be kept")
+	}
+}
+
+func TestExecuteRequest_ReportsChangedFiles(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	t.Setenv("SMARTSH_SUMMARY_PROVIDER", "deterministic")
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+	server := newDaemonServer(store)
+
+	repo := t.TempDir()
+	files := map[string]string{"kept.txt": "one\ntwo\n", "removed.txt": "a\nb\nc\n", "dirty.txt": "base\n", "touched.txt": "same\n"}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(repo, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("write %s failed: %v", name, err)
+		}
+	}
+	gitCommand := exec.Command("sh", "-c", "git init -q && git add . && git -c user.email=t@example.com -c user.name=t commit -qm init")
+	gitCommand.Dir = repo
+	if output, err := gitCommand.CombinedOutput(); err != nil {
+		t.Fatalf("git setup failed: %v: %s", err, output)
+	}
+	// dirty.txt already has an uncommitted edit that the run must not report.
+	if err := os.WriteFile(filepath.Join(repo, "dirty.txt"), []byte("base\nbefore\n"), 0o644); err != nil {
+		t.Fatalf("write dirty.txt failed: %v", err)
+	}
+
+	response := server.executeRequest(context.Background(), runRequest{
+		Command: "echo three >> kept.txt; rm removed.txt; printf 'x\\ny\\n' > new.txt; echo after >> dirty.txt; touch touched.txt",
+		Cwd:     repo,
+		Unsafe:  true,
+	}, "")
+	if response.Status != "completed" {
+		t.Fatalf("expected completed run, got %+v", response)
+	}
+	expected := []changedFile{
+		{Path: "dirty.txt", Change: "modified", Insertions: 1},
+		{Path: "kept.txt", Change: "modified", Insertions: 1},
+		{Path: "new.txt", Change: "added", Insertions: 2},
+		{Path: "removed.txt", Change: "deleted", Deletions: 3},
+	}
+	if fmt.Sprint(response.ChangedFiles) != fmt.Sprint(expected) {
+		t.Fatalf("expected changed files %+v, got %+v", expected, response.ChangedFiles)
+	}
+	if response.Diffstat != "4 files changed (1 added, 2 modified, 1 deleted), +4 -3" {
+		t.Fatalf("unexpected diffstat %q", response.Diffstat)
+	}
+}
+
+func TestCaptureWorkTreeSnapshot_KeepsOnlySmallTrackedEdits(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	repo := t.TempDir()
+	if err := os.WriteFile(filepath.Join(repo, "small.txt"), []byte("base\n"), 0o644); err != nil {
+		t.Fatalf("write small.txt failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(repo, "large.txt"), []byte("base\n"), 0o644); err != nil {
+		t.Fatalf("write large.txt failed: %v", err)
+	}
+	gitCommand := exec.Command("sh", "-c", "git init -q && git add . && git -c user.email=t@example.com -c user.name=t commit -qm init")
+	gitCommand.Dir = repo
+	if output, err := gitCommand.CombinedOutput(); err != nil {
+		t.Fatalf("git setup failed: %v: %s", err, output)
+	}
+	files := map[string]string{
+		"small.txt":     "base\nedit\n",
+		"large.txt":     strings.Repeat("x", maxSnapshotFileBytes+1),
+		"untracked.txt": "new\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(repo, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("write %s failed: %v", name, err)
+		}
+	}
+
+	snapshot := captureWorkTreeSnapshot(repo, true)
+	if snapshot == nil {
+		t.Fatalf("expected a snapshot")
+	}
+	if string(snapshot.entries["small.txt"].content) != files["small.txt"] {
+		t.Fatalf("expected small tracked edit to be kept, got %+v", snapshot.entries["small.txt"])
+	}
+	for _, name := range []string{"large.txt", "untracked.txt"} {
+		entry, ok := snapshot.entries[name]
+		if !ok || !entry.exists {
+			t.Fatalf("expected %s to be recorded, got %+v", name, snapshot.entries)
+		}
+		if entry.content != nil {
+			t.Fatalf("expected %s content not to be kept", name)
+		}
+	}
+}
+
+func TestHandleWatches_RerunsOnChangeAndStops(t *testing.T) {
+	t.Setenv("SMARTSH_DAEMON_DISABLE_AUTH", "true")
+	t.Setenv("SMARTSH_SUMMARY_PROVIDER", "deterministic")
+	t.Setenv("SMARTSH_WATCH_POLL_MS", "20")
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+	server := newDaemonServer(store)
+
+	cwd := t.TempDir()
+	inputPath := filepath.Join(cwd, "input.txt")
+	if err := os.WriteFile(inputPath, []byte("ok"), 0o644); err != nil {
+		t.Fatalf("write input failed: %v", err)
+	}
+	body := `{"command":"grep -q ok input.txt","cwd":"` + cwd + `","unsafe":true,"patterns":["*.txt"],"debounce_ms":50}`
+	recorder := httptest.NewRecorder()
+	server.handleWatches(recorder, httptest.NewRequest(http.MethodPost, "/watches", strings.NewReader(body)))
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	created := watchStatus{}
+	if decodeError := json.Unmarshal(recorder.Body.Bytes(), &created); decodeError != nil {
+		t.Fatalf("parse watch response failed: %v", decodeError)
+	}
+	defer server.stopWatch(server.watches[created.WatchID])
+
+	waitForWatchRun := func(runCount int, status string) watchStatus {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			recorder := httptest.NewRecorder()
+			server.handleWatchRoutes(recorder, httptest.NewRequest(http.MethodGet, "/watches/"+created.WatchID, nil))
+			current := watchStatus{}
+			_ = json.Unmarshal(recorder.Body.Bytes(), &current)
+			if current.RunCount == runCount && current.LastRun != nil && current.LastRun.Status == status {
+				return current
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		recorder := httptest.NewRecorder()
+		server.handleWatchRoutes(recorder, httptest.NewRequest(http.MethodGet, "/watches/"+created.WatchID, nil))
+		t.Fatalf("watch did not reach run %d with status %q: %s", runCount, status, recorder.Body.String())
+		return watchStatus{}
+	}
+
+	if err := os.WriteFile(inputPath, []byte("bad"), 0o644); err != nil {
+		t.Fatalf("write input failed: %v", err)
+	}
+	failed := waitForWatchRun(1, "failed")
+	if len(failed.LastTrigger) != 1 || failed.LastTrigger[0] != inputPath {
+		t.Fatalf("expected trigger %s, got %v", inputPath, failed.LastTrigger)
+	}
+	job, err := store.Get(failed.LastRun.JobID)
+	if err != nil || job == nil || job.WatchID != created.WatchID {
+		t.Fatalf("expected run to be stored as a job linked to the watch, got %+v", job)
+	}
+
+	if err := os.WriteFile(inputPath, []byte("ok again"), 0o644); err != nil {
+		t.Fatalf("write input failed: %v", err)
+	}
+	waitForWatchRun(2, "completed")
+
+	recorder = httptest.NewRecorder()
+	server.handleWatchRoutes(recorder, httptest.NewRequest(http.MethodPost, "/watches/"+created.WatchID+"/stop", nil))
+	if !strings.Contains(recorder.Body.String(), `"status":"stopped"`) {
+		t.Fatalf("expected stopped watch, got %s", recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	server.handleWatches(recorder, httptest.NewRequest(http.MethodPost, "/watches", strings.NewReader(`{"command":"echo hi","cwd":"`+cwd+`"}`)))
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected watch without patterns to be rejected, got %d", recorder.Code)
+	}
+}
+
+func TestHandleWatches_RerunsForEditsDuringRunButNotOwnWrites(t *testing.T) {
+	t.Setenv("SMARTSH_DAEMON_DISABLE_AUTH", "true")
+	t.Setenv("SMARTSH_SUMMARY_PROVIDER", "deterministic")
+	t.Setenv("SMARTSH_WATCH_POLL_MS", "20")
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+	server := newDaemonServer(store)
+
+	cwd := t.TempDir()
+	inputPath := filepath.Join(cwd, "input.txt")
+	if err := os.WriteFile(inputPath, []byte("ok"), 0o644); err != nil {
+		t.Fatalf("write input failed: %v", err)
+	}
+	body := `{"command":"date +%s%N > gen.txt; sleep 0.5","cwd":"` + cwd + `","unsafe":true,"patterns":["*.txt"],"debounce_ms":50,"run_on_start":true}`
+	recorder := httptest.NewRecorder()
+	server.handleWatches(recorder, httptest.NewRequest(http.MethodPost, "/watches", strings.NewReader(body)))
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	created := watchStatus{}
+	if decodeError := json.Unmarshal(recorder.Body.Bytes(), &created); decodeError != nil {
+		t.Fatalf("parse watch response failed: %v", decodeError)
+	}
+	defer server.stopWatch(server.watches[created.WatchID])
+
+	getWatch := func() watchStatus {
+		recorder := httptest.NewRecorder()
+		server.handleWatchRoutes(recorder, httptest.NewRequest(http.MethodGet, "/watches/"+created.WatchID, nil))
+		current := watchStatus{}
+		_ = json.Unmarshal(recorder.Body.Bytes(), &current)
+		return current
+	}
+	waitForWatchRun := func(runCount int, status string) watchStatus {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if current := getWatch(); current.RunCount == runCount && current.LastRun != nil && current.LastRun.Status == status {
+				return current
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatalf("watch did not reach run %d with status %q: %+v", runCount, status, getWatch())
+		return watchStatus{}
+	}
+
+	waitForWatchRun(1, "running")
+	if err := os.WriteFile(inputPath, []byte("edited during run"), 0o644); err != nil {
+		t.Fatalf("write input failed: %v", err)
+	}
+	rerun := waitForWatchRun(2, "completed")
+	if !containsString(rerun.LastTrigger, inputPath) {
+		t.Fatalf("expected the edit made during the run to trigger a rerun, got trigger %v", rerun.LastTrigger)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if current := getWatch(); current.RunCount != 2 {
+		t.Fatalf("expected the command's own writes not to keep retriggering, got %d runs (trigger %v)", current.RunCount, current.LastTrigger)
+	}
+}
+
+func TestHandleServices_ReadinessProbes(t *testing.T) {
+	t.Setenv("SMARTSH_DAEMON_DISABLE_AUTH", "true")
+	t.Setenv("SMARTSH_SUMMARY_PROVIDER", "deterministic")
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+	server := newDaemonServer(store)
+
+	healthServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusOK)
+	}))
+	defer healthServer.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	testCases := []struct {
+		name          string
+		body          string
+		expectedReady bool
+		expectedState string
+		expectedURL   string
+	}{
+		{name: "log regex", body: `"command":"echo server listening on http://127.0.0.1:4321/; sleep 30","ready":{"log_regex":"listening on"}`, expectedReady: true, expectedState: "ready", expectedURL: "http://127.0.0.1:4321/"},
+		{name: "http", body: `"command":"sleep 30","ready":{"http":"` + healthServer.URL + `"}`, expectedReady: true, expectedState: "ready", expectedURL: healthServer.URL},
+		{name: "tcp", body: `"command":"sleep 30","ready":{"tcp":"` + listener.Addr().String() + `"}`, expectedReady: true, expectedState: "ready", expectedURL: "http://" + listener.Addr().String()},
+		{name: "request shell", body: `"shell":"bash","command":"echo $0 on http://127.0.0.1:4322/; sleep 30","ready":{"log_regex":"^bash on"}`, expectedReady: true, expectedState: "ready", expectedURL: "http://127.0.0.1:4322/"},
+		{name: "exits before ready", body: `"command":"echo boom; exit 3","ready":{"log_regex":"never"}`, expectedReady: false, expectedState: "failed"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			body := `{"cwd":"` + tempDir + `","unsafe":true,"ready_timeout_sec":5,` + testCase.body + `}`
+			server.handleServices(recorder, httptest.NewRequest(http.MethodPost, "/services", strings.NewReader(body)))
+			if recorder.Code != http.StatusCreated {
+				t.Fatalf("expected status 201, got %d: %s", recorder.Code, recorder.Body.String())
+			}
+			status := serviceStatus{}
+			if decodeError := json.Unmarshal(recorder.Body.Bytes(), &status); decodeError != nil {
+				t.Fatalf("parse service response failed: %v", decodeError)
+			}
+			defer server.lookupService(status.ServiceID).stop()
+			if status.Ready != testCase.expectedReady || status.Status != testCase.expectedState || status.URL != testCase.expectedURL {
+				t.Fatalf("expected ready=%v status=%s url=%q, got %+v", testCase.expectedReady, testCase.expectedState, testCase.expectedURL, status)
+			}
+		})
+	}
+}
+
+func TestStopServices_StopsEveryRunningService(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses posix utilities")
+	}
+	t.Setenv("SMARTSH_DAEMON_DISABLE_AUTH", "true")
+	t.Setenv("SMARTSH_SUMMARY_PROVIDER", "deterministic")
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+	server := newDaemonServer(store)
+
+	pids := make([]int, 0, 2)
+	for _, name := range []string{"one", "two"} {
+		service, _, err := server.createService(context.Background(), serviceRequest{Name: name, Command: "sleep 30", Cwd: tempDir, Unsafe: true})
+		if err != nil {
+			t.Fatalf("create service failed: %v", err)
+		}
+		pids = append(pids, service.status().PID)
+	}
+	server.stopServices()
+	for index, name := range []string{"one", "two"} {
+		if status := server.lookupService(name).status(); status.Status != "stopped" {
+			t.Fatalf("expected %s to be stopped, got %+v", name, status)
+		}
+		if process, _ := os.FindProcess(pids[index]); process.Signal(syscall.Signal(0)) == nil {
+			t.Fatalf("expected process %d of %s to be gone", pids[index], name)
+		}
+	}
+}
+
+func TestHandleServiceRoutes_LogsRestartAndStop(t *testing.T) {
+	t.Setenv("SMARTSH_DAEMON_DISABLE_AUTH", "true")
+	t.Setenv("SMARTSH_SUMMARY_PROVIDER", "deterministic")
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+	server := newDaemonServer(store)
+
+	recorder := httptest.NewRecorder()
+	body := `{"name":"dev","command":"echo started; sleep 30","cwd":"` + tempDir + `","unsafe":true,"ready":{"log_regex":"started"}}`
+	server.handleServices(recorder, httptest.NewRequest(http.MethodPost, "/services", strings.NewReader(body)))
+	created := serviceStatus{}
+	if decodeError := json.Unmarshal(recorder.Body.Bytes(), &created); decodeError != nil || !created.Ready {
+		t.Fatalf("expected ready service, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	server.handleServices(recorder, httptest.NewRequest(http.MethodPost, "/services", strings.NewReader(body)))
+	if recorder.Code != http.StatusConflict {
+		t.Fatalf("expected duplicate name to conflict, got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	server.handleServiceRoutes(recorder, httptest.NewRequest(http.MethodPost, "/services/dev/restart", nil))
+	restarted := serviceStatus{}
+	_ = json.Unmarshal(recorder.Body.Bytes(), &restarted)
+	if !restarted.Ready || restarted.Restarts != 1 || restarted.PID == created.PID {
+		t.Fatalf("expected restarted ready service with new pid, got %s", recorder.Body.String())
+	}
+
+	// The running service's log is flushed every outputLogFlushInterval.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		recorder = httptest.NewRecorder()
+		server.handleServiceRoutes(recorder, httptest.NewRequest(http.MethodGet, "/services/"+created.ServiceID+"/logs?grep=started", nil))
+		page := jobOutputPage{}
+		_ = json.Unmarshal(recorder.Body.Bytes(), &page)
+		if page.ServiceID == created.ServiceID && page.TotalLines == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected output of both runs to be retained, got %s", recorder.Body.String())
+		}
+		time.Sleep(outputLogFlushInterval / 5)
+	}
+
+	recorder = httptest.NewRecorder()
+	server.handleServiceRoutes(recorder, httptest.NewRequest(http.MethodPost, "/services/dev/stop", nil))
+	stopped := serviceStatus{}
+	_ = json.Unmarshal(recorder.Body.Bytes(), &stopped)
+	if stopped.Status != "stopped" || stopped.Ready {
+		t.Fatalf("expected stopped service, got %s", recorder.Body.String())
+	}
+	if process, findErr := os.FindProcess(restarted.PID); runtime.GOOS != "windows" && findErr == nil && process.Signal(syscall.Signal(0)) == nil {
+		t.Fatalf("expected service process %d to be gone", restarted.PID)
+	}
+}
+
+func TestDetectInputPrompt(t *testing.T) {
+	testCases := []struct {
+		trailing string
+		expected string
+	}{
+		{trailing: "Need to install the following packages:\nOk to proceed? (y) ", expected: "Ok to proceed? (y)"},
+		{trailing: "Enter passphrase for key '/home/me/.ssh/id_ed25519': ", expected: "Enter passphrase for key '/home/me/.ssh/id_ed25519':"},
+		{trailing: "Do you want to continue? [Y/n]\n", expected: "Do you want to continue? [Y/n]"},
+		{trailing: "Compiling 42 files\n", expected: ""},
+		{trailing: "Downloading 45%", expected: ""},
+	}
+	for _, testCase := range testCases {
+		if prompt := detectInputPrompt(testCase.trailing); prompt != testCase.expected {
+			t.Fatalf("detectInputPrompt(%q): expected %q, got %q", testCase.trailing, testCase.expected, prompt)
+		}
+	}
+}
+
+func TestExecuteRequest_WaitingForInputAndStdin(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("terminal reads are only detected on linux")
+	}
+	t.Setenv("SMARTSH_SUMMARY_PROVIDER", "deterministic")
+	t.Setenv("SMARTSH_INPUT_IDLE_SEC", "1")
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+	server := newDaemonServer(store)
+	terminal, tty, err := pty.Open()
+	if err != nil {
+		t.Skipf("no pty available: %v", err)
+	}
+	defer terminal.Close()
+	defer tty.Close()
+
+	startedAt := time.Now()
+	waiting := server.executeRequest(context.Background(), runRequest{
+		Command:    "printf 'Overwrite existing config? [y/N] '; read answer < " + tty.Name(),
+		Cwd:        tempDir,
+		Unsafe:     true,
+		TimeoutSec: 20,
+	}, "")
+	if waiting.Status != "waiting_for_input" || waiting.InputPrompt != "Overwrite existing config? [y/N]" {
+		t.Fatalf("expected waiting_for_input with prompt, got status=%q prompt=%q error=%q", waiting.Status, waiting.InputPrompt, waiting.Error)
+	}
+	if elapsed := time.Since(startedAt); elapsed > 10*time.Second {
+		t.Fatalf("expected run to end early, took %s", elapsed)
+	}
+
+	answered := server.executeRequest(context.Background(), runRequest{
+		Command: `printf 'Overwrite existing config? [y/N] '; read answer; [ "$answer" = y ]`,
+		Cwd:     tempDir,
+		Unsafe:  true,
+		Stdin:   "y\n",
+	}, "")
+	if answered.Status != "completed" {
+		t.Fatalf("expected stdin answer to complete the run, got %+v", answered)
+	}
+
+	for _, command := range []string{
+		"echo 'ok  example.com/pkg/password 0.1s'; sleep 2",
+		"printf 'Building target:'; sleep 2",
+		"printf 'Overwrite existing config? [y/N] '; sleep 2",
+	} {
+		quiet := server.executeRequest(context.Background(), runRequest{Command: command, Cwd: tempDir, Unsafe: true, TimeoutSec: 20}, "")
+		if quiet.Status != "completed" || quiet.InputPrompt != "" {
+			t.Fatalf("expected %q to run to completion without a terminal read, got %+v", command, quiet)
+		}
+	}
+}
+
+func TestExecuteRequest_RecordsResourceUsage(t *testing.T) {
+	t.Setenv("SMARTSH_SUMMARY_PROVIDER", "deterministic")
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+	server := newDaemonServer(store)
+
+	response := server.executeRequest(context.Background(), runRequest{
+		Command: "printf '0123456789'; printf 'abc' >&2",
+		Cwd:     tempDir,
+		Unsafe:  true,
+	}, "")
+	usage := response.Usage
+	if usage == nil {
+		t.Fatalf("expected resource usage, got %+v", response)
+	}
+	if usage.OutputBytes != 13 || usage.WallMS < 0 {
+		t.Fatalf("expected 13 output bytes, got %+v", usage)
+	}
+	if runtime.GOOS == "linux" && usage.PeakRSSBytes <= 0 {
+		t.Fatalf("expected peak rss on linux, got %+v", usage)
+	}
+
+	server.metrics.recordRun(response)
+	rendered := server.metrics.renderPrometheus()
+	for _, expected := range []string{`smartsh_run_wall_seconds_bucket{le="+Inf"} 1`, "smartsh_run_output_bytes_sum 13", "smartsh_run_peak_rss_bytes_count"} {
+		if !strings.Contains(rendered, expected) {
+			t.Fatalf("expected %q in metrics:\n%s", expected, rendered)
+		}
+	}
+}
+
+func TestExecuteRequest_ArgvBypassesShell(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses posix utilities")
+	}
+	t.Setenv("SMARTSH_SUMMARY_PROVIDER", "deterministic")
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+	server := newDaemonServer(store)
+	policy := "version: 1\nenforce: true\nallow_commands:\n  - \"prefix:printf\"\n  - \"prefix:cat\"\n  - \"prefix:smartsh-missing-program\"\n"
+	if err := os.WriteFile(filepath.Join(tempDir, ".smartsh-policy.yaml"), []byte(policy), 0o644); err != nil {
+		t.Fatalf("write policy failed: %v", err)
+	}
+
+	testCases := []struct {
+		name             string
+		request          runRequest
+		expectedStatus   string
+		expectedExitCode int
+		expectedOutput   string
+		expectedCommand  string
+	}{
+		{name: "shell syntax stays literal", request: runRequest{Argv: []string{"cat", "$(id) | cat > out"}}, expectedStatus: "failed", expectedExitCode: 1, expectedOutput: "$(id) | cat > out", expectedCommand: `cat '$(id) | cat > out'`},
+		{name: "argv runs without approval", request: runRequest{Argv: []string{"printf", "%s", "a|b"}}, expectedStatus: "completed"},
+		{name: "same text through the shell needs approval", request: runRequest{Command: `printf %s $(id) | cat > out`}, expectedStatus: "blocked", expectedExitCode: 2},
+		{name: "policy matches argv words", request: runRequest{Argv: []string{"printfx", "hi"}}, expectedStatus: "blocked", expectedExitCode: 2},
+		{name: "missing program", request: runRequest{Argv: []string{"smartsh-missing-program"}}, expectedStatus: "failed", expectedExitCode: 127},
+		{name: "command and argv", request: runRequest{Command: "printf a", Argv: []string{"printf", "a"}}, expectedStatus: "failed", expectedExitCode: 1},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			request := testCase.request
+			request.Cwd = tempDir
+			response := server.executeRequest(context.Background(), request, "")
+			if response.Status != testCase.expectedStatus || response.ExitCode != testCase.expectedExitCode {
+				t.Fatalf("expected %s with exit %d, got %+v", testCase.expectedStatus, testCase.expectedExitCode, response)
+			}
+			if !strings.Contains(response.OutputTail, testCase.expectedOutput) {
+				t.Fatalf("expected output %q, got %q", testCase.expectedOutput, response.OutputTail)
+			}
+			if testCase.expectedCommand != "" && response.ResolvedCommand != testCase.expectedCommand {
+				t.Fatalf("expected resolved command %q, got %q", testCase.expectedCommand, response.ResolvedCommand)
+			}
+		})
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "out")); !os.IsNotExist(err) {
+		t.Fatalf("expected argv run not to create a redirect target, got %v", err)
+	}
+}
+
+func TestExecuteRequest_SelectsShell(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil || runtime.GOOS == "windows" {
+		t.Skip("bash is not available")
+	}
+	t.Setenv("SMARTSH_SUMMARY_PROVIDER", "deterministic")
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+	server := newDaemonServer(store)
+	for dir, shell := range map[string]string{"": "bash", "strict": "bash -o pipefail", "custom": "/opt/smartsh-shell"} {
+		if err := os.MkdirAll(filepath.Join(tempDir, dir), 0o755); err != nil {
+			t.Fatalf("create dir failed: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(tempDir, dir, ".smartsh-policy.yaml"), []byte("version: 1\nshell: "+shell+"\n"), 0o644); err != nil {
+			t.Fatalf("write policy failed: %v", err)
+		}
+	}
+
+	bashOnly := `[[ -n "$BASH_VERSION" ]] && exit 7`
+	testCases := []struct {
+		name             string
+		request          runRequest
+		expectedShell    string
+		expectedExitCode int
+		expectedError    string
+	}{
+		{name: "policy default", request: runRequest{Command: bashOnly, Unsafe: true}, expectedShell: "bash", expectedExitCode: 7},
+		{name: "request overrides policy", request: runRequest{Command: "echo $0; exit 3", Shell: "sh", Unsafe: true}, expectedShell: "sh", expectedExitCode: 3},
+		{name: "policy flags", request: runRequest{Command: "false | true", Cwd: "strict", Unsafe: true}, expectedShell: "bash", expectedExitCode: 1},
+		{name: "request repeats policy shell", request: runRequest{Command: "false | true", Cwd: "strict", Shell: "bash -o pipefail", Unsafe: true}, expectedShell: "bash", expectedExitCode: 1},
+		{name: "request cannot add flags", request: runRequest{Command: "false | true", Shell: "bash -o pipefail", Unsafe: true}, expectedExitCode: 1, expectedError: "extra shell arguments"},
+		{name: "request cannot pick a program", request: runRequest{Command: "print(1)", Shell: "python3 -c"}, expectedExitCode: 1, expectedError: "extra shell arguments"},
+		{name: "request cannot give a path", request: runRequest{Command: "echo hi", Shell: "/tmp/bash"}, expectedExitCode: 1, expectedError: "unknown shell"},
+		{name: "unknown program needs its flags", request: runRequest{Command: "echo hi", Cwd: "custom"}, expectedExitCode: 1, expectedError: "unknown shell"},
+		{name: "argv has no shell", request: runRequest{Argv: []string{"true"}, Shell: "bash"}, expectedExitCode: 1, expectedError: "shell does not apply"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			request := testCase.request
+			request.Cwd = filepath.Join(tempDir, request.Cwd)
+			response := server.executeRequest(context.Background(), request, "")
+			if response.ExitCode != testCase.expectedExitCode || response.Shell != testCase.expectedShell {
+				t.Fatalf("expected exit %d under %q, got %+v", testCase.expectedExitCode, testCase.expectedShell, response)
+			}
+			if !strings.Contains(response.Error, testCase.expectedError) {
+				t.Fatalf("expected error containing %q, got %q", testCase.expectedError, response.Error)
+			}
+		})
+	}
+}
+
+func TestExecuteRequest_ShellSessionCarriesCwdAndEnv(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell sessions need a posix shell")
+	}
+	t.Setenv("SMARTSH_DAEMON_DISABLE_AUTH", "true")
+	t.Setenv("SMARTSH_SUMMARY_PROVIDER", "deterministic")
+	tempDir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatalf("resolve temp dir failed: %v", err)
+	}
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+	server := newDaemonServer(store)
+	subDir := filepath.Join(tempDir, "sub")
+	if err := os.Mkdir(subDir, 0o755); err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+
+	steps := []struct {
+		command          string
+		expectedExitCode int
+		expectedCwd      string
+	}{
+		{command: "cd sub && export FOO=1 BAR=2", expectedCwd: subDir},
+		{command: `test "$(pwd)" = "` + subDir + `" && test "$FOO" = 1 && unset BAR`, expectedCwd: subDir},
+		{command: `test -z "${BAR+x}" && cd .. && exit 3`, expectedExitCode: 3, expectedCwd: tempDir},
+	}
+	for index, step := range steps {
+		request := runRequest{Command: step.command, SessionID: "agent", Unsafe: true}
+		if index == 0 {
+			request.Cwd = tempDir
+		}
+		response := server.executeRequest(context.Background(), request, "")
+		if response.ExitCode != step.expectedExitCode || response.SessionCwd != step.expectedCwd || response.SessionID != "agent" {
+			t.Fatalf("step %d: expected exit %d in %s, got %+v", index, step.expectedExitCode, step.expectedCwd, response)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	server.handleShellSessions(recorder, httptest.NewRequest(http.MethodGet, "/shell-sessions", nil))
+	listed := struct {
+		Sessions []shellSessionStatus `json:"sessions"`
+	}{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &listed); err != nil || len(listed.Sessions) != 1 {
+		t.Fatalf("expected one session, got %s", recorder.Body.String())
+	}
+	session := listed.Sessions[0]
+	if session.Runs != 3 || session.Cwd != tempDir || strings.Join(session.EnvKeys, ",") != "FOO" || strings.Join(session.UnsetKeys, ",") != "BAR" {
+		t.Fatalf("unexpected session state %+v", session)
+	}
+
+	t.Setenv("SMARTSH_SHELL_SESSION_IDLE_SEC", "1")
+	time.Sleep(1100 * time.Millisecond)
+	recorder = httptest.NewRecorder()
+	server.handleShellSessionRoutes(recorder, httptest.NewRequest(http.MethodGet, "/shell-sessions/agent", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected idle session to expire, got %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestExecuteRequest_RunsCatalogTasks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses posix shell syntax")
+	}
+	t.Setenv("SMARTSH_DAEMON_DISABLE_AUTH", "true")
+	t.Setenv("SMARTSH_SUMMARY_PROVIDER", "deterministic")
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+	server := newDaemonServer(store)
+	nestedDir := filepath.Join(tempDir, "sub", "deeper")
+	if err := os.MkdirAll(nestedDir, 0o755); err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+	catalog := `version: 1
+tasks:
+  test:
+    description: Write the package list
+    command: printf '%s' {{pkg}} > pkg.txt
+    cwd: sub
+    env:
+      TASK_MODE: vetted
+    trusted: true
+    args:
+      pkg:
+        default: ./...
+        pattern: '[a-z./]+'
+  echo:
+    command: printf '%s' {{msg}} > msg.txt
+    trusted: true
+    args:
+      msg:
+        required: true
+  lint:
+    command: printf lint > lint.txt
+`
+	if err := os.WriteFile(filepath.Join(tempDir, ".smartsh-tasks.yaml"), []byte(catalog), 0o644); err != nil {
+		t.Fatalf("write catalog failed: %v", err)
+	}
+
+	testCases := []struct {
+		name           string
+		request        runRequest
+		expectedStatus string
+		expectedError  string
+		expectedFile   string
+		expectedText   string
+	}{
+		{name: "trusted task skips approval", request: runRequest{Task: "test"}, expectedStatus: "completed", expectedFile: filepath.Join(tempDir, "sub", "pkg.txt"), expectedText: "./..."},
+		{name: "args are quoted", request: runRequest{Task: "echo", TaskArgs: map[string]string{"msg": "$(id); touch pwned"}}, expectedStatus: "completed", expectedFile: filepath.Join(tempDir, "msg.txt"), expectedText: "$(id); touch pwned"},
+		{name: "untrusted task needs approval", request: runRequest{Task: "lint"}, expectedStatus: "blocked"},
+		{name: "pattern rejects value", request: runRequest{Task: "test", TaskArgs: map[string]string{"pkg": "x; rm"}}, expectedStatus: "failed", expectedError: "must match"},
+		{name: "required argument", request: runRequest{Task: "echo"}, expectedStatus: "failed", expectedError: `requires argument "msg"`},
+		{name: "unknown task", request: runRequest{Task: "deploy"}, expectedStatus: "failed", expectedError: "available: echo, lint, test"},
+		{name: "task with command", request: runRequest{Task: "test", Command: "true"}, expectedStatus: "failed", expectedError: "cannot be combined"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			request := testCase.request
+			request.Cwd = nestedDir
+			response := server.executeRequest(context.Background(), request, "")
+			if response.Status != testCase.expectedStatus || !strings.Contains(response.Error, testCase.expectedError) {
+				t.Fatalf("expected %s with error %q, got %+v", testCase.expectedStatus, testCase.expectedError, response)
+			}
+			if testCase.expectedFile == "" {
+				return
+			}
+			content, err := os.ReadFile(testCase.expectedFile)
+			if err != nil || string(content) != testCase.expectedText {
+				t.Fatalf("expected %s to contain %q, got %q (%v)", testCase.expectedFile, testCase.expectedText, content, err)
+			}
+		})
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "pwned")); !os.IsNotExist(err) {
+		t.Fatalf("expected task argument not to be executed, got %v", err)
+	}
+
+	pending := server.executeRequest(context.Background(), runRequest{Task: "lint", Cwd: nestedDir, RequireApproval: true}, "")
+	approval, err := store.GetApproval(pending.ApprovalID)
+	if pending.Status != "needs_approval" || err != nil || approval == nil {
+		t.Fatalf("expected untrusted task to wait for approval, got %+v (%v)", pending, err)
+	}
+	if approved := server.executeApprovalNow(context.Background(), *approval); approved.Status != "completed" || approved.Task != "lint" {
+		t.Fatalf("expected approved task to run, got %+v", approved)
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "lint.txt")); err != nil {
+		t.Fatalf("expected approved task output, got %v", err)
+	}
+
+	recorder := httptest.NewRecorder()
+	server.handleTasks(recorder, httptest.NewRequest(http.MethodGet, "/tasks?cwd="+nestedDir, nil))
+	listed := struct {
+		Catalog string        `json:"catalog"`
+		Tasks   []taskListing `json:"tasks"`
+	}{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &listed); err != nil || len(listed.Tasks) != 3 {
+		t.Fatalf("expected three tasks, got %s", recorder.Body.String())
+	}
+	if listed.Catalog != filepath.Join(tempDir, ".smartsh-tasks.yaml") || listed.Tasks[2].Name != "test" || !listed.Tasks[2].Trusted || listed.Tasks[2].Args["pkg"].Default != "./..." {
+		t.Fatalf("unexpected task listing %+v", listed)
+	}
+}
+
+func TestLoadTaskCatalog_RejectsQuotedPlaceholders(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses posix shell syntax")
+	}
+	t.Setenv("SMARTSH_SUMMARY_PROVIDER", "deterministic")
+	testCases := []struct {
+		name          string
+		command       string
+		shell         string
+		expectedError string
+	}{
+		{name: "bare word", command: "echo {{msg}}"},
+		{name: "option value and redirect", command: "go test -run={{pattern}} {{pkg}} > {{out}}"},
+		{name: "assignment", command: "MSG={{msg}} make notes"},
+		{name: "inside command substitution", command: `echo "$(printf %s {{msg}})"`},
+		{name: "double quotes", command: `echo "{{msg}}"`, expectedError: "inside quotes"},
+		{name: "single quotes", command: `echo '{{msg}}'`, expectedError: "inside quotes"},
+		{name: "expansion default", command: `echo ${MSG:-{{msg}}}`, expectedError: "inside quotes"},
+		{name: "here-document", command: "cat <<EOF\n{{msg}}\nEOF", expectedError: "inside quotes"},
+		{name: "non-posix shell", command: "Write-Output {{msg}}", shell: "pwsh", expectedError: "use argv"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := checkTaskPlaceholders(testCase.command, testCase.shell)
+			if testCase.expectedError == "" && err != nil {
+				t.Fatalf("expected %q to be accepted, got %v", testCase.command, err)
+			}
+			if testCase.expectedError != "" && (err == nil || !strings.Contains(err.Error(), testCase.expectedError)) {
+				t.Fatalf("expected %q to be rejected with %q, got %v", testCase.command, testCase.expectedError, err)
+			}
+		})
+	}
+
+	argvCases := []struct {
+		name          string
+		argv          []string
+		expectedError bool
+	}{
+		{name: "plain program", argv: []string{"go", "test", "-run", "{{pattern}}"}},
+		{name: "positional parameter", argv: []string{"bash", "-c", `make "$1"`, "_", "{{target}}"}},
+		{name: "shell script", argv: []string{"bash", "-c", "make {{target}}"}, expectedError: true},
+		{name: "wrapped shell script", argv: []string{"env", "sh", "-ec", "make {{target}}"}, expectedError: true},
+		{name: "cmd words", argv: []string{"cmd", "/c", "echo", "{{msg}}"}, expectedError: true},
+	}
+	for _, testCase := range argvCases {
+		t.Run("argv "+testCase.name, func(t *testing.T) {
+			if err := checkTaskArgvPlaceholders(testCase.argv); (err != nil) != testCase.expectedError {
+				t.Fatalf("expected %q rejected=%v, got %v", testCase.argv, testCase.expectedError, err)
+			}
+		})
+	}
+
+	tempDir := t.TempDir()
+	store, err := newJobStore(filepath.Join(tempDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+	server := newDaemonServer(store)
+	catalog := "version: 1\ntasks:\n  note:\n    command: echo \"{{msg}}\" > note.txt\n    trusted: true\n    args:\n      msg:\n        required: true\n"
+	if err := os.WriteFile(filepath.Join(tempDir, ".smartsh-tasks.yaml"), []byte(catalog), 0o644); err != nil {
+		t.Fatalf("write catalog failed: %v", err)
+	}
+	response := server.executeRequest(context.Background(), runRequest{Task: "note", TaskArgs: map[string]string{"msg": "$(touch pwned)"}, Cwd: tempDir}, "")
+	if response.Status != "failed" || !strings.Contains(response.Error, "inside quotes") {
+		t.Fatalf("expected quoted placeholder to be rejected, got %+v", response)
+	}
+	for _, name := range []string{"pwned", "note.txt"} {
+		if _, err := os.Stat(filepath.Join(tempDir, name)); !os.IsNotExist(err) {
+			t.Fatalf("expected injected task not to run, found %s (%v)", name, err)
+		}
+	}
+}
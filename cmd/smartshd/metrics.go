@@ -13,8 +13,57 @@ type metricsRegistry struct {
 	jobsCompleted       int64
 	jobsFailed          int64
 	jobsBlocked         int64
+	jobsCancelled       int64
+	jobsInterrupted     int64
+	jobsWaitingForInput int64
+	runRetries          int64
+	flakyRuns           int64
+	cacheHits           int64
+	cacheMisses         int64
 	runDurationMSTotal  int64
 	errorTypeTotals     map[string]int64
+	wallSeconds         *histogram
+	cpuSeconds          *histogram
+	peakRSSBytes        *histogram
+	outputBytes         *histogram
+}
+
+// histogram is a Prometheus histogram with fixed upper bounds; counts are
+// per bucket and made cumulative when rendered.
+type histogram struct {
+	bounds []float64
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int64, len(bounds))}
+}
+
+func (h *histogram) observe(value float64) {
+	h.sum += value
+	h.count++
+	for index, bound := range h.bounds {
+		if value <= bound {
+			h.counts[index]++
+			return
+		}
+	}
+}
+
+func (h *histogram) render(name string) []string {
+	lines := []string{"# TYPE " + name + " histogram"}
+	cumulative := int64(0)
+	for index, bound := range h.bounds {
+		cumulative += h.counts[index]
+		lines = append(lines, fmt.Sprintf(`%s_bucket{le="%g"} %d`, name, bound, cumulative))
+	}
+	return append(lines,
+		fmt.Sprintf(`%s_bucket{le="+Inf"} %d`, name, h.count),
+		fmt.Sprintf("%s_sum %g", name, h.sum),
+		fmt.Sprintf("%s_count %d", name, h.count),
+	)
 }
 
 func newMetricsRegistry() *metricsRegistry {
@@ -27,6 +76,10 @@ func newMetricsRegistry() *metricsRegistry {
 			"dependency": 0,
 			"policy":     0,
 		},
+		wallSeconds:  newHistogram(0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600, 1800),
+		cpuSeconds:   newHistogram(0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600, 1800),
+		peakRSSBytes: newHistogram(16<<20, 64<<20, 256<<20, 512<<20, 1<<30, 2<<30, 4<<30, 8<<30, 16<<30),
+		outputBytes:  newHistogram(1<<10, 10<<10, 100<<10, 1<<20, 10<<20, 100<<20),
 	}
 }
 
@@ -40,6 +93,33 @@ func (metrics *metricsRegistry) recordRun(response runResponse) {
 		errorType = "none"
 	}
 	metrics.errorTypeTotals[errorType]++
+	if response.Flaky {
+		metrics.flakyRuns++
+	}
+	if usage := response.Usage; usage != nil {
+		metrics.wallSeconds.observe(float64(usage.WallMS) / 1000)
+		metrics.cpuSeconds.observe(float64(usage.UserCPUMS+usage.SystemCPUMS) / 1000)
+		if usage.PeakRSSBytes > 0 {
+			metrics.peakRSSBytes.observe(float64(usage.PeakRSSBytes))
+		}
+		metrics.outputBytes.observe(float64(usage.OutputBytes))
+	}
+}
+
+func (metrics *metricsRegistry) recordRetry() {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	metrics.runRetries++
+}
+
+func (metrics *metricsRegistry) recordCacheLookup(hit bool) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if hit {
+		metrics.cacheHits++
+		return
+	}
+	metrics.cacheMisses++
 }
 
 func (metrics *metricsRegistry) recordJobStatus(status string) {
@@ -53,6 +133,12 @@ func (metrics *metricsRegistry) recordJobStatus(status string) {
 		metrics.jobsFailed++
 	case "blocked":
 		metrics.jobsBlocked++
+	case "cancelled":
+		metrics.jobsCancelled++
+	case "interrupted":
+		metrics.jobsInterrupted++
+	case "waiting_for_input":
+		metrics.jobsWaitingForInput++
 	}
 }
 
@@ -70,11 +156,29 @@ func (metrics *metricsRegistry) renderPrometheus() string {
 		fmt.Sprintf("smartsh_jobs_failed_total %d", metrics.jobsFailed),
 		"# TYPE smartsh_jobs_blocked_total counter",
 		fmt.Sprintf("smartsh_jobs_blocked_total %d", metrics.jobsBlocked),
+		"# TYPE smartsh_jobs_cancelled_total counter",
+		fmt.Sprintf("smartsh_jobs_cancelled_total %d", metrics.jobsCancelled),
+		"# TYPE smartsh_jobs_interrupted_total counter",
+		fmt.Sprintf("smartsh_jobs_interrupted_total %d", metrics.jobsInterrupted),
+		"# TYPE smartsh_jobs_waiting_for_input_total counter",
+		fmt.Sprintf("smartsh_jobs_waiting_for_input_total %d", metrics.jobsWaitingForInput),
+		"# TYPE smartsh_run_retries_total counter",
+		fmt.Sprintf("smartsh_run_retries_total %d", metrics.runRetries),
+		"# TYPE smartsh_runs_flaky_total counter",
+		fmt.Sprintf("smartsh_runs_flaky_total %d", metrics.flakyRuns),
+		"# TYPE smartsh_run_cache_hits_total counter",
+		fmt.Sprintf("smartsh_run_cache_hits_total %d", metrics.cacheHits),
+		"# TYPE smartsh_run_cache_misses_total counter",
+		fmt.Sprintf("smartsh_run_cache_misses_total %d", metrics.cacheMisses),
 		"# TYPE smartsh_run_duration_ms_total counter",
 		fmt.Sprintf("smartsh_run_duration_ms_total %d", metrics.runDurationMSTotal),
 	}
 	for key, value := range metrics.errorTypeTotals {
 		lines = append(lines, fmt.Sprintf(`smartsh_error_type_total{type="%s"} %d`, key, value))
 	}
+	lines = append(lines, metrics.wallSeconds.render("smartsh_run_wall_seconds")...)
+	lines = append(lines, metrics.cpuSeconds.render("smartsh_run_cpu_seconds")...)
+	lines = append(lines, metrics.peakRSSBytes.render("smartsh_run_peak_rss_bytes")...)
+	lines = append(lines, metrics.outputBytes.render("smartsh_run_output_bytes")...)
 	return strings.Join(lines, "\n") + "\n"
 }
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultOutputPageLines = 200
+	maxOutputPageLines     = 2000
+	outputLogFlushInterval = 250 * time.Millisecond
+	outputLogPruneInterval = time.Hour
+)
+
+type jobOutputLine struct {
+	Line int    `json:"line"`
+	Text string `json:"text"`
+}
+
+type jobOutputPage struct {
+	MustUseSmartsh bool            `json:"must_use_smartsh"`
+	JobID          string          `json:"job_id,omitempty"`
+	ServiceID      string          `json:"service_id,omitempty"`
+	Offset         int             `json:"offset"`
+	Limit          int             `json:"limit"`
+	Grep           string          `json:"grep,omitempty"`
+	TotalLines     int             `json:"total_lines"`
+	HasMore        bool            `json:"has_more"`
+	NextOffset     int             `json:"next_offset,omitempty"`
+	Lines          []jobOutputLine `json:"lines"`
+	Error          string          `json:"error,omitempty"`
+}
+
+// outputLogWriter appends job output to a gzip file. Writes are flushed at
+// most every outputLogFlushInterval, so the log can be paged while the job is
+// still running without ending a deflate block per chunk, and write failures
+// are swallowed so a full disk never breaks the command being captured.
+type outputLogWriter struct {
+	mu         sync.Mutex
+	file       *os.File
+	writer     *gzip.Writer
+	flushTimer *time.Timer
+	failed     bool
+	closed     bool
+}
+
+func (store *jobStore) outputLogDir() string {
+	return filepath.Join(filepath.Dir(store.db.Path()), "job-logs")
+}
+
+func (store *jobStore) OutputLogPath(jobID string) string {
+	return filepath.Join(store.outputLogDir(), sanitizeFileToken(jobID)+".log.gz")
+}
+
+func (store *jobStore) CreateOutputLog(jobID string) (*outputLogWriter, error) {
+	return store.openOutputLog(jobID, os.O_TRUNC)
+}
+
+// AppendOutputLog continues an existing log with a new gzip member, which
+// readers see as one stream; services use it to keep output across restarts.
+func (store *jobStore) AppendOutputLog(id string) (*outputLogWriter, error) {
+	return store.openOutputLog(id, os.O_APPEND)
+}
+
+func (store *jobStore) openOutputLog(id string, mode int) (*outputLogWriter, error) {
+	path := store.OutputLogPath(id)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("create output log directory failed: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|mode, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &outputLogWriter{file: file, writer: gzip.NewWriter(file)}, nil
+}
+
+func (writer *outputLogWriter) Write(data []byte) (int, error) {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+	if writer.failed {
+		return len(data), nil
+	}
+	if _, err := writer.writer.Write(data); err != nil {
+		writer.failed = true
+		return len(data), nil
+	}
+	if writer.flushTimer == nil {
+		writer.flushTimer = time.AfterFunc(outputLogFlushInterval, writer.flush)
+	}
+	return len(data), nil
+}
+
+func (writer *outputLogWriter) flush() {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+	writer.flushTimer = nil
+	if writer.failed || writer.closed {
+		return
+	}
+	if err := writer.writer.Flush(); err != nil {
+		writer.failed = true
+	}
+}
+
+func (writer *outputLogWriter) Close() error {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+	if writer.flushTimer != nil {
+		writer.flushTimer.Stop()
+		writer.flushTimer = nil
+	}
+	writer.closed = true
+	closeErr := writer.writer.Close()
+	if fileErr := writer.file.Close(); closeErr == nil {
+		closeErr = fileErr
+	}
+	return closeErr
+}
+
+// pruneOutputLogs removes job and service logs that have not been written
+// since cutoff and returns how many were removed. Job records are kept; their
+// output page then reports that no output was recorded.
+func (store *jobStore) pruneOutputLogs(cutoff time.Time) (int, error) {
+	paths, err := filepath.Glob(filepath.Join(store.outputLogDir(), "*.log.gz"))
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, path := range paths {
+		info, statErr := os.Lstat(path)
+		if statErr != nil || !info.Mode().IsRegular() || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if os.Remove(path) == nil {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// pruneOutputLogsPeriodically applies SMARTSH_OUTPUT_LOG_RETENTION_DAYS at
+// startup and then every outputLogPruneInterval. Without it logs are kept.
+func (store *jobStore) pruneOutputLogsPeriodically() {
+	days := parsePositiveIntEnv("SMARTSH_OUTPUT_LOG_RETENTION_DAYS", 0)
+	if days == 0 {
+		return
+	}
+	ticker := time.NewTicker(outputLogPruneInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := store.pruneOutputLogs(time.Now().Add(-time.Duration(days) * 24 * time.Hour)); err != nil {
+			fmt.Fprintf(os.Stderr, "smartshd output log pruning failed: %v\n", err)
+		}
+		<-ticker.C
+	}
+}
+
+// readOutputLogPage returns a window of the (optionally grep-filtered) lines in
+// a job log. A negative offset counts back from the last matching line.
+func readOutputLogPage(path string, offset int, limit int, grep *regexp.Regexp) ([]jobOutputLine, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	if limit <= 0 {
+		limit = defaultOutputPageLines
+	}
+	lines := make([]jobOutputLine, 0, min(limit, 64))
+	total := 0
+	keepLast := 0
+	if offset < 0 {
+		keepLast = -offset
+	}
+
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return lines, 0, nil
+		}
+		return nil, 0, err
+	}
+	defer gzipReader.Close()
+	reader := bufio.NewReader(gzipReader)
+	lineNumber := 0
+	for {
+		text, readErr := reader.ReadString('\n')
+		if text != "" {
+			lineNumber++
+			text = strings.TrimRight(text, "\r\n")
+			if grep == nil || grep.MatchString(text) {
+				entry := jobOutputLine{Line: lineNumber, Text: text}
+				switch {
+				case keepLast > 0:
+					lines = append(lines, entry)
+					if len(lines) > keepLast {
+						lines = lines[1:]
+					}
+				case total >= offset && len(lines) < limit:
+					lines = append(lines, entry)
+				}
+				total++
+			}
+		}
+		if readErr != nil {
+			// A running job's log has no gzip trailer yet; treat that as the end.
+			if errors.Is(readErr, io.EOF) || errors.Is(readErr, io.ErrUnexpectedEOF) {
+				break
+			}
+			return nil, 0, readErr
+		}
+	}
+	if keepLast > 0 && len(lines) > limit {
+		lines = lines[:limit]
+	}
+	return lines, total, nil
+}
+
+func (server *daemonServer) handleJobOutput(writer http.ResponseWriter, request *http.Request, jobID string) {
+	if request.Method != http.MethodGet {
+		writeJSON(writer, http.StatusMethodNotAllowed, jobOutputPage{MustUseSmartsh: true, JobID: jobID, Error: "method not allowed"})
+		return
+	}
+	job, err := server.store.Get(jobID)
+	if err != nil {
+		writeJSON(writer, http.StatusInternalServerError, jobOutputPage{MustUseSmartsh: true, JobID: jobID, Error: err.Error()})
+		return
+	}
+	if job == nil {
+		writeJSON(writer, http.StatusNotFound, jobOutputPage{MustUseSmartsh: true, JobID: jobID, Error: "job not found"})
+		return
+	}
+	serveOutputLogPage(writer, request, server.store.OutputLogPath(jobID), jobOutputPage{MustUseSmartsh: true, JobID: jobID})
+}
+
+// serveOutputLogPage answers an offset/limit/grep query against an output log.
+// page carries the identifying fields of the response.
+func serveOutputLogPage(writer http.ResponseWriter, request *http.Request, path string, page jobOutputPage) {
+	fail := func(statusCode int, message string) {
+		page.Error = message
+		writeJSON(writer, statusCode, page)
+	}
+	query := request.URL.Query()
+	offset := 0
+	if rawOffset := strings.TrimSpace(query.Get("offset")); rawOffset != "" {
+		parsed, parseErr := strconv.Atoi(rawOffset)
+		if parseErr != nil {
+			fail(http.StatusBadRequest, "offset must be an integer")
+			return
+		}
+		offset = parsed
+	}
+	limit := defaultOutputPageLines
+	if rawLimit := strings.TrimSpace(query.Get("limit")); rawLimit != "" {
+		parsed, parseErr := strconv.Atoi(rawLimit)
+		if parseErr != nil || parsed <= 0 {
+			fail(http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = min(parsed, maxOutputPageLines)
+	}
+	grepPattern := strings.TrimSpace(query.Get("grep"))
+	var grep *regexp.Regexp
+	if grepPattern != "" {
+		compiled, compileErr := regexp.Compile(grepPattern)
+		if compileErr != nil {
+			fail(http.StatusBadRequest, fmt.Sprintf("invalid grep pattern: %v", compileErr))
+			return
+		}
+		grep = compiled
+	}
+
+	lines, total, readErr := readOutputLogPage(path, offset, limit, grep)
+	if readErr != nil {
+		if errors.Is(readErr, os.ErrNotExist) {
+			fail(http.StatusNotFound, "no output recorded")
+			return
+		}
+		fail(http.StatusInternalServerError, readErr.Error())
+		return
+	}
+
+	page.Offset = offset
+	page.Limit = limit
+	page.Grep = grepPattern
+	page.TotalLines = total
+	page.Lines = lines
+	if offset >= 0 && offset+len(lines) < total {
+		page.HasMore = true
+		page.NextOffset = offset + len(lines)
+	}
+	writeJSON(writer, http.StatusOK, page)
+}
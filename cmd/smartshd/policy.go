@@ -8,9 +8,12 @@ import (
 	"regexp"
 	"strings"
 
+	"github.com/BegaDeveloper/smartsh/internal/security"
 	"gopkg.in/yaml.v3"
 )
 
+const policyFileName = ".smartsh-policy.yaml"
+
 type projectPolicy struct {
 	Version       int      `yaml:"version"`
 	Enforce       bool     `yaml:"enforce"`
@@ -21,12 +24,19 @@ type projectPolicy struct {
 	DenyPaths     []string `yaml:"deny_paths"`
 	AllowEnv      []string `yaml:"allow_env"`
 	DenyEnv       []string `yaml:"deny_env"`
+	Sandbox       string   `yaml:"sandbox"`
+	Shell         string   `yaml:"shell"`
 }
 
 func findPolicyFile(cwd string) string {
+	return findProjectFile(cwd, policyFileName)
+}
+
+// findProjectFile walks up from cwd and returns the first file called name.
+func findProjectFile(cwd string, name string) string {
 	current := cwd
 	for {
-		candidate := filepath.Join(current, ".smartsh-policy.yaml")
+		candidate := filepath.Join(current, name)
 		if _, err := os.Stat(candidate); err == nil {
 			return candidate
 		}
@@ -55,7 +65,9 @@ func loadPolicy(cwd string) (*projectPolicy, error) {
 	return &policy, nil
 }
 
-func applyPolicy(policy *projectPolicy, cwd string, resolvedCommand string, risk string) error {
+// applyPolicy checks the run against the project policy. argv is set for runs
+// that bypass the shell; command rules then match it word by word.
+func applyPolicy(policy *projectPolicy, cwd string, resolvedCommand string, argv []string, risk string) error {
 	if policy == nil {
 		return nil
 	}
@@ -63,10 +75,16 @@ func applyPolicy(policy *projectPolicy, cwd string, resolvedCommand string, risk
 		return fmt.Errorf("blocked by policy: risk %q exceeds max_risk %q", risk, policy.MaxRisk)
 	}
 
-	if matchesAnyRule(resolvedCommand, policy.DenyCommands) {
+	matches := func(rules []string) bool {
+		if len(argv) > 0 {
+			return matchesAnyArgvRule(argv, rules)
+		}
+		return matchesAnyRule(resolvedCommand, rules)
+	}
+	if matches(policy.DenyCommands) {
 		return errors.New("blocked by policy: command denied")
 	}
-	if len(policy.AllowCommands) > 0 && !matchesAnyRule(resolvedCommand, policy.AllowCommands) {
+	if len(policy.AllowCommands) > 0 && !matches(policy.AllowCommands) {
 		return errors.New("blocked by policy: command not in allow_commands")
 	}
 
@@ -220,6 +238,35 @@ func matchesAnyRule(command string, rules []string) bool {
 	return false
 }
 
+// matchesAnyArgvRule is matchesAnyRule for an argv: exact and prefix rules
+// compare whole words, re rules match the quoted argv.
+func matchesAnyArgvRule(argv []string, rules []string) bool {
+	for _, rule := range rules {
+		trimmed := strings.TrimSpace(rule)
+		if trimmed == "" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "exact:") && security.ArgvHasWords(argv, strings.TrimPrefix(trimmed, "exact:"), true) {
+			return true
+		}
+		if strings.HasPrefix(trimmed, "prefix:") && security.ArgvHasWords(argv, strings.TrimPrefix(trimmed, "prefix:"), false) {
+			return true
+		}
+		if strings.HasPrefix(trimmed, "re:") {
+			pattern := strings.TrimSpace(strings.TrimPrefix(trimmed, "re:"))
+			matched, err := regexp.MatchString(pattern, security.QuoteArgv(argv))
+			if err == nil && matched {
+				return true
+			}
+			continue
+		}
+		if security.ArgvHasWords(argv, trimmed, true) {
+			return true
+		}
+	}
+	return false
+}
+
 func pathMatchesAny(path string, rules []string) bool {
 	for _, rule := range rules {
 		normalized := strings.TrimSpace(rule)
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const defaultKillGraceSec = 5
+
+// killGracePeriod is how long a timed-out or cancelled command gets between
+// SIGTERM and SIGKILL.
+func killGracePeriod() time.Duration {
+	return time.Duration(parsePositiveIntEnv("SMARTSH_KILL_GRACE_SEC", defaultKillGraceSec)) * time.Second
+}
+
+// processTerminator remembers which signals smartshd sent to a command's
+// process group so the response can say what ended it.
+type processTerminator struct {
+	mu         sync.Mutex
+	lastSignal string
+	cancelled  bool
+	killTimer  *time.Timer
+}
+
+func (terminator *processTerminator) recordSignal(name string) {
+	terminator.mu.Lock()
+	defer terminator.mu.Unlock()
+	terminator.lastSignal = name
+}
+
+func (terminator *processTerminator) sentSignal() string {
+	terminator.mu.Lock()
+	defer terminator.mu.Unlock()
+	return terminator.lastSignal
+}
+
+// waitCommand waits for a command started with configureProcessTree. When the
+// command exits cleanly but a background process it spawned keeps the output
+// pipes open, Wait gives up after WaitDelay with exec.ErrWaitDelay; the
+// command itself still succeeded.
+func waitCommand(execCommand *exec.Cmd) error {
+	err := execCommand.Wait()
+	if errors.Is(err, exec.ErrWaitDelay) && execCommand.ProcessState != nil && execCommand.ProcessState.Success() {
+		return nil
+	}
+	return err
+}
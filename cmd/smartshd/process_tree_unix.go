@@ -0,0 +1,69 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// configureProcessTree starts the command in its own process group. When its
+// context ends, the whole group gets SIGTERM and, after the grace period,
+// SIGKILL, so grandchildren cannot outlive the job or hold its pipes open.
+func configureProcessTree(execCommand *exec.Cmd, grace time.Duration) *processTerminator {
+	terminator := &processTerminator{}
+	execCommand.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	execCommand.Cancel = func() error {
+		terminator.mu.Lock()
+		terminator.cancelled = true
+		terminator.killTimer = time.AfterFunc(grace, func() {
+			terminator.signalGroup(execCommand, syscall.SIGKILL)
+		})
+		terminator.mu.Unlock()
+		terminator.signalGroup(execCommand, syscall.SIGTERM)
+		return nil
+	}
+	// Backstop for processes that left the group, or outlived a clean exit,
+	// but kept our pipes; waitCommand reports the latter as success.
+	execCommand.WaitDelay = grace + time.Second
+	return terminator
+}
+
+func (terminator *processTerminator) signalGroup(execCommand *exec.Cmd, signal syscall.Signal) {
+	if execCommand.Process == nil {
+		return
+	}
+	if err := syscall.Kill(-execCommand.Process.Pid, signal); err == nil {
+		terminator.recordSignal(unix.SignalName(signal))
+	}
+}
+
+// finish stops the pending SIGKILL and, for cancelled commands, sweeps any
+// group members that survived the leader.
+func (terminator *processTerminator) finish(execCommand *exec.Cmd) {
+	terminator.mu.Lock()
+	cancelled := terminator.cancelled
+	if terminator.killTimer != nil {
+		terminator.killTimer.Stop()
+	}
+	terminator.mu.Unlock()
+	if cancelled && execCommand.Process != nil {
+		_ = syscall.Kill(-execCommand.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// waitStatusSignal returns the name and number of the signal the kernel
+// reported as having killed the shell, if any.
+func waitStatusSignal(runError error) (string, int) {
+	var exitError *exec.ExitError
+	if errors.As(runError, &exitError) {
+		if status, ok := exitError.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return unix.SignalName(status.Signal()), int(status.Signal())
+		}
+	}
+	return "", 0
+}
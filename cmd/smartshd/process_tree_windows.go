@@ -0,0 +1,22 @@
+//go:build windows
+
+package main
+
+import (
+	"os/exec"
+	"time"
+)
+
+// configureProcessTree keeps the default exec behaviour on Windows, where the
+// command is killed outright when its context ends.
+func configureProcessTree(execCommand *exec.Cmd, grace time.Duration) *processTerminator {
+	terminator := &processTerminator{}
+	execCommand.WaitDelay = grace
+	return terminator
+}
+
+func (terminator *processTerminator) finish(execCommand *exec.Cmd) {}
+
+func waitStatusSignal(runError error) (string, int) {
+	return "", 0
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"time"
+)
+
+// maxJobResumes bounds how often one job is re-queued after restarts so a
+// command that takes the daemon down cannot crash-loop it.
+const maxJobResumes = 2
+
+const interruptedJobError = "smartshd restarted before the job finished"
+
+type recoveryReport struct {
+	Interrupted      int
+	Resumed          int
+	ExpiredApprovals int
+}
+
+// recoverInterruptedJobs runs once at startup. Jobs left queued or running by a
+// previous daemon process are marked interrupted (and re-queued when they opted
+// into resume_on_restart). Pending approvals whose job can no longer be
+// executed, and approved ones whose job was interrupted and not resumed, are
+// expired.
+func (server *daemonServer) recoverInterruptedJobs() (recoveryReport, error) {
+	report := recoveryReport{}
+	jobs, err := server.store.ListByStatus("queued", "running")
+	if err != nil {
+		return report, err
+	}
+	for _, job := range jobs {
+		interrupted := runResponse{
+			MustUseSmartsh:  true,
+			JobID:           job.ID,
+			Status:          "interrupted",
+			Executed:        job.Result.Status == "running",
+			ResolvedCommand: job.Result.ResolvedCommand,
+			ExitCode:        1,
+			Summary:         "job interrupted by daemon restart",
+			ErrorType:       "runtime",
+			ApprovalID:      job.Result.ApprovalID,
+			Error:           interruptedJobError,
+		}
+		job.Result = interrupted
+		job.UpdatedAt = time.Now()
+		_ = server.store.Save(job)
+		server.publish(job.ID, interrupted)
+		server.metrics.recordJobStatus(interrupted.Status)
+		report.Interrupted++
+
+		if job.Request.ResumeOnRestart && job.ResumeCount < maxJobResumes && server.resumeJob(job) {
+			report.Resumed++
+		}
+	}
+
+	pending, err := server.store.ListApprovalsByStatus("pending")
+	if err != nil {
+		return report, err
+	}
+	approved, err := server.store.ListApprovalsByStatus("approved")
+	if err != nil {
+		return report, err
+	}
+	for _, approval := range append(pending, approved...) {
+		if approval.JobID == "" {
+			// Synchronous approvals execute directly and do not depend on a job.
+			continue
+		}
+		job, jobErr := server.store.Get(approval.JobID)
+		if jobErr != nil {
+			continue
+		}
+		if job != nil && approval.Status == "pending" && job.Result.Status == "needs_approval" {
+			continue
+		}
+		if job != nil && approval.Status == "approved" && job.Result.Status != "interrupted" {
+			continue
+		}
+		approval.Status = "expired"
+		approval.UpdatedAt = time.Now()
+		_ = server.store.SaveApproval(approval)
+		report.ExpiredApprovals++
+	}
+	return report, nil
+}
+
+func (server *daemonServer) resumeJob(job daemonJob) bool {
+	var approval *commandApproval
+	if job.Result.ApprovalID != "" {
+		loaded, err := server.store.GetApproval(job.Result.ApprovalID)
+		if err != nil || loaded == nil || loaded.Status != "approved" {
+			return false
+		}
+		approval = loaded
+	}
+
+	job.ResumeCount++
+	job.Result = runResponse{
+		MustUseSmartsh:  true,
+		JobID:           job.ID,
+		Status:          "queued",
+		Executed:        false,
+		ResolvedCommand: job.Result.ResolvedCommand,
+		ExitCode:        0,
+		Summary:         "job re-queued after daemon restart",
+		ApprovalID:      job.Result.ApprovalID,
+	}
+	job.UpdatedAt = time.Now()
+
+	priority, _ := parseJobPriority(job.Request.Priority, priorityNormal)
+	jobContext := server.trackJob(job.ID)
+	ticket := server.scheduler.enqueue(job.ID, resolveWorkspaceKey(job.Request.Cwd), priority)
+	server.applyQueuePosition(&job.Result)
+	_ = server.store.Save(job)
+	server.publish(job.ID, job.Result)
+	if approval != nil {
+		go server.executeApprovedJob(jobContext, *approval, ticket)
+	} else {
+		go server.executeJob(jobContext, job.ID, ticket)
+	}
+	return true
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	maxRetryAttempts   = 10
+	maxRetryBackoffSec = 300
+)
+
+// normalizeRetryPolicy returns nil when the request does not ask for more than
+// one attempt, and clamps the remaining settings.
+func normalizeRetryPolicy(policy *retryPolicy) *retryPolicy {
+	if policy == nil || policy.MaxAttempts <= 1 {
+		return nil
+	}
+	normalized := retryPolicy{
+		MaxAttempts: min(policy.MaxAttempts, maxRetryAttempts),
+		BackoffSec:  min(max(0, policy.BackoffSec), maxRetryBackoffSec),
+	}
+	for _, errorType := range policy.RetryOn {
+		if trimmed := strings.ToLower(strings.TrimSpace(errorType)); trimmed != "" {
+			normalized.RetryOn = append(normalized.RetryOn, trimmed)
+		}
+	}
+	return &normalized
+}
+
+// shouldRetry reports whether a failed attempt qualifies for another try. An
+// empty retry_on retries any failure; sandbox violations and cancellations
+// never change on a rerun.
+func (policy retryPolicy) shouldRetry(result runResponse) bool {
+	if result.Status != "failed" || result.ErrorType == "sandbox" {
+		return false
+	}
+	if len(policy.RetryOn) == 0 {
+		return true
+	}
+	for _, errorType := range policy.RetryOn {
+		if errorType == result.ErrorType {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff doubles the base delay after every failed attempt.
+func (policy retryPolicy) backoff(failedAttempt int) time.Duration {
+	if policy.BackoffSec <= 0 {
+		return 0
+	}
+	delay := time.Duration(policy.BackoffSec) * time.Second << (failedAttempt - 1)
+	if ceiling := time.Duration(maxRetryBackoffSec) * time.Second; delay > ceiling {
+		return ceiling
+	}
+	return delay
+}
+
+// runWithRetry executes the prepared command until it succeeds, fails with an
+// error type outside retry_on, or runs out of attempts. The last attempt's
+// result is returned with every attempt recorded; a success after a failure
+// is flagged flaky.
+func (server *daemonServer) runWithRetry(ctx context.Context, prepared preparedCommand, policy retryPolicy) runResponse {
+	attempts := make([]runAttempt, 0, policy.MaxAttempts)
+	var result runResponse
+	for attempt := 1; attempt <= policy.MaxAttempts; attempt++ {
+		if attempt > 1 && prepared.outputLog != nil {
+			_, _ = fmt.Fprintf(prepared.outputLog, "\n[smartshd retry attempt %d/%d]\n", attempt, policy.MaxAttempts)
+		}
+		result = server.runPreparedCommand(ctx, prepared)
+		attempts = append(attempts, runAttempt{
+			Attempt:    attempt,
+			Status:     result.Status,
+			ExitCode:   result.ExitCode,
+			ErrorType:  result.ErrorType,
+			DurationMS: result.DurationMS,
+		})
+		if ctx.Err() != nil || attempt == policy.MaxAttempts || !policy.shouldRetry(result) {
+			break
+		}
+		server.metrics.recordRetry()
+		if delay := policy.backoff(attempt); delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+			case <-timer.C:
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+	}
+	result.Attempts = attempts
+	result.Flaky = len(attempts) > 1 && result.Status == "completed"
+	if result.Flaky {
+		result.Summary = fmt.Sprintf("%s (passed on attempt %d of %d; flaky)", result.Summary, len(attempts), policy.MaxAttempts)
+	}
+	return result
+}
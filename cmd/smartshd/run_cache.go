@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	defaultRunCacheMaxAgeSec = 24 * 60 * 60
+	defaultRunCacheMaxMB     = 64
+	runCacheGitTimeout       = 10 * time.Second
+)
+
+// volatileCacheEnv are variables that differ between otherwise identical
+// invocations and must not split the cache.
+var volatileCacheEnv = map[string]bool{
+	"_":               true,
+	"PWD":             true,
+	"OLDPWD":          true,
+	"SHLVL":           true,
+	"SSH_AUTH_SOCK":   true,
+	"SSH_AGENT_PID":   true,
+	"TERM_SESSION_ID": true,
+	"WINDOWID":        true,
+	"XDG_SESSION_ID":  true,
+}
+
+type runCacheEntry struct {
+	Response  runResponse `json:"response"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// computeRunCacheKey hashes everything that determines a command's result:
+// the resolved command, cwd, filtered environment, sandbox mode, stdin, the
+// summary parser hint and the state of its inputs. It fails when the inputs
+// cannot be determined, in which case the run is not cached.
+func computeRunCacheKey(command string, cwd string, env []string, sandbox string, stdin string, parser string, inputs []string) (string, error) {
+	inputHash, err := hashRunCacheInputs(cwd, inputs)
+	if err != nil {
+		return "", err
+	}
+	filteredEnv := make([]string, 0, len(env))
+	for _, entry := range env {
+		name, _, _ := strings.Cut(entry, "=")
+		if !volatileCacheEnv[name] {
+			filteredEnv = append(filteredEnv, entry)
+		}
+	}
+	sort.Strings(filteredEnv)
+	hasher := sha256.New()
+	for _, part := range []string{command, cwd, sandbox, stdin, parser, strings.Join(filteredEnv, "\x00"), inputHash} {
+		_, _ = io.WriteString(hasher, part)
+		_, _ = hasher.Write([]byte{0})
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// hashRunCacheInputs hashes the declared input globs, or, without any, the
+// git tree state: HEAD plus the content of every modified or untracked file.
+func hashRunCacheInputs(cwd string, inputs []string) (string, error) {
+	files := make([]string, 0)
+	hasher := sha256.New()
+	if len(inputs) > 0 {
+		for _, pattern := range inputs {
+			matches, err := expandCacheInputGlob(cwd, pattern)
+			if err != nil {
+				return "", err
+			}
+			files = append(files, matches...)
+		}
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), runCacheGitTimeout)
+		defer cancel()
+		head, err := exec.CommandContext(ctx, "git", "-C", cwd, "rev-parse", "HEAD").Output()
+		if err != nil {
+			return "", errors.New("cache needs a git work tree or cache_inputs")
+		}
+		status, err := exec.CommandContext(ctx, "git", "--no-optional-locks", "-C", cwd, "status", "--porcelain=v1", "-z", "--untracked-files=all").Output()
+		if err != nil {
+			return "", fmt.Errorf("git status failed: %w", err)
+		}
+		topLevel, err := exec.CommandContext(ctx, "git", "-C", cwd, "rev-parse", "--show-toplevel").Output()
+		if err != nil {
+			return "", fmt.Errorf("git rev-parse failed: %w", err)
+		}
+		root := strings.TrimSpace(string(topLevel))
+		_, _ = hasher.Write(head)
+		_, _ = hasher.Write(status)
+		for _, record := range bytes.Split(status, []byte{0}) {
+			if len(record) > 3 {
+				files = append(files, filepath.Join(root, string(record[3:])))
+			}
+		}
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		_, _ = io.WriteString(hasher, file)
+		_, _ = hasher.Write([]byte{0})
+		content, err := os.ReadFile(file)
+		if err != nil {
+			// Deleted files are already captured by git status; directories and
+			// unreadable entries only contribute their name.
+			continue
+		}
+		sum := sha256.Sum256(content)
+		_, _ = hasher.Write(sum[:])
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// expandCacheInputGlob resolves a glob relative to cwd. A "**" segment matches
+// any depth: "src/**/*.ts" walks src and matches "*.ts" against file names.
+func expandCacheInputGlob(cwd string, pattern string) ([]string, error) {
+	pattern = strings.TrimSpace(pattern)
+	if pattern == "" {
+		return nil, nil
+	}
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(cwd, pattern)
+	}
+	root, rest, recursive := strings.Cut(pattern, "**")
+	if !recursive {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cache_inputs pattern %q: %w", pattern, err)
+		}
+		return matches, nil
+	}
+	namePattern := strings.TrimPrefix(rest, string(filepath.Separator))
+	if namePattern == "" {
+		namePattern = "*"
+	}
+	if _, err := filepath.Match(namePattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid cache_inputs pattern %q: %w", pattern, err)
+	}
+	matches := make([]string, 0)
+	walkErr := filepath.WalkDir(filepath.Clean(root), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if entry.IsDir() {
+			if entry.Name() == ".git" || entry.Name() == "node_modules" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if matched, _ := filepath.Match(namePattern, entry.Name()); matched {
+			matches = append(matches, path)
+		}
+		return nil
+	})
+	return matches, walkErr
+}
+
+// isCacheableResult keeps results that a rerun would reproduce: clean exits
+// and ordinary failures, not runs that were killed, cancelled or blocked.
+func isCacheableResult(response runResponse) bool {
+	if response.Status != "completed" && response.Status != "failed" {
+		return false
+	}
+	return response.Signal == "" && response.ErrorType != "sandbox" && !response.Flaky
+}
+
+func (store *jobStore) GetCachedRun(key string, maxAge time.Duration) (*runCacheEntry, error) {
+	var entry *runCacheEntry
+	err := store.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(runCacheBucket).Get([]byte(key))
+		if raw == nil {
+			return nil
+		}
+		parsed := runCacheEntry{}
+		if decodeErr := json.Unmarshal(raw, &parsed); decodeErr != nil {
+			return nil
+		}
+		if time.Since(parsed.CreatedAt) > maxAge {
+			return nil
+		}
+		entry = &parsed
+		return nil
+	})
+	return entry, err
+}
+
+// PutCachedRun stores a result and evicts entries older than maxAge, then the
+// oldest entries until the bucket fits in maxBytes.
+func (store *jobStore) PutCachedRun(key string, response runResponse, maxAge time.Duration, maxBytes int) error {
+	payload, err := json.Marshal(runCacheEntry{Response: response, CreatedAt: time.Now()})
+	if err != nil {
+		return err
+	}
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(runCacheBucket)
+		if putErr := bucket.Put([]byte(key), payload); putErr != nil {
+			return putErr
+		}
+		type cachedItem struct {
+			key       []byte
+			size      int
+			createdAt time.Time
+		}
+		items := make([]cachedItem, 0)
+		totalBytes := 0
+		expired := make([][]byte, 0)
+		_ = bucket.ForEach(func(itemKey []byte, value []byte) error {
+			parsed := runCacheEntry{}
+			if json.Unmarshal(value, &parsed) != nil || time.Since(parsed.CreatedAt) > maxAge {
+				expired = append(expired, append([]byte{}, itemKey...))
+				return nil
+			}
+			items = append(items, cachedItem{key: append([]byte{}, itemKey...), size: len(itemKey) + len(value), createdAt: parsed.CreatedAt})
+			totalBytes += len(itemKey) + len(value)
+			return nil
+		})
+		sort.Slice(items, func(i, j int) bool { return items[i].createdAt.Before(items[j].createdAt) })
+		for index := 0; totalBytes > maxBytes && index < len(items); index++ {
+			expired = append(expired, items[index].key)
+			totalBytes -= items[index].size
+		}
+		for _, expiredKey := range expired {
+			if deleteErr := bucket.Delete(expiredKey); deleteErr != nil {
+				return deleteErr
+			}
+		}
+		return nil
+	})
+}
+
+func runCacheMaxAge() time.Duration {
+	return time.Duration(parsePositiveIntEnv("SMARTSH_CACHE_MAX_AGE_SEC", defaultRunCacheMaxAgeSec)) * time.Second
+}
+
+func runCacheMaxBytes() int {
+	return parsePositiveIntEnv("SMARTSH_CACHE_MAX_MB", defaultRunCacheMaxMB) * 1024 * 1024
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// resourceUsage is what one command execution consumed, taken from the wait
+// status of its shell, which includes every descendant the shell reaped.
+type resourceUsage struct {
+	WallMS       int64 `json:"wall_ms"`
+	UserCPUMS    int64 `json:"user_cpu_ms"`
+	SystemCPUMS  int64 `json:"system_cpu_ms"`
+	PeakRSSBytes int64 `json:"peak_rss_bytes,omitempty"`
+	OutputBytes  int64 `json:"output_bytes"`
+}
+
+func collectResourceUsage(state *os.ProcessState, wall time.Duration, outputBytes int64) *resourceUsage {
+	usage := &resourceUsage{WallMS: wall.Milliseconds(), OutputBytes: outputBytes}
+	if state == nil {
+		return usage
+	}
+	usage.UserCPUMS = state.UserTime().Milliseconds()
+	usage.SystemCPUMS = state.SystemTime().Milliseconds()
+	usage.PeakRSSBytes = peakRSSBytes(state)
+	return usage
+}
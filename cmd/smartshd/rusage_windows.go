@@ -0,0 +1,10 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// peakRSSBytes is not available from a Windows wait status.
+func peakRSSBytes(state *os.ProcessState) int64 {
+	return 0
+}
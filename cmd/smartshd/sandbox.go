@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	sandboxOff      = "off"
+	sandboxLandlock = "landlock"
+	sandboxStrict   = "strict"
+)
+
+// parseSandboxMode normalises a sandbox setting from a request or policy.
+func parseSandboxMode(value string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", sandboxOff, "none":
+		return sandboxOff, nil
+	case sandboxLandlock:
+		return sandboxLandlock, nil
+	case sandboxStrict:
+		return sandboxStrict, nil
+	default:
+		return "", fmt.Errorf("invalid sandbox %q (expected strict|landlock|off)", value)
+	}
+}
+
+func sandboxRank(mode string) int {
+	switch mode {
+	case sandboxStrict:
+		return 2
+	case sandboxLandlock:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// resolveSandboxMode combines the request and the project policy, keeping the
+// stricter of the two: a policy sandbox cannot be relaxed by a request.
+func resolveSandboxMode(requested string, policy *projectPolicy) (string, error) {
+	mode, err := parseSandboxMode(requested)
+	if err != nil {
+		return "", err
+	}
+	if policy != nil {
+		policyMode, policyErr := parseSandboxMode(policy.Sandbox)
+		if policyErr != nil {
+			return "", fmt.Errorf("invalid .smartsh-policy.yaml: %w", policyErr)
+		}
+		if sandboxRank(policyMode) > sandboxRank(mode) {
+			mode = policyMode
+		}
+	}
+	return mode, nil
+}
+
+// sandboxWritablePaths lists what a sandboxed command may write: the cwd, the
+// project (git work tree) containing it and existing policy allow_paths.
+func sandboxWritablePaths(cwd string, policy *projectPolicy) []string {
+	paths := []string{cwd}
+	if workspace := resolveWorkspaceKey(cwd); workspace != "" && workspace != cwd {
+		paths = append(paths, workspace)
+	}
+	if policy != nil {
+		for _, rule := range policy.AllowPaths {
+			absolute, err := filepath.Abs(strings.TrimSpace(rule))
+			if err != nil || strings.TrimSpace(rule) == "" {
+				continue
+			}
+			if _, statErr := os.Stat(absolute); statErr == nil {
+				paths = append(paths, absolute)
+			}
+		}
+	}
+	return paths
+}
+
+// sandboxDeniedPaths lists the existing policy deny_paths. The sandbox keeps
+// them read-only even where they lie inside a writable path.
+func sandboxDeniedPaths(policy *projectPolicy) []string {
+	paths := make([]string, 0)
+	if policy == nil {
+		return paths
+	}
+	for _, rule := range policy.DenyPaths {
+		absolute, err := filepath.Abs(strings.TrimSpace(rule))
+		if err != nil || strings.TrimSpace(rule) == "" {
+			continue
+		}
+		if _, statErr := os.Lstat(absolute); statErr == nil {
+			paths = append(paths, absolute)
+		}
+	}
+	return paths
+}
+
+// sandboxTempPaths are the shared temp directories a Landlock-confined command
+// may write to: the daemon's TMPDIR (or /tmp) and /dev/shm. The namespace
+// sandbox gives each command a private /tmp instead.
+func sandboxTempPaths() []string {
+	paths := make([]string, 0, 2)
+	for _, candidate := range []string{os.TempDir(), "/dev/shm"} {
+		if _, err := os.Stat(candidate); err == nil && !containsString(paths, candidate) {
+			paths = append(paths, candidate)
+		}
+	}
+	return paths
+}
+
+var sandboxDeniedLinePattern = regexp.MustCompile(`(?i)(permission denied|read-only file system|operation not permitted)`)
+var sandboxPathPattern = regexp.MustCompile(`(/[^\s'"‘’:]+)`)
+
+// sandboxWriteLinePattern recognises error lines about a write: a read-only
+// file system, or a tool saying it could not create, change or remove
+// something. A bare "Permission denied" may just as well be a failed read.
+var sandboxWriteLinePattern = regexp.MustCompile(`(?i)(read-only file system|\b(cannot|can't|could not|couldn't|unable to|failed to) (create|touch|write|remove|delete|make|move|rename|overwrite|truncate|mkdir|unlink|open [^:]* for writing))`)
+
+// detectSandboxViolation looks for a failed write in command output and
+// returns the first denied absolute path outside the writable set, or inside
+// a denied path. A path the daemon could not write either is an ordinary
+// permission error, not the sandbox's doing.
+func detectSandboxViolation(output string, writablePaths []string, deniedPaths []string) string {
+	for _, line := range splitNonEmptyLines(output) {
+		if !sandboxDeniedLinePattern.MatchString(line) || !sandboxWriteLinePattern.MatchString(line) {
+			continue
+		}
+		for _, candidate := range sandboxPathPattern.FindAllString(line, -1) {
+			path := filepath.Clean(candidate)
+			if pathWithinAny(path, writablePaths) && !pathWithinAny(path, deniedPaths) {
+				continue
+			}
+			if daemonCanWrite(path) {
+				return path
+			}
+		}
+	}
+	return ""
+}
+
+// daemonCanWrite reports whether the daemon itself may write path, or create
+// it in its nearest existing parent directory.
+func daemonCanWrite(path string) bool {
+	for current := path; ; current = filepath.Dir(current) {
+		if _, err := os.Lstat(current); err == nil {
+			return pathWritable(current)
+		}
+		if parent := filepath.Dir(current); parent == current {
+			return false
+		}
+	}
+}
+
+func pathWithinAny(path string, roots []string) bool {
+	for _, root := range roots {
+		if path == root || strings.HasPrefix(path, strings.TrimSuffix(root, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, existing := range values {
+		if existing == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,271 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// sandboxExecArg marks a re-exec of the smartshd binary as the in-namespace
+// setup helper. It is checked from init so that test binaries, which never
+// reach main, can host the helper too.
+const sandboxExecArg = "__smartsh-sandbox-exec"
+
+func init() {
+	if len(os.Args) > 1 && os.Args[1] == sandboxExecArg {
+		runSandboxChild(os.Args[2:])
+	}
+}
+
+var (
+	userNamespacesOnce      sync.Once
+	userNamespacesSupported bool
+)
+
+// applySandbox rewrites execCommand to start through the setup helper and
+// returns the mechanism in effect. Strict mode uses fresh user, mount and
+// network namespaces. Where unprivileged user namespaces are disabled it
+// fails, unless SMARTSH_SANDBOX_ALLOW_FALLBACK opts into Landlock write
+// confinement, which still allows network access. Denied paths stay
+// read-only even inside a writable path.
+func applySandbox(execCommand *exec.Cmd, cwd string, mode string, writablePaths []string, deniedPaths []string) (string, error) {
+	applied := mode
+	if mode == sandboxStrict && !userNamespacesAvailable() {
+		if !parseBooleanEnv("SMARTSH_SANDBOX_ALLOW_FALLBACK") {
+			return "", errors.New("strict sandbox unavailable: user namespaces are disabled; set SMARTSH_SANDBOX_ALLOW_FALLBACK=true to accept Landlock, which does not block network access")
+		}
+		applied = sandboxLandlock
+	}
+	if applied == sandboxLandlock && landlockABIVersion() <= 0 {
+		if mode == sandboxStrict {
+			return "", errors.New("strict sandbox unavailable: neither user namespaces nor Landlock are supported")
+		}
+		return "", errors.New("landlock sandbox unavailable: kernel does not support Landlock")
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("%s sandbox unavailable: %w", mode, err)
+	}
+	args := []string{self, sandboxExecArg, "--mode", applied, "--cwd", cwd}
+	for _, path := range writablePaths {
+		args = append(args, "--writable", path)
+	}
+	if applied == sandboxLandlock {
+		for _, path := range sandboxTempPaths() {
+			args = append(args, "--writable", path)
+		}
+	}
+	for _, path := range deniedPaths {
+		args = append(args, "--deny", path)
+	}
+	args = append(args, "--", execCommand.Path)
+	args = append(args, execCommand.Args...)
+	execCommand.Path = self
+	execCommand.Args = args
+
+	if applied == sandboxStrict {
+		if execCommand.SysProcAttr == nil {
+			execCommand.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		configureSandboxNamespaces(execCommand.SysProcAttr)
+	}
+	return applied, nil
+}
+
+// configureSandboxNamespaces maps the daemon's own uid/gid into the new user
+// namespace. The helper keeps CAP_SYS_ADMIN only long enough to build the
+// filesystem view, then execs the command without capabilities.
+func configureSandboxNamespaces(attributes *syscall.SysProcAttr) {
+	uid := os.Getuid()
+	gid := os.Getgid()
+	attributes.Cloneflags |= syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWNET
+	attributes.UidMappings = []syscall.SysProcIDMap{{ContainerID: uid, HostID: uid, Size: 1}}
+	attributes.GidMappings = []syscall.SysProcIDMap{{ContainerID: gid, HostID: gid, Size: 1}}
+	attributes.AmbientCaps = []uintptr{unix.CAP_SYS_ADMIN, unix.CAP_NET_ADMIN}
+}
+
+// userNamespacesAvailable probes once by starting a trivial process in the
+// namespaces the strict sandbox needs; sysctls alone miss AppArmor and
+// seccomp restrictions.
+func userNamespacesAvailable() bool {
+	userNamespacesOnce.Do(func() {
+		probe := exec.Command("/bin/true")
+		probe.SysProcAttr = &syscall.SysProcAttr{}
+		configureSandboxNamespaces(probe.SysProcAttr)
+		userNamespacesSupported = probe.Run() == nil
+	})
+	return userNamespacesSupported
+}
+
+func runSandboxChild(args []string) {
+	if err := setupSandbox(args); err != nil {
+		fmt.Fprintf(os.Stderr, "smartsh sandbox: %v\n", err)
+		os.Exit(125)
+	}
+}
+
+func setupSandbox(args []string) error {
+	mode := sandboxStrict
+	cwd := ""
+	writable := make([]string, 0, 2)
+	denied := make([]string, 0)
+	for len(args) > 0 && args[0] != "--" {
+		if len(args) < 2 {
+			return fmt.Errorf("missing value for %s", args[0])
+		}
+		switch args[0] {
+		case "--mode":
+			mode = args[1]
+		case "--cwd":
+			cwd = args[1]
+		case "--writable":
+			writable = append(writable, filepath.Clean(args[1]))
+		case "--deny":
+			denied = append(denied, filepath.Clean(args[1]))
+		default:
+			return fmt.Errorf("unknown option %s", args[0])
+		}
+		args = args[2:]
+	}
+	if len(args) < 3 {
+		return errors.New("missing command")
+	}
+	commandPath, argv := args[1], args[2:]
+	env := os.Environ()
+
+	// Both the Landlock domain and no_new_privs are per thread; exec from the
+	// thread that set them up.
+	runtime.LockOSThread()
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("set no_new_privs: %w", err)
+	}
+	switch mode {
+	case sandboxStrict:
+		if err := setupSandboxMounts(cwd, writable, denied); err != nil {
+			return err
+		}
+		env = make([]string, 0, len(env)+1)
+		for _, entry := range os.Environ() {
+			if !strings.HasPrefix(entry, "TMPDIR=") {
+				env = append(env, entry)
+			}
+		}
+		env = append(env, "TMPDIR=/tmp")
+	case sandboxLandlock:
+		if err := restrictWritesWithLandlock(landlockWriteRules(writable, denied)); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown sandbox mode %s", mode)
+	}
+	return syscall.Exec(commandPath, argv, env)
+}
+
+func setupSandboxMounts(cwd string, writable []string, denied []string) error {
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("make mounts private: %w", err)
+	}
+	// Clone the writable trees before anything else so they survive both the
+	// read-only remount and a tmpfs mounted over a parent such as /tmp.
+	clones := make([]int, len(writable))
+	for index, path := range writable {
+		fd, err := unix.OpenTree(unix.AT_FDCWD, path, unix.OPEN_TREE_CLONE|unix.OPEN_TREE_CLOEXEC|unix.AT_RECURSIVE)
+		if err != nil {
+			return fmt.Errorf("clone %s: %w", path, err)
+		}
+		clones[index] = fd
+	}
+	if err := unix.MountSetattr(-1, "/", unix.AT_RECURSIVE, &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_RDONLY}); err != nil {
+		return fmt.Errorf("remount read-only: %w", err)
+	}
+	if err := unix.Mount("tmpfs", "/tmp", "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=1777"); err != nil {
+		return fmt.Errorf("mount private /tmp: %w", err)
+	}
+	for index, path := range writable {
+		if strings.HasPrefix(path, "/tmp/") {
+			if err := os.MkdirAll(path, 0o755); err != nil {
+				return fmt.Errorf("prepare %s: %w", path, err)
+			}
+		}
+		if err := unix.MoveMount(clones[index], "", unix.AT_FDCWD, path, unix.MOVE_MOUNT_F_EMPTY_PATH); err != nil {
+			return fmt.Errorf("mount writable %s: %w", path, err)
+		}
+		_ = unix.Close(clones[index])
+	}
+	// Denied paths inside the writable trees get a read-only mount of their
+	// own; everything else is read-only already.
+	for _, path := range denied {
+		if !pathWithinAny(path, writable) {
+			continue
+		}
+		if err := remountReadOnly(path); err != nil {
+			return err
+		}
+	}
+	if cwd != "" {
+		if err := os.Chdir(cwd); err != nil {
+			return fmt.Errorf("enter cwd: %w", err)
+		}
+	}
+	// Loopback only: local test servers work, nothing leaves the namespace.
+	_ = bringUpLoopback()
+
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+		return fmt.Errorf("drop capabilities: %w", err)
+	}
+	if os.Getuid() == 0 {
+		// Root inside the namespace would keep its capabilities across exec
+		// and could undo the mounts, so empty the bounding set.
+		for capability := 0; capability <= unix.CAP_LAST_CAP; capability++ {
+			_ = unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(capability), 0, 0, 0)
+		}
+	}
+	return nil
+}
+
+func remountReadOnly(path string) error {
+	fd, err := unix.OpenTree(unix.AT_FDCWD, path, unix.OPEN_TREE_CLONE|unix.OPEN_TREE_CLOEXEC|unix.AT_RECURSIVE)
+	if err != nil {
+		return fmt.Errorf("clone denied %s: %w", path, err)
+	}
+	defer unix.Close(fd)
+	if err := unix.MountSetattr(fd, "", unix.AT_EMPTY_PATH|unix.AT_RECURSIVE, &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_RDONLY}); err != nil {
+		return fmt.Errorf("make denied %s read-only: %w", path, err)
+	}
+	if err := unix.MoveMount(fd, "", unix.AT_FDCWD, path, unix.MOVE_MOUNT_F_EMPTY_PATH); err != nil {
+		return fmt.Errorf("mount denied %s: %w", path, err)
+	}
+	return nil
+}
+
+// pathWritable asks the kernel whether the daemon may write path.
+func pathWritable(path string) bool {
+	return unix.Access(path, unix.W_OK) == nil
+}
+
+func bringUpLoopback() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	request, err := unix.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, request); err != nil {
+		return err
+	}
+	request.SetUint16(request.Uint16() | unix.IFF_UP)
+	return unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, request)
+}
@@ -0,0 +1,192 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunCommandWithCapture_StrictSandbox(t *testing.T) {
+	projectDir := t.TempDir()
+	probeName := filepath.Base(projectDir) + "-outside"
+	outsidePath := filepath.Join(os.TempDir(), probeName)
+	defer os.Remove(outsidePath)
+
+	isolation := isolationOptions{MaxOutputKB: 16, Sandbox: sandboxStrict, WritablePaths: sandboxWritablePaths(projectDir, nil)}
+	script := strings.Join([]string{
+		"echo ok > inside.txt",
+		"touch /tmp/" + probeName,
+		"(touch /etc/smartsh-sandbox-probe 2>/dev/null && echo etc=writable || echo etc=readonly)",
+		"grep -c : /proc/net/dev",
+	}, " && ")
+	_, output, err := runCommandWithCapture(context.Background(), script, projectDir, isolation, os.Environ(), nil)
+	if err != nil && (strings.Contains(output.Combined, "smartsh sandbox:") || strings.Contains(err.Error(), "operation not permitted")) {
+		t.Skipf("user namespaces unavailable: %v %s", err, output.Combined)
+	}
+	if err != nil {
+		t.Fatalf("sandboxed command failed: %v\n%s", err, output.Combined)
+	}
+	if _, statErr := os.Stat(filepath.Join(projectDir, "inside.txt")); statErr != nil {
+		t.Fatalf("expected write inside project to succeed: %v", statErr)
+	}
+	if _, statErr := os.Stat(outsidePath); !os.IsNotExist(statErr) {
+		t.Fatalf("expected /tmp writes to stay private, stat err=%v", statErr)
+	}
+	if !strings.Contains(output.Stdout, "etc=readonly") {
+		t.Fatalf("expected /etc to be read-only, output: %s", output.Stdout)
+	}
+	if lines := strings.Fields(output.Stdout); lines[len(lines)-1] != "1" {
+		t.Fatalf("expected only loopback in network namespace, output: %s", output.Stdout)
+	}
+}
+
+func TestExecuteRequest_LandlockBlocksWritesOutsideProject(t *testing.T) {
+	if landlockABIVersion() <= 0 {
+		t.Skip("landlock is not supported by this kernel")
+	}
+	t.Setenv("SMARTSH_DAEMON_DISABLE_AUTH", "true")
+	t.Setenv("SMARTSH_SUMMARY_PROVIDER", "deterministic")
+	baseDir := t.TempDir()
+	projectDir := filepath.Join(baseDir, "project")
+	outsideDir := filepath.Join(baseDir, "outside")
+	tempDir := filepath.Join(baseDir, "tmp")
+	for _, dir := range []string{projectDir, outsideDir, tempDir} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatalf("mkdir failed: %v", err)
+		}
+	}
+	// Point the shared temp dir elsewhere so outsideDir is not covered by it.
+	t.Setenv("TMPDIR", tempDir)
+
+	store, err := newJobStore(filepath.Join(baseDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+	server := newDaemonServer(store)
+	blockedPath := filepath.Join(outsideDir, "escape.txt")
+	response := server.executeRequest(context.Background(), runRequest{
+		Command: "echo inside > ok.txt && echo escape > " + blockedPath,
+		Cwd:     projectDir,
+		Unsafe:  true,
+		Sandbox: sandboxLandlock,
+	}, "")
+	if response.Sandbox != sandboxLandlock {
+		t.Fatalf("expected landlock sandbox, got %+v", response)
+	}
+	if _, statErr := os.Stat(filepath.Join(projectDir, "ok.txt")); statErr != nil {
+		t.Fatalf("expected write inside project to succeed: %v", statErr)
+	}
+	if response.Status != "failed" || response.ErrorType != "sandbox" || response.SandboxViolation != blockedPath {
+		t.Fatalf("expected sandbox violation for %s, got status=%s error_type=%s violation=%q", blockedPath, response.Status, response.ErrorType, response.SandboxViolation)
+	}
+}
+
+func TestDetectSandboxViolation(t *testing.T) {
+	projectDir := t.TempDir()
+	outsideDir := t.TempDir()
+	deniedDir := filepath.Join(projectDir, ".git")
+	readOnlyDir := filepath.Join(outsideDir, "readonly")
+	if err := os.MkdirAll(readOnlyDir, 0o500); err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+	testCases := []struct {
+		name     string
+		output   string
+		expected string
+	}{
+		{name: "redirect outside", output: "sh: 1: cannot create " + outsideDir + "/authorized_keys: Permission denied", expected: outsideDir + "/authorized_keys"},
+		{name: "read-only file system", output: "touch: cannot touch '" + outsideDir + "/hosts': Read-only file system", expected: outsideDir + "/hosts"},
+		{name: "write inside project", output: "mkdir: cannot create directory '" + projectDir + "/out': Permission denied", expected: ""},
+		{name: "write to denied path", output: "sh: 1: cannot create " + deniedDir + "/config: Permission denied", expected: deniedDir + "/config"},
+		{name: "failed read", output: "cat: " + outsideDir + "/secret: Permission denied", expected: ""},
+		{name: "unrelated failure", output: "error: build failed", expected: ""},
+	}
+	if os.Getuid() != 0 {
+		testCases = append(testCases, struct {
+			name     string
+			output   string
+			expected string
+		}{name: "not writable without sandbox", output: "sh: 1: cannot create " + readOnlyDir + "/x: Permission denied", expected: ""})
+	}
+	for _, testCase := range testCases {
+		if violation := detectSandboxViolation(testCase.output, []string{projectDir}, []string{deniedDir}); violation != testCase.expected {
+			t.Fatalf("%s: detectSandboxViolation(%q) = %q, want %q", testCase.name, testCase.output, violation, testCase.expected)
+		}
+	}
+}
+
+func TestExecuteRequest_SandboxKeepsDeniedPathsReadOnly(t *testing.T) {
+	t.Setenv("SMARTSH_SUMMARY_PROVIDER", "deterministic")
+	baseDir := t.TempDir()
+	t.Setenv("TMPDIR", filepath.Join(baseDir, "tmp"))
+	store, err := newJobStore(filepath.Join(baseDir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	defer store.Close()
+	server := newDaemonServer(store)
+
+	for _, mode := range []string{sandboxLandlock, sandboxStrict} {
+		t.Run(mode, func(t *testing.T) {
+			if mode == sandboxLandlock && landlockABIVersion() <= 0 {
+				t.Skip("landlock is not supported by this kernel")
+			}
+			if mode == sandboxStrict && !userNamespacesAvailable() {
+				t.Skip("user namespaces unavailable")
+			}
+			projectDir := filepath.Join(baseDir, mode)
+			secretsDir := filepath.Join(projectDir, "secrets")
+			for _, dir := range []string{filepath.Join(projectDir, "src"), secretsDir, filepath.Join(baseDir, "tmp")} {
+				if err := os.MkdirAll(dir, 0o755); err != nil {
+					t.Fatalf("mkdir failed: %v", err)
+				}
+			}
+			policy := "version: 1\ndeny_paths:\n  - " + secretsDir + "\n"
+			if err := os.WriteFile(filepath.Join(projectDir, ".smartsh-policy.yaml"), []byte(policy), 0o644); err != nil {
+				t.Fatalf("write policy failed: %v", err)
+			}
+			blockedPath := filepath.Join(secretsDir, "key")
+			response := server.executeRequest(context.Background(), runRequest{
+				Command: "echo ok > src/ok.txt && echo leak > " + blockedPath,
+				Cwd:     projectDir,
+				Unsafe:  true,
+				Sandbox: mode,
+			}, "")
+			if _, statErr := os.Stat(filepath.Join(projectDir, "src", "ok.txt")); statErr != nil {
+				t.Fatalf("expected write beside the denied path to succeed: %v (%+v)", statErr, response)
+			}
+			if _, statErr := os.Stat(blockedPath); !os.IsNotExist(statErr) {
+				t.Fatalf("expected denied path to stay read-only, stat err=%v", statErr)
+			}
+			if response.Sandbox != mode || response.ErrorType != "sandbox" || response.SandboxViolation != blockedPath {
+				t.Fatalf("expected %s sandbox violation for %s, got %+v", mode, blockedPath, response)
+			}
+		})
+	}
+}
+
+func TestApplySandbox_StrictNeedsOptInToFallBack(t *testing.T) {
+	if landlockABIVersion() <= 0 {
+		t.Skip("landlock is not supported by this kernel")
+	}
+	userNamespacesAvailable()
+	supported := userNamespacesSupported
+	userNamespacesSupported = false
+	defer func() { userNamespacesSupported = supported }()
+
+	projectDir := t.TempDir()
+	isolation := isolationOptions{MaxOutputKB: 16, Sandbox: sandboxStrict, WritablePaths: []string{projectDir}}
+	if _, _, err := runCommandWithCapture(context.Background(), "true", projectDir, isolation, os.Environ(), nil); err == nil || !strings.Contains(err.Error(), "SMARTSH_SANDBOX_ALLOW_FALLBACK") {
+		t.Fatalf("expected strict sandbox to refuse to degrade, got %v", err)
+	}
+	t.Setenv("SMARTSH_SANDBOX_ALLOW_FALLBACK", "true")
+	_, output, err := runCommandWithCapture(context.Background(), "true", projectDir, isolation, os.Environ(), nil)
+	if err != nil || output.Sandbox != sandboxLandlock {
+		t.Fatalf("expected opted-in fallback to run under landlock, got %q (%v)", output.Sandbox, err)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+func applySandbox(execCommand *exec.Cmd, cwd string, mode string, writablePaths []string, deniedPaths []string) (string, error) {
+	return "", fmt.Errorf("%s sandbox unavailable: requires Linux", mode)
+}
+
+// pathWritable is only consulted for sandbox violations, which need Linux.
+func pathWritable(path string) bool {
+	return false
+}
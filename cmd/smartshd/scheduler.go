@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+type jobPriority int
+
+const (
+	priorityBackground jobPriority = iota
+	priorityNormal
+	priorityInteractive
+)
+
+func (priority jobPriority) String() string {
+	switch priority {
+	case priorityInteractive:
+		return "interactive"
+	case priorityBackground:
+		return "background"
+	default:
+		return "normal"
+	}
+}
+
+// parseJobPriority maps a request priority class to its scheduling rank.
+// An empty value falls back to the given default.
+func parseJobPriority(value string, fallback jobPriority) (jobPriority, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "":
+		return fallback, nil
+	case "interactive":
+		return priorityInteractive, nil
+	case "normal":
+		return priorityNormal, nil
+	case "background":
+		return priorityBackground, nil
+	default:
+		return fallback, fmt.Errorf("invalid priority %q (expected interactive|normal|background)", value)
+	}
+}
+
+type schedulerTicket struct {
+	id         string
+	workspace  string
+	priority   jobPriority
+	enqueuedAt time.Time
+	startedAt  time.Time
+	ready      chan struct{}
+	granted    bool
+	released   bool
+}
+
+// jobScheduler bounds how many commands run at once, globally and per
+// workspace. Waiting tickets are served by priority class, FIFO within a class;
+// a ticket whose workspace is saturated does not hold up other workspaces.
+type jobScheduler struct {
+	mu                 sync.Mutex
+	maxConcurrent      int
+	maxPerWorkspace    int
+	waiting            []*schedulerTicket
+	running            int
+	runningByWorkspace map[string]int
+	averageRunMS       float64
+}
+
+func newJobScheduler(maxConcurrent int, maxPerWorkspace int) *jobScheduler {
+	return &jobScheduler{
+		maxConcurrent:      max(1, maxConcurrent),
+		maxPerWorkspace:    max(1, maxPerWorkspace),
+		runningByWorkspace: map[string]int{},
+	}
+}
+
+func newJobSchedulerFromEnv() *jobScheduler {
+	return newJobScheduler(
+		parsePositiveIntEnv("SMARTSH_MAX_CONCURRENT_JOBS", max(2, runtime.NumCPU()/2)),
+		parsePositiveIntEnv("SMARTSH_MAX_JOBS_PER_WORKSPACE", 2),
+	)
+}
+
+func (scheduler *jobScheduler) enqueue(id string, workspace string, priority jobPriority) *schedulerTicket {
+	ticket := &schedulerTicket{
+		id:         id,
+		workspace:  workspace,
+		priority:   priority,
+		enqueuedAt: time.Now(),
+		ready:      make(chan struct{}),
+	}
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	insertAt := len(scheduler.waiting)
+	for index, waiting := range scheduler.waiting {
+		if waiting.priority < priority {
+			insertAt = index
+			break
+		}
+	}
+	scheduler.waiting = append(scheduler.waiting, nil)
+	copy(scheduler.waiting[insertAt+1:], scheduler.waiting[insertAt:])
+	scheduler.waiting[insertAt] = ticket
+	scheduler.dispatchLocked()
+	return ticket
+}
+
+// wait blocks until the ticket is granted a slot or ctx ends. A ticket that
+// is abandoned while waiting is removed from the queue.
+func (scheduler *jobScheduler) wait(ctx context.Context, ticket *schedulerTicket) error {
+	select {
+	case <-ticket.ready:
+		return nil
+	case <-ctx.Done():
+	}
+	scheduler.mu.Lock()
+	granted := ticket.granted
+	if !granted {
+		scheduler.removeWaitingLocked(ticket)
+	}
+	scheduler.mu.Unlock()
+	if granted {
+		scheduler.release(ticket)
+	}
+	return context.Cause(ctx)
+}
+
+func (scheduler *jobScheduler) release(ticket *schedulerTicket) {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	if !ticket.granted || ticket.released {
+		return
+	}
+	ticket.released = true
+	scheduler.running--
+	scheduler.runningByWorkspace[ticket.workspace]--
+	if scheduler.runningByWorkspace[ticket.workspace] <= 0 {
+		delete(scheduler.runningByWorkspace, ticket.workspace)
+	}
+	elapsedMS := float64(time.Since(ticket.startedAt).Milliseconds())
+	if scheduler.averageRunMS == 0 {
+		scheduler.averageRunMS = elapsedMS
+	} else {
+		scheduler.averageRunMS = 0.7*scheduler.averageRunMS + 0.3*elapsedMS
+	}
+	scheduler.dispatchLocked()
+}
+
+// position returns the 1-based queue position of a waiting ticket and a rough
+// wait estimate based on recent run durations.
+func (scheduler *jobScheduler) position(id string) (int, int64, bool) {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	for index, ticket := range scheduler.waiting {
+		if ticket.id == id {
+			position := index + 1
+			rounds := (position-1)/scheduler.maxConcurrent + 1
+			return position, int64(scheduler.averageRunMS) * int64(rounds), true
+		}
+	}
+	return 0, 0, false
+}
+
+func (scheduler *jobScheduler) dispatchLocked() {
+	for index := 0; index < len(scheduler.waiting) && scheduler.running < scheduler.maxConcurrent; {
+		ticket := scheduler.waiting[index]
+		if scheduler.runningByWorkspace[ticket.workspace] >= scheduler.maxPerWorkspace {
+			index++
+			continue
+		}
+		scheduler.waiting = append(scheduler.waiting[:index], scheduler.waiting[index+1:]...)
+		scheduler.running++
+		scheduler.runningByWorkspace[ticket.workspace]++
+		ticket.granted = true
+		ticket.startedAt = time.Now()
+		close(ticket.ready)
+	}
+}
+
+func (scheduler *jobScheduler) removeWaitingLocked(ticket *schedulerTicket) {
+	for index, waiting := range scheduler.waiting {
+		if waiting == ticket {
+			scheduler.waiting = append(scheduler.waiting[:index], scheduler.waiting[index+1:]...)
+			return
+		}
+	}
+}
+
+func (scheduler *jobScheduler) renderPrometheus() string {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	depthByPriority := map[jobPriority]int{}
+	for _, ticket := range scheduler.waiting {
+		depthByPriority[ticket.priority]++
+	}
+	lines := []string{
+		"# TYPE smartsh_queue_depth gauge",
+		fmt.Sprintf("smartsh_queue_depth %d", len(scheduler.waiting)),
+		"# TYPE smartsh_jobs_running gauge",
+		fmt.Sprintf("smartsh_jobs_running %d", scheduler.running),
+		"# TYPE smartsh_jobs_max_concurrent gauge",
+		fmt.Sprintf("smartsh_jobs_max_concurrent %d", scheduler.maxConcurrent),
+		"# TYPE smartsh_queue_depth_by_priority gauge",
+	}
+	for _, priority := range []jobPriority{priorityInteractive, priorityNormal, priorityBackground} {
+		lines = append(lines, fmt.Sprintf(`smartsh_queue_depth_by_priority{priority="%s"} %d`, priority, depthByPriority[priority]))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// resolveWorkspaceKey groups commands by the enclosing git work tree, or by
+// the cwd itself outside of one, for per-workspace concurrency limits.
+func resolveWorkspaceKey(cwd string) string {
+	resolved, err := resolveWorkingDirectory(cwd)
+	if err != nil {
+		return strings.TrimSpace(cwd)
+	}
+	current := resolved
+	for {
+		if _, statErr := os.Stat(filepath.Join(current, ".git")); statErr == nil {
+			return current
+		}
+		parent := filepath.Dir(current)
+		if parent == current {
+			return resolved
+		}
+		current = parent
+	}
+}
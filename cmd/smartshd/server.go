@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -27,28 +26,44 @@ const (
 )
 
 type daemonServer struct {
-	cwdMutex         sync.Mutex
-	store            *jobStore
-	httpClient       *http.Client
-	metrics          *metricsRegistry
-	authDisabled     bool
-	daemonToken      string
-	subscribersMutex sync.Mutex
-	subscribers      map[string]map[chan runResponse]struct{}
-	ptySessionsMutex sync.Mutex
-	ptySessions      map[string]*ptySession
+	cwdMutex           sync.Mutex
+	store              *jobStore
+	httpClient         *http.Client
+	metrics            *metricsRegistry
+	scheduler          *jobScheduler
+	authDisabled       bool
+	daemonToken        string
+	subscribersMutex   sync.Mutex
+	subscribers        map[string]map[chan jobEvent]struct{}
+	ptySessionsMutex   sync.Mutex
+	ptySessions        map[string]*ptySession
+	jobCancelsMutex    sync.Mutex
+	jobCancels         map[string]context.CancelCauseFunc
+	shellSessionsMutex sync.Mutex
+	shellSessions      map[string]*shellSession
+	watchesMutex       sync.Mutex
+	watches            map[string]*watchSession
+	servicesMutex      sync.Mutex
+	services           map[string]*managedService
 }
 
+var errJobCancelled = errors.New("job cancelled by request")
+
 func newDaemonServer(store *jobStore) *daemonServer {
 	authDisabled, daemonToken := resolveDaemonAuthConfig()
 	return &daemonServer{
-		store:        store,
-		httpClient:   &http.Client{Timeout: 25 * time.Second},
-		metrics:      newMetricsRegistry(),
-		authDisabled: authDisabled,
-		daemonToken:  daemonToken,
-		subscribers:  map[string]map[chan runResponse]struct{}{},
-		ptySessions:  map[string]*ptySession{},
+		store:         store,
+		httpClient:    &http.Client{Timeout: 25 * time.Second},
+		metrics:       newMetricsRegistry(),
+		scheduler:     newJobSchedulerFromEnv(),
+		authDisabled:  authDisabled,
+		daemonToken:   daemonToken,
+		subscribers:   map[string]map[chan jobEvent]struct{}{},
+		ptySessions:   map[string]*ptySession{},
+		jobCancels:    map[string]context.CancelCauseFunc{},
+		shellSessions: map[string]*shellSession{},
+		watches:       map[string]*watchSession{},
+		services:      map[string]*managedService{},
 	}
 }
 
@@ -80,6 +95,16 @@ func (server *daemonServer) handleRun(writer http.ResponseWriter, request *http.
 		return
 	}
 
+	defaultPriority := priorityInteractive
+	if runRequestPayload.Async {
+		defaultPriority = priorityNormal
+	}
+	priority, priorityError := parseJobPriority(runRequestPayload.Priority, defaultPriority)
+	if priorityError != nil {
+		writeJSON(writer, http.StatusBadRequest, runResponse{MustUseSmartsh: true, Executed: false, ExitCode: 1, Error: priorityError.Error()})
+		return
+	}
+
 	if runRequestPayload.Async {
 		job := daemonJob{
 			ID:        fmt.Sprintf("job_%d", time.Now().UnixNano()),
@@ -96,13 +121,29 @@ func (server *daemonServer) handleRun(writer http.ResponseWriter, request *http.
 			},
 		}
 		job.Result.JobID = job.ID
+		jobContext := server.trackJob(job.ID)
+		ticket := server.scheduler.enqueue(job.ID, resolveWorkspaceKey(runRequestPayload.Cwd), priority)
+		server.applyQueuePosition(&job.Result)
 		_ = server.store.Save(job)
-		go server.executeJob(job.ID)
+		go server.executeJob(jobContext, job.ID, ticket)
 		writeJSON(writer, http.StatusAccepted, job.Result)
 		return
 	}
 
-	runResponsePayload := server.executeRequest(request.Context(), runRequestPayload, "")
+	// Validate first so that dry runs and blocked or approval-pending commands
+	// answer right away instead of waiting for a slot they would not use.
+	preflightRequest := runRequestPayload
+	preflightRequest.DryRun = true
+	runResponsePayload := server.executeRequest(request.Context(), preflightRequest, "")
+	if !runRequestPayload.DryRun && runResponsePayload.Status == "completed" {
+		ticket := server.scheduler.enqueue(fmt.Sprintf("run_%d", time.Now().UnixNano()), resolveWorkspaceKey(runRequestPayload.Cwd), priority)
+		if waitError := server.scheduler.wait(request.Context(), ticket); waitError != nil {
+			writeJSON(writer, http.StatusServiceUnavailable, runResponse{MustUseSmartsh: true, Executed: false, ExitCode: 1, Error: fmt.Sprintf("run abandoned while queued: %v", waitError)})
+			return
+		}
+		defer server.scheduler.release(ticket)
+		runResponsePayload = server.executeRequest(request.Context(), runRequestPayload, "")
+	}
 	server.metrics.recordRun(runResponsePayload)
 	// Command failures are valid run results and should not be mapped to HTTP errors.
 	// Keep transport-level errors (auth/validation/method) on non-2xx responses.
@@ -149,6 +190,24 @@ func (server *daemonServer) handleJobRoutes(writer http.ResponseWriter, request
 		server.handleJobStream(writer, request, jobID)
 		return
 	}
+	if strings.HasSuffix(path, "/output") {
+		jobID := strings.TrimSuffix(path, "/output")
+		jobID = strings.TrimSuffix(jobID, "/")
+		server.handleJobOutput(writer, request, jobID)
+		return
+	}
+	if strings.HasSuffix(path, "/chunks") {
+		jobID := strings.TrimSuffix(path, "/chunks")
+		jobID = strings.TrimSuffix(jobID, "/")
+		server.handleJobChunks(writer, request, jobID)
+		return
+	}
+	if strings.HasSuffix(path, "/cancel") {
+		jobID := strings.TrimSuffix(path, "/cancel")
+		jobID = strings.TrimSuffix(jobID, "/")
+		server.handleJobCancel(writer, request, jobID)
+		return
+	}
 	server.handleJobByID(writer, request, path)
 }
 
@@ -245,22 +304,37 @@ func (server *daemonServer) handleApprovalRoutes(writer http.ResponseWriter, req
 		approval.UpdatedAt = time.Now()
 		_ = server.store.SaveApproval(*approval)
 		if approval.JobID != "" {
-			running := runResponse{
+			priority, _ := parseJobPriority(approval.Request.Priority, priorityNormal)
+			jobContext := server.trackJob(approval.JobID)
+			ticket := server.scheduler.enqueue(approval.JobID, resolveWorkspaceKey(approval.Request.Cwd), priority)
+			queued := runResponse{
 				MustUseSmartsh:  true,
 				JobID:           approval.JobID,
-				Status:          "running",
+				Status:          "queued",
 				Executed:        false,
 				ResolvedCommand: approval.ResolvedCommand,
 				ExitCode:        0,
-				Summary:         "approval accepted; executing command",
+				Summary:         "approval accepted; waiting to execute command",
 				ApprovalID:      approval.ID,
 			}
-			server.updateJobWithApprovalResult(approval.JobID, running)
-			go server.executeApprovedJob(*approval)
-			writeJSON(writer, http.StatusAccepted, running)
+			server.applyQueuePosition(&queued)
+			server.updateJobWithApprovalResult(approval.JobID, queued)
+			go server.executeApprovedJob(jobContext, *approval, ticket)
+			writeJSON(writer, http.StatusAccepted, queued)
 			return
 		}
 
+		priority, _ := parseJobPriority(approval.Request.Priority, priorityInteractive)
+		ticket := server.scheduler.enqueue(approval.ID, resolveWorkspaceKey(approval.Request.Cwd), priority)
+		if waitError := server.scheduler.wait(request.Context(), ticket); waitError != nil {
+			// Nothing ran, so the approval can still be decided again.
+			approval.Status = "pending"
+			approval.UpdatedAt = time.Now()
+			_ = server.store.SaveApproval(*approval)
+			writeJSON(writer, http.StatusServiceUnavailable, runResponse{MustUseSmartsh: true, Executed: false, ExitCode: 1, ApprovalID: approval.ID, Error: fmt.Sprintf("run abandoned while queued: %v", waitError)})
+			return
+		}
+		defer server.scheduler.release(ticket)
 		result := server.executeApprovalNow(request.Context(), *approval)
 		writeJSON(writer, http.StatusOK, result)
 	default:
@@ -282,9 +356,50 @@ func (server *daemonServer) handleJobByID(writer http.ResponseWriter, request *h
 		writeJSON(writer, http.StatusNotFound, runResponse{MustUseSmartsh: true, Executed: false, ExitCode: 1, Error: "job not found"})
 		return
 	}
+	if job.Result.Status == "queued" {
+		server.applyQueuePosition(&job.Result)
+	}
 	writeJSON(writer, http.StatusOK, job.Result)
 }
 
+// handleJobChunks returns the job's captured output as timestamped stdout and
+// stderr chunks. They are kept out of the job list, which would otherwise
+// carry up to the full capture of every job.
+func (server *daemonServer) handleJobChunks(writer http.ResponseWriter, request *http.Request, jobID string) {
+	if request.Method != http.MethodGet {
+		writeJSON(writer, http.StatusMethodNotAllowed, runResponse{MustUseSmartsh: true, Executed: false, ExitCode: 1, Error: "method not allowed"})
+		return
+	}
+	job, err := server.store.Get(jobID)
+	if err != nil {
+		writeJSON(writer, http.StatusInternalServerError, runResponse{MustUseSmartsh: true, Executed: false, ExitCode: 1, Error: err.Error()})
+		return
+	}
+	if job == nil {
+		writeJSON(writer, http.StatusNotFound, runResponse{MustUseSmartsh: true, Executed: false, ExitCode: 1, Error: "job not found"})
+		return
+	}
+	chunks, err := server.store.GetOutputChunks(jobID)
+	if err != nil {
+		writeJSON(writer, http.StatusInternalServerError, runResponse{MustUseSmartsh: true, Executed: false, ExitCode: 1, Error: err.Error()})
+		return
+	}
+	if chunks == nil {
+		chunks = []outputChunk{}
+	}
+	writeJSON(writer, http.StatusOK, map[string]any{"must_use_smartsh": true, "job_id": jobID, "chunks": chunks})
+}
+
+// applyQueuePosition fills in the live queue position of a waiting job.
+func (server *daemonServer) applyQueuePosition(response *runResponse) {
+	position, estimatedWaitMS, queued := server.scheduler.position(response.JobID)
+	if !queued {
+		return
+	}
+	response.QueuePosition = position
+	response.EstimatedWaitMS = estimatedWaitMS
+}
+
 func (server *daemonServer) handleJobStream(writer http.ResponseWriter, request *http.Request, jobID string) {
 	if request.Method != http.MethodGet {
 		writeJSON(writer, http.StatusMethodNotAllowed, runResponse{MustUseSmartsh: true, Executed: false, ExitCode: 1, Error: "method not allowed"})
@@ -311,7 +426,7 @@ func (server *daemonServer) handleJobStream(writer http.ResponseWriter, request
 		return
 	}
 
-	channel := make(chan runResponse, 8)
+	channel := make(chan jobEvent, 64)
 	server.subscribe(jobID, channel)
 	defer server.unsubscribe(jobID, channel)
 
@@ -321,10 +436,15 @@ func (server *daemonServer) handleJobStream(writer http.ResponseWriter, request
 		select {
 		case <-request.Context().Done():
 			return
-		case response := <-channel:
-			sendSSE(writer, "status", response)
+		case event := <-channel:
+			if event.Output != nil {
+				sendSSE(writer, "output", event.Output)
+				flusher.Flush()
+				continue
+			}
+			sendSSE(writer, "status", event.Status)
 			flusher.Flush()
-			if isTerminalStatus(response.Status) {
+			if isTerminalStatus(event.Status.Status) {
 				return
 			}
 		case <-heartbeat.C:
@@ -340,19 +460,90 @@ func (server *daemonServer) handleJobStream(writer http.ResponseWriter, request
 	}
 }
 
-func (server *daemonServer) executeJob(jobID string) {
-	job, err := server.store.Get(jobID)
-	if err != nil || job == nil {
+func (server *daemonServer) handleJobCancel(writer http.ResponseWriter, request *http.Request, jobID string) {
+	if request.Method != http.MethodPost {
+		writeJSON(writer, http.StatusMethodNotAllowed, runResponse{MustUseSmartsh: true, Executed: false, ExitCode: 1, Error: "method not allowed"})
+		return
+	}
+	// The status check and the cancellation are one transaction, so a job
+	// that finishes meanwhile is not overwritten as cancelled.
+	job, cancelled, err := server.store.Update(jobID, func(job *daemonJob) bool {
+		// needs_approval is terminal for pollers but the job can still be withdrawn.
+		if isTerminalStatus(job.Result.Status) && job.Result.Status != "needs_approval" {
+			return false
+		}
+		result := cancelledResponse(job.ID, job.Result.ResolvedCommand)
+		result.ApprovalID = job.Result.ApprovalID
+		job.Result = result
+		job.UpdatedAt = time.Now()
+		return true
+	})
+	if err != nil {
+		writeJSON(writer, http.StatusInternalServerError, runResponse{MustUseSmartsh: true, Executed: false, ExitCode: 1, Error: err.Error()})
+		return
+	}
+	if job == nil {
+		writeJSON(writer, http.StatusNotFound, runResponse{MustUseSmartsh: true, Executed: false, ExitCode: 1, Error: "job not found"})
+		return
+	}
+	if !cancelled {
+		writeJSON(writer, http.StatusConflict, runResponse{
+			MustUseSmartsh: true,
+			JobID:          job.ID,
+			Status:         job.Result.Status,
+			Executed:       job.Result.Executed,
+			ExitCode:       job.Result.ExitCode,
+			Error:          fmt.Sprintf("job is already %s", job.Result.Status),
+		})
+		return
+	}
+
+	signalled := server.cancelTrackedJob(job.ID)
+	if job.Result.ApprovalID != "" {
+		approval, approvalError := server.store.GetApproval(job.Result.ApprovalID)
+		if approvalError == nil && approval != nil && approval.Status == "pending" {
+			approval.Status = "cancelled"
+			approval.UpdatedAt = time.Now()
+			_ = server.store.SaveApproval(*approval)
+		}
+	}
+
+	result := job.Result
+	server.publish(job.ID, result)
+	if !signalled {
+		// Running jobs record their own status once the process has exited.
+		server.metrics.recordJobStatus(result.Status)
+	}
+	writeJSON(writer, http.StatusOK, result)
+}
+
+func (server *daemonServer) executeJob(ctx context.Context, jobID string, ticket *schedulerTicket) {
+	defer server.releaseJob(jobID)
+	if waitError := server.scheduler.wait(ctx, ticket); waitError != nil {
+		// Only a cancel request ends the context of a queued job.
+		server.metrics.recordJobStatus("cancelled")
+		return
+	}
+	defer server.scheduler.release(ticket)
+	job, started, err := server.store.Update(jobID, func(job *daemonJob) bool {
+		if ctx.Err() != nil || job.Result.Status == "cancelled" {
+			return false
+		}
+		job.Result.Status = "running"
+		job.Result.Summary = "job running"
+		job.UpdatedAt = time.Now()
+		return true
+	})
+	if err != nil || job == nil || !started {
 		return
 	}
-	job.Result.Status = "running"
-	job.Result.Summary = "job running"
-	job.UpdatedAt = time.Now()
-	_ = server.store.Save(*job)
 	server.publish(job.ID, job.Result)
 
-	result := server.executeRequest(context.Background(), job.Request, job.ID)
+	result := server.executeRequest(ctx, job.Request, job.ID)
 	result.JobID = job.ID
+	if isJobCancelled(ctx) {
+		result = cancelledRunResult(job.ID, result)
+	}
 	if result.Status == "" {
 		if result.Error != "" && result.ExitCode != 0 {
 			result.Status = "failed"
@@ -360,9 +551,17 @@ func (server *daemonServer) executeJob(jobID string) {
 			result.Status = "completed"
 		}
 	}
-	job.Result = result
-	job.UpdatedAt = time.Now()
-	_ = server.store.Save(*job)
+	// A cancel request that was accepted before the run finished wins, even if
+	// the process exited before it was signalled.
+	_, _, _ = server.store.Update(job.ID, func(stored *daemonJob) bool {
+		if stored.Result.Status == "cancelled" && result.Status != "cancelled" {
+			result = cancelledRunResult(job.ID, result)
+		}
+		stored.Result = result
+		stored.OutputChunks = result.outputChunks
+		stored.UpdatedAt = time.Now()
+		return true
+	})
 	server.publish(job.ID, result)
 	server.metrics.recordRun(result)
 	server.metrics.recordJobStatus(result.Status)
@@ -370,6 +569,26 @@ func (server *daemonServer) executeJob(jobID string) {
 
 func (server *daemonServer) executeRequest(ctx context.Context, runRequestPayload runRequest, jobID string) runResponse {
 	startedAt := time.Now()
+	var session *shellSession
+	if sessionID := strings.TrimSpace(runRequestPayload.SessionID); sessionID != "" {
+		acquired, release, sessionError := server.acquireShellSession(ctx, sessionID)
+		if sessionError != nil {
+			return runResponse{MustUseSmartsh: true, Status: "failed", Executed: false, ExitCode: 1, Error: sessionError.Error()}
+		}
+		defer release()
+		session = acquired
+		if strings.TrimSpace(runRequestPayload.Cwd) == "" {
+			runRequestPayload.Cwd = session.cwd()
+		}
+	}
+	trustedTask := false
+	if strings.TrimSpace(runRequestPayload.Task) != "" {
+		resolvedRequest, trusted, taskError := resolveTaskRequest(runRequestPayload)
+		if taskError != nil {
+			return runResponse{MustUseSmartsh: true, Status: "failed", Executed: false, ExitCode: 1, Task: runRequestPayload.Task, Error: taskError.Error()}
+		}
+		runRequestPayload, trustedTask = resolvedRequest, trusted
+	}
 	cwd, cwdError := resolveWorkingDirectory(runRequestPayload.Cwd)
 	if cwdError != nil {
 		return runResponse{MustUseSmartsh: true, Status: "failed", Executed: false, ExitCode: 1, Error: cwdError.Error()}
@@ -404,11 +623,44 @@ func (server *daemonServer) executeRequest(ctx context.Context, runRequestPayloa
 
 	resolvedCommand := strings.TrimSpace(runRequestPayload.Command)
 	resolvedRisk := "low"
+	argv := runRequestPayload.Argv
+	if len(argv) > 0 {
+		if resolvedCommand != "" {
+			return runResponse{MustUseSmartsh: true, Status: "failed", Executed: false, ExitCode: 1, Error: "command and argv are mutually exclusive"}
+		}
+		if strings.TrimSpace(argv[0]) == "" {
+			return runResponse{MustUseSmartsh: true, Status: "failed", Executed: false, ExitCode: 1, Error: "argv[0] must name a program"}
+		}
+		resolvedCommand = security.QuoteArgv(argv)
+	}
 	if resolvedCommand == "" {
 		return runResponse{MustUseSmartsh: true, Status: "failed", Executed: false, ExitCode: 1, Error: "command is required"}
 	}
 
-	commandAssessment, assessmentError := security.AssessCommand(resolvedCommand, strings.ToLower(resolvedRisk), runRequestPayload.Unsafe)
+	policy, policyError := loadPolicy(cwd)
+	shell := runShell{}
+	if len(argv) > 0 {
+		if strings.TrimSpace(runRequestPayload.Shell) != "" {
+			return runResponse{MustUseSmartsh: true, Status: "failed", Executed: false, ResolvedCommand: resolvedCommand, ExitCode: 1, Error: "shell does not apply to argv runs"}
+		}
+	} else {
+		resolvedShell, shellError := resolveShell(runRequestPayload.Shell, policy)
+		if shellError != nil {
+			return runResponse{MustUseSmartsh: true, Status: "failed", Executed: false, ResolvedCommand: resolvedCommand, ExitCode: 1, Error: shellError.Error()}
+		}
+		shell = resolvedShell
+		if session != nil && !sessionShellSupported(shell) {
+			return runResponse{MustUseSmartsh: true, Status: "failed", Executed: false, ResolvedCommand: resolvedCommand, ExitCode: 1, Error: "session_id needs a POSIX shell (sh, bash, zsh, dash or ksh)"}
+		}
+	}
+
+	var commandAssessment security.CommandAssessment
+	var assessmentError error
+	if len(argv) > 0 {
+		commandAssessment, assessmentError = security.AssessArgv(argv, strings.ToLower(resolvedRisk), runRequestPayload.Unsafe)
+	} else {
+		commandAssessment, assessmentError = security.AssessShellCommand(resolvedCommand, shell.program(), strings.ToLower(resolvedRisk), runRequestPayload.Unsafe)
+	}
 	if assessmentError != nil {
 		return runResponse{
 			MustUseSmartsh:  true,
@@ -425,7 +677,7 @@ func (server *daemonServer) executeRequest(ctx context.Context, runRequestPayloa
 	if resolvedRisk == "" {
 		resolvedRisk = "low"
 	}
-	if commandAssessment.RequiresRiskConfirmation && !runRequestPayload.Unsafe {
+	if commandAssessment.RequiresRiskConfirmation && !runRequestPayload.Unsafe && !trustedTask {
 		if !runRequestPayload.RequireApproval {
 			return runResponse{
 				MustUseSmartsh:  true,
@@ -478,7 +730,13 @@ func (server *daemonServer) executeRequest(ctx context.Context, runRequestPayloa
 			BlockedReason:    fmt.Sprintf("approval required: %s", commandAssessment.RiskReason),
 		}
 	}
-	if _, allowlistValidationError := security.ValidateAllowlist(resolvedCommand, commandAllowlist, parsedAllowlistMode); allowlistValidationError != nil {
+	var allowlistValidationError error
+	if len(argv) > 0 {
+		_, allowlistValidationError = security.ValidateAllowlistArgv(argv, commandAllowlist, parsedAllowlistMode)
+	} else {
+		_, allowlistValidationError = security.ValidateAllowlist(resolvedCommand, commandAllowlist, parsedAllowlistMode)
+	}
+	if allowlistValidationError != nil {
 		return runResponse{
 			MustUseSmartsh:  true,
 			Status:          "blocked",
@@ -491,7 +749,6 @@ func (server *daemonServer) executeRequest(ctx context.Context, runRequestPayloa
 		}
 	}
 
-	policy, policyError := loadPolicy(cwd)
 	if policyError != nil && (policy == nil || policy.Enforce) {
 		return runResponse{
 			MustUseSmartsh:  true,
@@ -504,7 +761,7 @@ func (server *daemonServer) executeRequest(ctx context.Context, runRequestPayloa
 			Error:           "command blocked by policy parse failure",
 		}
 	}
-	if applyError := applyPolicy(policy, cwd, resolvedCommand, resolvedRisk); applyError != nil {
+	if applyError := applyPolicy(policy, cwd, resolvedCommand, argv, resolvedRisk); applyError != nil {
 		return runResponse{
 			MustUseSmartsh:  true,
 			Status:          "blocked",
@@ -517,6 +774,18 @@ func (server *daemonServer) executeRequest(ctx context.Context, runRequestPayloa
 		}
 	}
 
+	sandboxMode, sandboxError := resolveSandboxMode(runRequestPayload.Sandbox, policy)
+	if sandboxError != nil {
+		return runResponse{MustUseSmartsh: true, Status: "failed", Executed: false, ResolvedCommand: resolvedCommand, ExitCode: 1, Error: sandboxError.Error()}
+	}
+	openExternalTerminal := runRequestPayload.OpenExternalTerminal || parseBooleanEnv("SMARTSH_OPEN_EXTERNAL_TERMINAL")
+	if sandboxMode != sandboxOff && openExternalTerminal {
+		return runResponse{MustUseSmartsh: true, Status: "failed", Executed: false, ResolvedCommand: resolvedCommand, ExitCode: 1, Error: "sandboxed commands cannot run in an external terminal"}
+	}
+	if session != nil && (openExternalTerminal || sandboxMode == sandboxStrict) {
+		return runResponse{MustUseSmartsh: true, Status: "failed", Executed: false, ResolvedCommand: resolvedCommand, ExitCode: 1, Error: "session_id cannot be combined with an external terminal or the strict sandbox"}
+	}
+
 	if runRequestPayload.DryRun {
 		return runResponse{
 			MustUseSmartsh:  true,
@@ -531,51 +800,166 @@ func (server *daemonServer) executeRequest(ctx context.Context, runRequestPayloa
 		}
 	}
 
-	executionContext := ctx
-	cancel := func() {}
-	timeoutSec := runRequestPayload.TimeoutSec
-	if timeoutSec > 0 {
-		executionContext, cancel = context.WithTimeout(ctx, time.Duration(timeoutSec)*time.Second)
-	}
-	defer cancel()
-
 	isolation := isolationOptions{
 		Isolated:      runRequestPayload.Isolated || !runRequestPayload.Unsafe,
 		MaxOutputKB:   runRequestPayload.MaxOutputKB,
+		OutputHeadKB:  runRequestPayload.OutputHeadKB,
 		MaxMemoryMB:   runRequestPayload.MaxMemoryMB,
 		MaxCPUSeconds: runRequestPayload.MaxCPUSeconds,
+		MaxCPUPercent: runRequestPayload.MaxCPUPercent,
+		MaxPids:       runRequestPayload.MaxPids,
+		Sandbox:       sandboxMode,
 		AllowedEnv:    runRequestPayload.AllowedEnv,
 		Env:           runRequestPayload.Env,
+		Stdin:         runRequestPayload.Stdin,
+		Argv:          argv,
+		Shell:         shell.Argv,
 	}
 	if isolation.MaxOutputKB <= 0 {
 		isolation.MaxOutputKB = defaultRunMaxOutputKB
 	}
+	if sandboxMode != sandboxOff {
+		isolation.WritablePaths = sandboxWritablePaths(cwd, policy)
+		isolation.DeniedPaths = sandboxDeniedPaths(policy)
+	}
 
 	env := buildEnvWithPolicy(policy, runRequestPayload)
+	if session != nil {
+		env = session.applyEnv(env, runRequestPayload.Env)
+		if len(argv) == 0 {
+			if stateFile, stateError := os.CreateTemp("", "smartsh-session-*.json"); stateError == nil {
+				_ = stateFile.Close()
+				isolation.SessionStateFile = stateFile.Name()
+				defer os.Remove(stateFile.Name())
+			}
+		}
+	}
+	cacheKey := ""
+	// A cache hit would skip the run, and with it a session's cd and exports.
+	if runRequestPayload.Cache && !openExternalTerminal && session == nil {
+		if key, keyError := computeRunCacheKey(strings.Join(append(append([]string{}, shell.Argv...), resolvedCommand), " "), cwd, env, sandboxMode, runRequestPayload.Stdin, runRequestPayload.Parser, runRequestPayload.CacheInputs); keyError == nil {
+			cacheKey = key
+			if cached, _ := server.store.GetCachedRun(cacheKey, runCacheMaxAge()); cached != nil {
+				server.metrics.recordCacheLookup(true)
+				response := cached.Response
+				response.JobID = ""
+				response.CacheHit = true
+				response.CacheAgeSec = int64(time.Since(cached.CreatedAt).Seconds())
+				response.Usage = nil
+				response.ChangedFiles = nil
+				response.ChangedOmitted = 0
+				response.Diffstat = ""
+				response.DurationMS = time.Since(startedAt).Milliseconds()
+				return response
+			}
+			server.metrics.recordCacheLookup(false)
+		}
+	}
+	var liveOutput outputSink
+	var outputLog *outputLogWriter
+	if jobID != "" {
+		jobOutput := &jobOutputWriter{server: server, jobID: jobID}
+		if createdLog, logError := server.store.CreateOutputLog(jobID); logError == nil {
+			outputLog = createdLog
+			defer outputLog.Close()
+		}
+		liveOutput = func(stream string, data []byte) {
+			jobOutput.writeStream(stream, data)
+			if outputLog != nil {
+				_, _ = outputLog.Write(data)
+			}
+		}
+	}
+	prepared := preparedCommand{
+		request:          runRequestPayload,
+		command:          resolvedCommand,
+		cwd:              cwd,
+		isolation:        isolation,
+		env:              env,
+		externalTerminal: openExternalTerminal,
+		liveOutput:       liveOutput,
+		outputLog:        outputLog,
+	}
+	snapshotBefore := captureWorkTreeSnapshot(cwd, true)
+	var response runResponse
+	if retry := normalizeRetryPolicy(runRequestPayload.Retry); retry != nil {
+		response = server.runWithRetry(ctx, prepared, *retry)
+	} else {
+		response = server.runPreparedCommand(ctx, prepared)
+	}
+	response.Shell = shell.Name
+	response.Task = runRequestPayload.Task
+	if session != nil {
+		session.record(isolation.SessionStateFile, env)
+		response.SessionID = session.ID
+		response.SessionCwd = session.cwd()
+	}
+	if snapshotBefore != nil {
+		response.ChangedFiles, response.ChangedOmitted = diffWorkTreeSnapshots(snapshotBefore, captureWorkTreeSnapshot(cwd, false))
+		response.Diffstat = summarizeChangedFiles(response.ChangedFiles, response.ChangedOmitted)
+	}
+	response.DurationMS = time.Since(startedAt).Milliseconds()
+	if cacheKey != "" && isCacheableResult(response) {
+		_ = server.store.PutCachedRun(cacheKey, response, runCacheMaxAge(), runCacheMaxBytes())
+	}
+	return response
+}
+
+// preparedCommand is a validated, approved command with its isolation settings
+// and output sinks, ready to be executed one or more times.
+type preparedCommand struct {
+	request          runRequest
+	command          string
+	cwd              string
+	isolation        isolationOptions
+	env              []string
+	externalTerminal bool
+	liveOutput       outputSink
+	outputLog        *outputLogWriter
+}
+
+// runPreparedCommand executes the command once, applying timeout_sec to this
+// execution, and summarizes the result.
+func (server *daemonServer) runPreparedCommand(ctx context.Context, prepared preparedCommand) runResponse {
+	attemptStartedAt := time.Now()
+	executionContext := ctx
+	cancel := func() {}
+	if timeoutSec := prepared.request.TimeoutSec; timeoutSec > 0 {
+		executionContext, cancel = context.WithTimeout(ctx, time.Duration(timeoutSec)*time.Second)
+	}
+	defer cancel()
+
 	exitCode := 0
-	combinedOutput := ""
+	output := commandOutput{}
 	var executionError error
-	if runRequestPayload.OpenExternalTerminal || parseBooleanEnv("SMARTSH_OPEN_EXTERNAL_TERMINAL") {
-		exitCode, combinedOutput, executionError = runCommandViaExternalTerminal(
+	if prepared.externalTerminal {
+		terminalCommand := prepared.command
+		if len(prepared.isolation.Shell) > 0 {
+			terminalCommand = security.QuoteArgv(append(append([]string{}, prepared.isolation.Shell...), prepared.command))
+		}
+		exitCode, output.Combined, executionError = runCommandViaExternalTerminal(
 			executionContext,
-			resolvedCommand,
-			cwd,
-			isolation,
-			env,
-			runRequestPayload.TerminalApp,
-			runRequestPayload.TerminalSessionKey,
+			terminalCommand,
+			prepared.cwd,
+			prepared.isolation,
+			prepared.env,
+			prepared.request.TerminalApp,
+			prepared.request.TerminalSessionKey,
 		)
+		if prepared.outputLog != nil {
+			_, _ = io.WriteString(prepared.outputLog, output.Combined)
+		}
 	} else {
-		exitCode, combinedOutput, executionError = runCommandWithCapture(executionContext, resolvedCommand, cwd, isolation, env)
+		exitCode, output, executionError = runCommandWithCapture(executionContext, prepared.command, prepared.cwd, prepared.isolation, prepared.env, prepared.liveOutput)
 	}
-	summaryResult := resolveSummary(resolvedCommand, exitCode, combinedOutput, executionError, server.httpClient)
+	summaryResult := resolveSummary(prepared.command, prepared.request.Parser, exitCode, output.Combined, output.Stderr, executionError, server.httpClient)
 	resolvedSummary := summaryResult.Summary
 
 	response := runResponse{
 		MustUseSmartsh:  true,
 		Status:          "completed",
 		Executed:        true,
-		ResolvedCommand: resolvedCommand,
+		ResolvedCommand: prepared.command,
 		ExitCode:        exitCode,
 		Summary:         resolvedSummary.Summary,
 		SummarySource:   summaryResult.Source,
@@ -585,7 +969,14 @@ func (server *daemonServer) executeRequest(ctx context.Context, runRequestPayloa
 		FailingTests:    resolvedSummary.FailingTests,
 		FailedFiles:     resolvedSummary.FailedFiles,
 		TopIssues:       resolvedSummary.TopIssues,
-		DurationMS:      time.Since(startedAt).Milliseconds(),
+		DurationMS:      time.Since(attemptStartedAt).Milliseconds(),
+		OmittedLines:    output.OmittedLines,
+		OmittedBytes:    output.OmittedBytes,
+		Signal:          output.Signal,
+		Termination:     output.Termination,
+		Cgroup:          output.Cgroup,
+		Usage:           output.Usage,
+		outputChunks:    output.Chunks,
 	}
 	if executionError != nil {
 		response.Error = executionError.Error()
@@ -594,18 +985,48 @@ func (server *daemonServer) executeRequest(ctx context.Context, runRequestPayloa
 		}
 		response.Status = "failed"
 	}
-	if response.Status == "failed" {
-		response.OutputTail = tailString(combinedOutput, failedRunOutputTailMaxSize)
+	if output.Sandbox != "" {
+		response.Sandbox = output.Sandbox
+		if output.Sandbox != prepared.isolation.Sandbox {
+			response.SandboxRequested = prepared.isolation.Sandbox
+		}
+		allowed := append(append([]string{}, prepared.isolation.WritablePaths...), sandboxTempPaths()...)
+		if violation := detectSandboxViolation(output.Stderr, allowed, prepared.isolation.DeniedPaths); response.Status == "failed" && violation != "" {
+			response.ErrorType = "sandbox"
+			response.SandboxViolation = violation
+			response.PrimaryError = fmt.Sprintf("write blocked by %s sandbox: %s", output.Sandbox, violation)
+			response.NextAction = "write inside the project or a temp dir, or add the path to allow_paths in .smartsh-policy.yaml"
+		}
+	}
+	if output.InputPrompt != "" {
+		response.Status = "waiting_for_input"
+		response.ErrorType = "input"
+		response.InputPrompt = output.InputPrompt
+		response.Summary = "command stopped while waiting for input"
+		response.PrimaryError = "waiting for input: " + output.InputPrompt
+		response.NextAction = "rerun with the answer in stdin (e.g. \"y\\n\"), or pass the tool's non-interactive flag such as --yes"
+	}
+	if response.Status == "failed" || response.Status == "waiting_for_input" {
+		response.OutputTail = tailString(output.Combined, failedRunOutputTailMaxSize)
+		response.StderrTail = tailString(output.Stderr, failedRunOutputTailMaxSize)
 	}
 	return response
 }
 
 func (server *daemonServer) executeApprovalNow(ctx context.Context, approval commandApproval) runResponse {
 	approvedRequest := approval.Request
-	approvedRequest.Command = approval.ResolvedCommand
+	// An argv approval runs the stored argv; its resolved command is only the
+	// quoted form shown to the user.
+	if len(approvedRequest.Argv) == 0 {
+		approvedRequest.Command = approval.ResolvedCommand
+	}
+	// The stored request of a task is already resolved; resolving it again
+	// would find a command next to the task name.
+	approvedRequest.Task = ""
 	approvedRequest.RequireApproval = false
 	approvedRequest.Unsafe = true
 	response := server.executeRequest(ctx, approvedRequest, approval.JobID)
+	response.Task = approval.Request.Task
 	response.ApprovalID = approval.ID
 	response.RequiresApproval = false
 
@@ -622,11 +1043,30 @@ func (server *daemonServer) executeApprovalNow(ctx context.Context, approval com
 	return response
 }
 
-func (server *daemonServer) executeApprovedJob(approval commandApproval) {
-	result := server.executeApprovalNow(context.Background(), approval)
+func (server *daemonServer) executeApprovedJob(ctx context.Context, approval commandApproval, ticket *schedulerTicket) {
+	defer server.releaseJob(approval.JobID)
+	if waitError := server.scheduler.wait(ctx, ticket); waitError != nil {
+		server.metrics.recordJobStatus("cancelled")
+		return
+	}
+	defer server.scheduler.release(ticket)
+	server.updateJobWithApprovalResult(approval.JobID, runResponse{
+		MustUseSmartsh:  true,
+		JobID:           approval.JobID,
+		Status:          "running",
+		Executed:        false,
+		ResolvedCommand: approval.ResolvedCommand,
+		ExitCode:        0,
+		Summary:         "approval accepted; executing command",
+		ApprovalID:      approval.ID,
+	})
+	result := server.executeApprovalNow(ctx, approval)
 	if result.JobID == "" {
 		result.JobID = approval.JobID
 	}
+	if isJobCancelled(ctx) {
+		result = cancelledRunResult(approval.JobID, result)
+	}
 	if result.Status == "" {
 		if result.Error != "" && result.ExitCode != 0 {
 			result.Status = "failed"
@@ -639,17 +1079,89 @@ func (server *daemonServer) executeApprovedJob(approval commandApproval) {
 	server.metrics.recordJobStatus(result.Status)
 }
 
+// trackJob registers a cancellable context for an async job so that
+// POST /jobs/{id}/cancel can stop it while it is queued or running.
+func (server *daemonServer) trackJob(jobID string) context.Context {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	server.jobCancelsMutex.Lock()
+	server.jobCancels[jobID] = cancel
+	server.jobCancelsMutex.Unlock()
+	return ctx
+}
+
+func (server *daemonServer) releaseJob(jobID string) {
+	server.jobCancelsMutex.Lock()
+	cancel, exists := server.jobCancels[jobID]
+	delete(server.jobCancels, jobID)
+	server.jobCancelsMutex.Unlock()
+	if exists {
+		cancel(nil)
+	}
+}
+
+func (server *daemonServer) cancelTrackedJob(jobID string) bool {
+	server.jobCancelsMutex.Lock()
+	cancel, exists := server.jobCancels[jobID]
+	server.jobCancelsMutex.Unlock()
+	if !exists {
+		return false
+	}
+	cancel(errJobCancelled)
+	return true
+}
+
+func isJobCancelled(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errJobCancelled)
+}
+
+func cancelledResponse(jobID string, resolvedCommand string) runResponse {
+	return runResponse{
+		MustUseSmartsh:  true,
+		JobID:           jobID,
+		Status:          "cancelled",
+		Executed:        false,
+		ResolvedCommand: resolvedCommand,
+		ExitCode:        1,
+		Summary:         "job cancelled",
+		Error:           errJobCancelled.Error(),
+		Termination:     &termination{Reason: terminationCancelled},
+	}
+}
+
+func cancelledRunResult(jobID string, result runResponse) runResponse {
+	cancelled := cancelledResponse(jobID, result.ResolvedCommand)
+	cancelled.Executed = result.Executed
+	cancelled.ApprovalID = result.ApprovalID
+	cancelled.DurationMS = result.DurationMS
+	cancelled.OutputTail = result.OutputTail
+	cancelled.StderrTail = result.StderrTail
+	cancelled.Signal = result.Signal
+	if result.Termination != nil {
+		cancelled.Termination = result.Termination
+	}
+	cancelled.outputChunks = result.outputChunks
+	return cancelled
+}
+
 func (server *daemonServer) updateJobWithApprovalResult(jobID string, result runResponse) {
 	if strings.TrimSpace(jobID) == "" {
 		return
 	}
-	job, jobError := server.store.Get(jobID)
+	job, _, jobError := server.store.Update(jobID, func(job *daemonJob) bool {
+		// A job cancelled meanwhile stays cancelled, as in executeJob.
+		if job.Result.Status == "cancelled" && result.Status != "cancelled" {
+			result = cancelledRunResult(jobID, result)
+		}
+		job.Result = result
+		if result.outputChunks != nil {
+			job.OutputChunks = result.outputChunks
+		}
+		job.UpdatedAt = time.Now()
+		return true
+	})
 	if jobError != nil || job == nil {
 		return
 	}
-	job.Result = result
-	job.UpdatedAt = time.Now()
-	_ = server.store.Save(*job)
 	server.publish(job.ID, result)
 }
 
@@ -795,49 +1307,120 @@ func (server *daemonServer) handleMetrics(writer http.ResponseWriter, request *h
 	}
 	writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
 	_, _ = writer.Write([]byte(server.metrics.renderPrometheus()))
+	_, _ = writer.Write([]byte(server.scheduler.renderPrometheus()))
 }
 
-func runCommandWithCapture(ctx context.Context, command string, cwd string, isolation isolationOptions, env []string) (int, string, error) {
+func runCommandWithCapture(ctx context.Context, command string, cwd string, isolation isolationOptions, env []string, liveOutput outputSink) (int, commandOutput, error) {
+	runContext, cancelRun := context.WithCancelCause(ctx)
+	defer cancelRun(nil)
 	var execCommand *exec.Cmd
-	finalCommand := command
-	if runtime.GOOS != "windows" && isolation.Isolated {
-		finalCommand = wrapWithULimits(command, isolation)
+	script := command
+	if isolation.SessionStateFile != "" {
+		script = wrapForShellSession(command, isolation.SessionStateFile)
 	}
-	if runtime.GOOS == "windows" {
-		execCommand = exec.CommandContext(ctx, "cmd", "/C", finalCommand)
-	} else {
-		execCommand = exec.CommandContext(ctx, "sh", "-c", finalCommand)
+	finalCommand := script
+	var jobCgroup *cgroupJob
+	if runtime.GOOS != "windows" && isolation.Isolated {
+		jobCgroup = startCgroupJob(isolation)
+		finalCommand = wrapWithULimits(script, isolation, jobCgroup != nil)
+	}
+	switch {
+	case len(isolation.Argv) > 0:
+		execCommand = argvCommand(runContext, isolation.Argv, isolation, jobCgroup != nil)
+	case len(isolation.Shell) > 0:
+		execCommand = argvCommand(runContext, append(append([]string{}, isolation.Shell...), script), isolation, jobCgroup != nil)
+	case runtime.GOOS == "windows":
+		execCommand = exec.CommandContext(runContext, "cmd", "/C", finalCommand)
+	default:
+		execCommand = exec.CommandContext(runContext, "sh", "-c", finalCommand)
 	}
 	execCommand.Dir = cwd
 	execCommand.Env = env
+	if isolation.Stdin != "" {
+		execCommand.Stdin = strings.NewReader(isolation.Stdin)
+	}
+	terminator := configureProcessTree(execCommand, killGracePeriod())
+	appliedSandbox := ""
+	if isolation.Sandbox != "" && isolation.Sandbox != sandboxOff {
+		applied, sandboxError := applySandbox(execCommand, cwd, isolation.Sandbox, isolation.WritablePaths, isolation.DeniedPaths)
+		if sandboxError != nil {
+			jobCgroup.finish()
+			return 1, commandOutput{}, sandboxError
+		}
+		appliedSandbox = applied
+	}
+	jobCgroup.attach(execCommand)
 
-	var outputBuffer bytes.Buffer
-	limitWriter := &limitedBufferWriter{
-		maxBytes: int64(max(1, isolation.MaxOutputKB) * 1024),
-		buffer:   &outputBuffer,
+	headBytes := -1
+	if isolation.OutputHeadKB > 0 {
+		headBytes = isolation.OutputHeadKB * 1024
 	}
-	execCommand.Stdout = limitWriter
-	execCommand.Stderr = limitWriter
-	outputError := execCommand.Run()
+	capture := newStreamCapture(max(1, isolation.MaxOutputKB)*1024, headBytes, liveOutput)
+	execCommand.Stdout = capture.writer(streamStdout)
+	execCommand.Stderr = capture.writer(streamStderr)
+	startedAt := time.Now()
+	outputError := execCommand.Start()
+	if outputError == nil {
+		stopInputWatch := watchForInputPrompt(execCommand.Process.Pid, capture, cancelRun)
+		outputError = waitCommand(execCommand)
+		stopInputWatch()
+	}
+	terminator.finish(execCommand)
+	cgroupUsage := jobCgroup.finish()
+	kernelSignal, signalNumber := waitStatusSignal(outputError)
+	sentSignal := terminator.sentSignal()
+	ended := describeTermination(runContext, outputError, kernelSignal, sentSignal, cgroupUsage)
 
 	exitCode := 0
 	if outputError != nil {
+		exitCode = 1
 		var exitError *exec.ExitError
-		if strings.Contains(outputError.Error(), "exit status ") && errors.As(outputError, &exitError) {
+		if errors.As(outputError, &exitError) && exitError.ExitCode() >= 0 {
 			exitCode = exitError.ExitCode()
-		} else {
-			exitCode = 1
+		} else if signalNumber > 0 {
+			// Shell convention for a child killed by a signal.
+			exitCode = 128 + signalNumber
+		} else if errors.Is(outputError, exec.ErrNotFound) {
+			// Shell convention for an argv program that is not on PATH.
+			exitCode = 127
 		}
 	}
-	return exitCode, outputBuffer.String(), outputError
+
+	inputPrompt := ""
+	var inputWait *waitingForInputError
+	switch ended.Reason {
+	case terminationTimeout:
+		if deadline, ok := ctx.Deadline(); ok {
+			ended.TimeoutSec = int(deadline.Sub(startedAt).Round(time.Second).Seconds())
+		}
+		outputError = &terminationError{termination: ended, err: outputError}
+	case terminationOOM, terminationSignaled:
+		outputError = &terminationError{termination: ended, err: outputError}
+	case terminationCancelled:
+		if errors.As(context.Cause(runContext), &inputWait) && ctx.Err() == nil {
+			inputPrompt = inputWait.Prompt
+			outputError = inputWait
+		}
+	}
+	output := capture.result()
+	output.Usage = collectResourceUsage(execCommand.ProcessState, time.Since(startedAt), output.OutputBytes)
+	output.Signal = firstNonEmpty(kernelSignal, sentSignal)
+	output.Termination = &ended
+	output.Cgroup = cgroupUsage
+	output.Sandbox = appliedSandbox
+	output.InputPrompt = inputPrompt
+	return exitCode, output, outputError
 }
 
-func wrapWithULimits(command string, isolation isolationOptions) string {
+// wrapWithULimits prefixes the per-process ulimits. When the command runs in
+// a cgroup, memory is bounded by memory.max instead: ulimit -v caps virtual
+// address space, which breaks Go and Node binaries.
+func wrapWithULimits(command string, isolation isolationOptions, inCgroup bool) string {
 	limits := make([]string, 0, 2)
 	if isolation.MaxCPUSeconds > 0 {
 		limits = append(limits, fmt.Sprintf("ulimit -t %d", isolation.MaxCPUSeconds))
 	}
-	if isolation.MaxMemoryMB > 0 {
+	if isolation.MaxMemoryMB > 0 && !inCgroup {
 		limits = append(limits, fmt.Sprintf("ulimit -v %d", isolation.MaxMemoryMB*1024))
 	}
 	if len(limits) == 0 {
@@ -846,10 +1429,32 @@ func wrapWithULimits(command string, isolation isolationOptions) string {
 	return strings.Join(limits, "; ") + "; " + command
 }
 
+// argvCommand execs argv without an intermediate shell. Only when ulimits
+// must be applied does a fixed sh script set them and exec the argv, which it
+// passes through as positional parameters and never parses.
+func argvCommand(ctx context.Context, argv []string, isolation isolationOptions, inCgroup bool) *exec.Cmd {
+	const execArgs = `exec "$@"`
+	if runtime.GOOS != "windows" && isolation.Isolated {
+		if script := wrapWithULimits(execArgs, isolation, inCgroup); script != execArgs {
+			return exec.CommandContext(ctx, "sh", append([]string{"-c", script, "sh"}, argv...)...)
+		}
+	}
+	return exec.CommandContext(ctx, argv[0], argv[1:]...)
+}
+
 func classifyErrorType(command string, output string, runError error, exitCode int) string {
 	if exitCode == 0 && runError == nil {
 		return "none"
 	}
+	var terminated *terminationError
+	if errors.As(runError, &terminated) {
+		switch terminated.termination.Reason {
+		case terminationTimeout, terminationOOM:
+			return terminated.termination.Reason
+		case terminationSignaled:
+			return "runtime"
+		}
+	}
 	combined := strings.ToLower(command + "\n" + output)
 	compileTokens := []string{"failed to compile", "compilation failed", "syntax error", "error ts", "javac", "cannot find symbol", "build failed", "compile"}
 	testTokens := []string{"test failed", "failing", "assert", "expected", "jest", "vitest", "pytest", "go test", "dotnet test", "--- fail"}
@@ -922,41 +1527,6 @@ func tailString(text string, maxLength int) string {
 	return text[len(text)-maxLength:]
 }
 
-type limitedBufferWriter struct {
-	maxBytes  int64
-	buffer    *bytes.Buffer
-	written   int64
-	truncated bool
-}
-
-func (writer *limitedBufferWriter) Write(data []byte) (int, error) {
-	totalLen := len(data)
-	if writer.maxBytes <= 0 {
-		return totalLen, nil
-	}
-	remaining := writer.maxBytes - writer.written
-	if remaining <= 0 {
-		if !writer.truncated {
-			writer.buffer.WriteString("\n[smartshd output truncated]\n")
-			writer.truncated = true
-		}
-		return totalLen, nil
-	}
-	writeLen := len(data)
-	if int64(writeLen) > remaining {
-		writeLen = int(remaining)
-	}
-	if writeLen > 0 {
-		_, _ = writer.buffer.Write(data[:writeLen])
-		writer.written += int64(writeLen)
-	}
-	if writeLen < totalLen && !writer.truncated {
-		writer.buffer.WriteString("\n[smartshd output truncated]\n")
-		writer.truncated = true
-	}
-	return totalLen, nil
-}
-
 func (server *daemonServer) authorize(request *http.Request) bool {
 	if server.authDisabled {
 		return true
@@ -989,16 +1559,16 @@ func resolveDaemonAuthConfig() (bool, string) {
 	return authDisabled, daemonToken
 }
 
-func (server *daemonServer) subscribe(jobID string, channel chan runResponse) {
+func (server *daemonServer) subscribe(jobID string, channel chan jobEvent) {
 	server.subscribersMutex.Lock()
 	defer server.subscribersMutex.Unlock()
 	if _, exists := server.subscribers[jobID]; !exists {
-		server.subscribers[jobID] = map[chan runResponse]struct{}{}
+		server.subscribers[jobID] = map[chan jobEvent]struct{}{}
 	}
 	server.subscribers[jobID][channel] = struct{}{}
 }
 
-func (server *daemonServer) unsubscribe(jobID string, channel chan runResponse) {
+func (server *daemonServer) unsubscribe(jobID string, channel chan jobEvent) {
 	server.subscribersMutex.Lock()
 	defer server.subscribersMutex.Unlock()
 	if existing, exists := server.subscribers[jobID]; exists {
@@ -1011,19 +1581,59 @@ func (server *daemonServer) unsubscribe(jobID string, channel chan runResponse)
 }
 
 func (server *daemonServer) publish(jobID string, response runResponse) {
+	server.broadcast(jobID, jobEvent{Status: response})
+}
+
+func (server *daemonServer) publishOutput(jobID string, chunk jobOutputChunk) {
+	server.broadcast(jobID, jobEvent{Output: &chunk})
+}
+
+// broadcast queues an event for every subscriber of a job without blocking.
+// Output events are dropped for subscribers that fall behind (the sequence
+// numbers show the gap), but a status event always gets through: it evicts
+// the oldest queued events until it fits, since a newer status supersedes
+// whatever is ahead of it.
+func (server *daemonServer) broadcast(jobID string, event jobEvent) {
 	server.subscribersMutex.Lock()
 	defer server.subscribersMutex.Unlock()
 	for channel := range server.subscribers[jobID] {
-		select {
-		case channel <- response:
-		default:
+		for {
+			select {
+			case channel <- event:
+			default:
+				if event.Output == nil {
+					select {
+					case <-channel:
+					default:
+					}
+					continue
+				}
+			}
+			break
 		}
 	}
 }
 
+// jobOutputWriter forwards live command output to SSE subscribers of a job.
+// Chunks carry a per-job sequence number so clients can detect dropped events.
+type jobOutputWriter struct {
+	server *daemonServer
+	jobID  string
+	mu     sync.Mutex
+	seq    int64
+}
+
+func (writer *jobOutputWriter) writeStream(stream string, data []byte) {
+	writer.mu.Lock()
+	writer.seq++
+	chunk := jobOutputChunk{JobID: writer.jobID, Seq: writer.seq, Stream: stream, Data: string(data)}
+	writer.mu.Unlock()
+	writer.server.publishOutput(writer.jobID, chunk)
+}
+
 func isTerminalStatus(status string) bool {
 	switch status {
-	case "completed", "failed", "blocked", "needs_approval":
+	case "completed", "failed", "blocked", "needs_approval", "cancelled", "interrupted", "waiting_for_input":
 		return true
 	default:
 		return false
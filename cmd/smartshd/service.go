@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultServiceReadyTimeoutSec = 60
+	serviceProbeInterval          = 200 * time.Millisecond
+	serviceOutputTailSize         = 4000
+	defaultMaxServices            = 16
+)
+
+var serviceURLPattern = regexp.MustCompile(`https?://[^\s"'<>]+`)
+
+type serviceRequest struct {
+	Name            string            `json:"name,omitempty"`
+	Command         string            `json:"command"`
+	Shell           string            `json:"shell,omitempty"`
+	Cwd             string            `json:"cwd,omitempty"`
+	Env             map[string]string `json:"env,omitempty"`
+	AllowedEnv      []string          `json:"allowed_env,omitempty"`
+	Unsafe          bool              `json:"unsafe,omitempty"`
+	AllowlistMode   string            `json:"allowlist_mode,omitempty"`
+	AllowlistFile   string            `json:"allowlist_file,omitempty"`
+	Sandbox         string            `json:"sandbox,omitempty"`
+	Ready           *readinessProbe   `json:"ready,omitempty"`
+	ReadyTimeoutSec int               `json:"ready_timeout_sec,omitempty"`
+}
+
+// readinessProbe decides when a service is up. Exactly one field is expected;
+// TCP takes "host:port" or a bare port.
+type readinessProbe struct {
+	TCP      string `json:"tcp,omitempty"`
+	HTTP     string `json:"http,omitempty"`
+	LogRegex string `json:"log_regex,omitempty"`
+}
+
+// managedService is a long-running command supervised by the daemon. Its
+// output is appended to an output log named after the service ID, so it can
+// be paged like job output and survives restarts.
+type managedService struct {
+	ID        string
+	Request   serviceRequest
+	Command   string
+	Cwd       string
+	Status    string
+	Ready     bool
+	URL       string
+	PID       int
+	ExitCode  int
+	Restarts  int
+	Error     string
+	StartedAt time.Time
+	UpdatedAt time.Time
+
+	env          []string
+	shell        []string
+	sandbox      string
+	writable     []string
+	denied       []string
+	readyPattern *regexp.Regexp
+	outputTail   string
+	pending      []byte
+	cancel       context.CancelFunc
+	done         chan struct{}
+	readyCh      chan struct{}
+	log          *outputLogWriter
+	mu           sync.Mutex
+}
+
+type serviceStatus struct {
+	MustUseSmartsh bool      `json:"must_use_smartsh"`
+	ServiceID      string    `json:"service_id,omitempty"`
+	Name           string    `json:"name,omitempty"`
+	Status         string    `json:"status,omitempty"`
+	Ready          bool      `json:"ready"`
+	URL            string    `json:"url,omitempty"`
+	PID            int       `json:"pid,omitempty"`
+	Command        string    `json:"command,omitempty"`
+	Cwd            string    `json:"cwd,omitempty"`
+	ExitCode       int       `json:"exit_code,omitempty"`
+	Restarts       int       `json:"restarts,omitempty"`
+	OutputTail     string    `json:"output_tail,omitempty"`
+	StartedAt      time.Time `json:"started_at,omitempty"`
+	UpdatedAt      time.Time `json:"updated_at,omitempty"`
+	Error          string    `json:"error,omitempty"`
+}
+
+func (server *daemonServer) handleServices(writer http.ResponseWriter, request *http.Request) {
+	if !server.authorize(request) {
+		writeJSON(writer, http.StatusUnauthorized, serviceStatus{MustUseSmartsh: true, Error: "unauthorized"})
+		return
+	}
+	switch request.Method {
+	case http.MethodGet:
+		server.servicesMutex.Lock()
+		services := make([]*managedService, 0, len(server.services))
+		for _, service := range server.services {
+			services = append(services, service)
+		}
+		server.servicesMutex.Unlock()
+		sort.Slice(services, func(i, j int) bool { return services[i].ID < services[j].ID })
+		statuses := make([]serviceStatus, 0, len(services))
+		for _, service := range services {
+			status := service.status()
+			status.OutputTail = ""
+			statuses = append(statuses, status)
+		}
+		writeJSON(writer, http.StatusOK, map[string]any{"must_use_smartsh": true, "services": statuses})
+	case http.MethodPost:
+		payload := serviceRequest{}
+		if err := json.NewDecoder(request.Body).Decode(&payload); err != nil {
+			writeJSON(writer, http.StatusBadRequest, serviceStatus{MustUseSmartsh: true, Error: fmt.Sprintf("invalid request body: %v", err)})
+			return
+		}
+		service, statusCode, err := server.createService(request.Context(), payload)
+		if err != nil {
+			writeJSON(writer, statusCode, serviceStatus{MustUseSmartsh: true, Error: err.Error()})
+			return
+		}
+		service.waitReady(request.Context())
+		writeJSON(writer, statusCode, service.status())
+	default:
+		writeJSON(writer, http.StatusMethodNotAllowed, serviceStatus{MustUseSmartsh: true, Error: "method not allowed"})
+	}
+}
+
+func (server *daemonServer) handleServiceRoutes(writer http.ResponseWriter, request *http.Request) {
+	if !server.authorize(request) {
+		writeJSON(writer, http.StatusUnauthorized, serviceStatus{MustUseSmartsh: true, Error: "unauthorized"})
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(request.URL.Path, "/services/"), "/"), "/")
+	if len(parts) < 1 || parts[0] == "" {
+		writeJSON(writer, http.StatusBadRequest, serviceStatus{MustUseSmartsh: true, Error: "service id is required"})
+		return
+	}
+	service := server.lookupService(parts[0])
+	if service == nil {
+		writeJSON(writer, http.StatusNotFound, serviceStatus{MustUseSmartsh: true, Error: "service not found"})
+		return
+	}
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+	expectedMethod := http.MethodPost
+	if action == "" || action == "logs" {
+		expectedMethod = http.MethodGet
+	}
+	if request.Method != expectedMethod {
+		writeJSON(writer, http.StatusMethodNotAllowed, serviceStatus{MustUseSmartsh: true, Error: "method not allowed"})
+		return
+	}
+
+	switch action {
+	case "":
+		writeJSON(writer, http.StatusOK, service.status())
+	case "logs":
+		serveOutputLogPage(writer, request, server.store.OutputLogPath(service.ID), jobOutputPage{MustUseSmartsh: true, ServiceID: service.ID})
+	case "stop":
+		service.stop()
+		writeJSON(writer, http.StatusOK, service.status())
+	case "restart":
+		service.stop()
+		service.mu.Lock()
+		service.Restarts++
+		service.mu.Unlock()
+		if err := server.startService(service); err != nil {
+			writeJSON(writer, http.StatusInternalServerError, serviceStatus{MustUseSmartsh: true, ServiceID: service.ID, Error: err.Error()})
+			return
+		}
+		service.waitReady(request.Context())
+		writeJSON(writer, http.StatusOK, service.status())
+	default:
+		writeJSON(writer, http.StatusNotFound, serviceStatus{MustUseSmartsh: true, Error: "unknown service action"})
+	}
+}
+
+// lookupService accepts a service ID or the name it was started with.
+func (server *daemonServer) lookupService(key string) *managedService {
+	server.servicesMutex.Lock()
+	defer server.servicesMutex.Unlock()
+	if service := server.services[key]; service != nil {
+		return service
+	}
+	for _, service := range server.services {
+		if service.Request.Name != "" && service.Request.Name == key {
+			return service
+		}
+	}
+	return nil
+}
+
+func (server *daemonServer) createService(ctx context.Context, payload serviceRequest) (*managedService, int, error) {
+	if strings.TrimSpace(payload.Command) == "" {
+		return nil, http.StatusBadRequest, fmt.Errorf("command is required")
+	}
+	var readyPattern *regexp.Regexp
+	if payload.Ready != nil && strings.TrimSpace(payload.Ready.LogRegex) != "" {
+		compiled, err := regexp.Compile(payload.Ready.LogRegex)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid ready.log_regex: %w", err)
+		}
+		readyPattern = compiled
+	}
+	runPayload := runRequest{
+		Command:       payload.Command,
+		Shell:         payload.Shell,
+		Cwd:           payload.Cwd,
+		Unsafe:        payload.Unsafe,
+		AllowlistMode: payload.AllowlistMode,
+		AllowlistFile: payload.AllowlistFile,
+		Sandbox:       payload.Sandbox,
+		AllowedEnv:    payload.AllowedEnv,
+		Env:           payload.Env,
+	}
+	validated, err := server.validateBackgroundCommand(ctx, runPayload)
+	if err != nil {
+		return nil, http.StatusUnprocessableEntity, err
+	}
+	cwd, _ := resolveWorkingDirectory(payload.Cwd)
+	policy, _ := loadPolicy(cwd)
+	sandboxMode, _ := resolveSandboxMode(payload.Sandbox, policy)
+	shell, _ := resolveShell(payload.Shell, policy)
+
+	server.servicesMutex.Lock()
+	running := 0
+	for _, existing := range server.services {
+		if payload.Name != "" && existing.Request.Name == payload.Name && existing.isRunning() {
+			server.servicesMutex.Unlock()
+			return nil, http.StatusConflict, fmt.Errorf("service %q is already running as %s", payload.Name, existing.ID)
+		}
+		if existing.isRunning() {
+			running++
+		}
+	}
+	if running >= parsePositiveIntEnv("SMARTSH_MAX_SERVICES", defaultMaxServices) {
+		server.servicesMutex.Unlock()
+		return nil, http.StatusTooManyRequests, fmt.Errorf("too many running services; stop one first")
+	}
+	service := &managedService{
+		ID:           fmt.Sprintf("svc_%d", time.Now().UnixNano()),
+		Request:      payload,
+		Command:      validated.ResolvedCommand,
+		Cwd:          cwd,
+		env:          buildEnvWithPolicy(policy, runPayload),
+		shell:        shell.Argv,
+		sandbox:      sandboxMode,
+		readyPattern: readyPattern,
+	}
+	if sandboxMode != sandboxOff {
+		service.writable = sandboxWritablePaths(cwd, policy)
+		service.denied = sandboxDeniedPaths(policy)
+	}
+	server.services[service.ID] = service
+	server.servicesMutex.Unlock()
+
+	if err := server.startService(service); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return service, http.StatusCreated, nil
+}
+
+// validateBackgroundCommand runs the policy, allowlist and approval checks of
+// /run as a dry run, so that a command started outside a job is held to the
+// same rules. Commands that would need approval are rejected.
+func (server *daemonServer) validateBackgroundCommand(ctx context.Context, payload runRequest) (runResponse, error) {
+	payload.DryRun = true
+	payload.Async = false
+	payload.OpenExternalTerminal = false
+	validation := server.executeRequest(ctx, payload, "")
+	if validation.Status != "completed" {
+		reason := firstNonEmpty(validation.BlockedReason, validation.Error, validation.ApprovalMessage, validation.Status)
+		return validation, fmt.Errorf("command rejected: %s", reason)
+	}
+	return validation, nil
+}
+
+func (server *daemonServer) startService(service *managedService) error {
+	processContext, cancel := context.WithCancel(context.Background())
+	var execCommand *exec.Cmd
+	switch {
+	case len(service.shell) > 0:
+		execCommand = exec.CommandContext(processContext, service.shell[0], append(append([]string{}, service.shell[1:]...), service.Command)...)
+	case runtime.GOOS == "windows":
+		execCommand = exec.CommandContext(processContext, "cmd", "/C", service.Command)
+	default:
+		execCommand = exec.CommandContext(processContext, "sh", "-c", service.Command)
+	}
+	execCommand.Dir = service.Cwd
+	execCommand.Env = service.env
+	terminator := configureProcessTree(execCommand, killGracePeriod())
+	if service.sandbox != sandboxOff {
+		if _, err := applySandbox(execCommand, service.Cwd, service.sandbox, service.writable, service.denied); err != nil {
+			cancel()
+			return err
+		}
+	}
+	bindServiceToDaemon(execCommand)
+	outputLog, _ := server.store.AppendOutputLog(service.ID)
+	execCommand.Stdout = service
+	execCommand.Stderr = service
+
+	service.mu.Lock()
+	service.Status = "starting"
+	service.Ready = false
+	service.URL = ""
+	service.Error = ""
+	service.ExitCode = 0
+	service.pending = nil
+	service.log = outputLog
+	service.cancel = cancel
+	service.done = make(chan struct{})
+	service.readyCh = make(chan struct{})
+	service.StartedAt = time.Now()
+	service.UpdatedAt = time.Now()
+	if err := execCommand.Start(); err != nil {
+		service.Status = "failed"
+		service.Error = err.Error()
+		close(service.done)
+		service.mu.Unlock()
+		cancel()
+		if outputLog != nil {
+			_ = outputLog.Close()
+		}
+		return err
+	}
+	service.PID = execCommand.Process.Pid
+	if service.Request.Ready == nil || *service.Request.Ready == (readinessProbe{}) {
+		service.markReadyLocked("")
+	}
+	done := service.done
+	service.mu.Unlock()
+
+	go service.probe(done)
+	go func() {
+		waitErr := waitCommand(execCommand)
+		terminator.finish(execCommand)
+		service.mu.Lock()
+		defer service.mu.Unlock()
+		if service.Status != "stopped" {
+			service.Status = "exited"
+			if waitErr != nil {
+				service.Status = "failed"
+				service.Error = waitErr.Error()
+			}
+		}
+		if execCommand.ProcessState != nil {
+			service.ExitCode = execCommand.ProcessState.ExitCode()
+		}
+		service.Ready = false
+		service.UpdatedAt = time.Now()
+		if service.log != nil {
+			_ = service.log.Close()
+			service.log = nil
+		}
+		close(done)
+	}()
+	return nil
+}
+
+// Write receives both output streams of the service. Complete lines are
+// matched against the log readiness regex.
+func (service *managedService) Write(data []byte) (int, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	if service.log != nil {
+		_, _ = service.log.Write(data)
+	}
+	service.outputTail = tailString(service.outputTail+string(data), serviceOutputTailSize)
+	service.UpdatedAt = time.Now()
+	if service.Ready || service.readyPattern == nil {
+		return len(data), nil
+	}
+	service.pending = append(service.pending, data...)
+	for {
+		newline := bytes.IndexByte(service.pending, '\n')
+		if newline < 0 {
+			break
+		}
+		line := string(service.pending[:newline])
+		service.pending = service.pending[newline+1:]
+		if service.readyPattern.MatchString(line) {
+			service.markReadyLocked(serviceURLPattern.FindString(line))
+			service.pending = nil
+			break
+		}
+	}
+	return len(data), nil
+}
+
+// probe polls the TCP or HTTP readiness check until it passes, the service
+// exits, or it is replaced by a restart.
+func (service *managedService) probe(done chan struct{}) {
+	probe := service.Request.Ready
+	if probe == nil || (probe.TCP == "" && probe.HTTP == "") {
+		return
+	}
+	client := &http.Client{Timeout: 2 * time.Second}
+	ticker := time.NewTicker(serviceProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		passed, url := false, ""
+		if probe.HTTP != "" {
+			if response, err := client.Get(probe.HTTP); err == nil {
+				_ = response.Body.Close()
+				passed = response.StatusCode == http.StatusOK
+			}
+			url = probe.HTTP
+		} else {
+			address := probe.TCP
+			if !strings.Contains(address, ":") {
+				address = "127.0.0.1:" + address
+			}
+			if connection, err := net.DialTimeout("tcp", address, time.Second); err == nil {
+				_ = connection.Close()
+				passed = true
+			}
+			url = "http://" + address
+		}
+		if passed {
+			service.mu.Lock()
+			if service.done == done {
+				service.markReadyLocked(url)
+			}
+			service.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (service *managedService) markReadyLocked(url string) {
+	if service.Ready || service.Status != "starting" {
+		return
+	}
+	service.Ready = true
+	service.Status = "ready"
+	if url == "" {
+		url = serviceURLPattern.FindString(service.outputTail)
+	}
+	service.URL = strings.TrimRight(url, ".,;)")
+	service.UpdatedAt = time.Now()
+	close(service.readyCh)
+}
+
+// waitReady blocks until the service is ready, exits, or ready_timeout_sec
+// passes; a service that is still starting afterwards keeps running.
+func (service *managedService) waitReady(ctx context.Context) {
+	service.mu.Lock()
+	readyCh, done := service.readyCh, service.done
+	timeoutSec := service.Request.ReadyTimeoutSec
+	service.mu.Unlock()
+	if timeoutSec <= 0 {
+		timeoutSec = defaultServiceReadyTimeoutSec
+	}
+	timer := time.NewTimer(time.Duration(timeoutSec) * time.Second)
+	defer timer.Stop()
+	select {
+	case <-readyCh:
+	case <-done:
+	case <-timer.C:
+		service.mu.Lock()
+		if service.Status == "starting" {
+			service.Error = fmt.Sprintf("not ready after %ds", timeoutSec)
+		}
+		service.mu.Unlock()
+	case <-ctx.Done():
+	}
+}
+
+// stopServices stops every running service. The daemon calls it on shutdown
+// so that no service outlives it, still holding its port but out of reach of
+// /services.
+func (server *daemonServer) stopServices() {
+	server.servicesMutex.Lock()
+	services := make([]*managedService, 0, len(server.services))
+	for _, service := range server.services {
+		services = append(services, service)
+	}
+	server.servicesMutex.Unlock()
+	var group sync.WaitGroup
+	for _, service := range services {
+		group.Add(1)
+		go func(service *managedService) {
+			defer group.Done()
+			service.stop()
+		}(service)
+	}
+	group.Wait()
+}
+
+// stop terminates the service's process group and waits for it to exit.
+func (service *managedService) stop() {
+	service.mu.Lock()
+	if !service.isRunningLocked() {
+		service.mu.Unlock()
+		return
+	}
+	service.Status = "stopped"
+	cancel, done := service.cancel, service.done
+	service.mu.Unlock()
+	cancel()
+	<-done
+}
+
+func (service *managedService) isRunning() bool {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	return service.isRunningLocked()
+}
+
+func (service *managedService) isRunningLocked() bool {
+	return service.Status == "starting" || service.Status == "ready"
+}
+
+func (service *managedService) status() serviceStatus {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	return serviceStatus{
+		MustUseSmartsh: true,
+		ServiceID:      service.ID,
+		Name:           service.Request.Name,
+		Status:         service.Status,
+		Ready:          service.Ready,
+		URL:            service.URL,
+		PID:            service.PID,
+		Command:        service.Command,
+		Cwd:            service.Cwd,
+		ExitCode:       service.ExitCode,
+		Restarts:       service.Restarts,
+		OutputTail:     tailString(service.outputTail, 2000),
+		StartedAt:      service.StartedAt,
+		UpdatedAt:      service.UpdatedAt,
+		Error:          service.Error,
+	}
+}
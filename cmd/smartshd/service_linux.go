@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// bindServiceToDaemon has the kernel send SIGTERM to the service's process
+// if the daemon dies without stopping its services, e.g. on SIGKILL.
+func bindServiceToDaemon(execCommand *exec.Cmd) {
+	if execCommand.SysProcAttr == nil {
+		execCommand.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	execCommand.SysProcAttr.Pdeathsig = syscall.SIGTERM
+}
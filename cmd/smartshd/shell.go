@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// shellScriptFlags are the arguments each known shell needs before the
+// command string.
+var shellScriptFlags = map[string][]string{
+	"sh":         {"-c"},
+	"bash":       {"-c"},
+	"zsh":        {"-c"},
+	"dash":       {"-c"},
+	"ksh":        {"-c"},
+	"mksh":       {"-c"},
+	"fish":       {"-c"},
+	"pwsh":       {"-NoProfile", "-NonInteractive", "-Command"},
+	"powershell": {"-NoProfile", "-NonInteractive", "-Command"},
+	"cmd":        {"/C"},
+}
+
+// runShell is the interpreter a command string runs under. The zero value is
+// the platform default, sh -c or cmd /C.
+type runShell struct {
+	// Name is the program's base name, used for display and to pick the
+	// parser dialect for risk assessment.
+	Name string
+	// Argv is the program and the arguments that precede the command string.
+	Argv []string
+}
+
+// program is the shell the command string actually runs under, naming the
+// platform default for the zero value.
+func (shell runShell) program() string {
+	if shell.Name == "" && runtime.GOOS == "windows" {
+		return "cmd"
+	}
+	return shell.Name
+}
+
+// resolveShell picks the shell from the request, falling back to the policy's
+// default. A request may only name a known shell ("bash", "zsh") or repeat the
+// policy's shell verbatim: the shell's own argv is not assessed, so a request
+// must not be able to smuggle in a program or flags of its choosing. The
+// policy may give a path and extra flags ("bash -e -o pipefail"), and the
+// script flag of a known shell is added when missing. Any other program in
+// the policy must spell out the arguments that precede the command string,
+// e.g. "/opt/bin/nu -c".
+func resolveShell(requested string, policy *projectPolicy) (runShell, error) {
+	value := strings.TrimSpace(requested)
+	policyShell := ""
+	if policy != nil {
+		policyShell = strings.TrimSpace(policy.Shell)
+	}
+	if value != "" && value != policyShell {
+		if len(strings.Fields(value)) > 1 {
+			return runShell{}, fmt.Errorf("shell %q: extra shell arguments can only be set in %s", value, policyFileName)
+		}
+		if _, known := shellScriptFlags[strings.ToLower(value)]; !known {
+			return runShell{}, fmt.Errorf("unknown shell %q: use one of %s or set it in %s", value, strings.Join(knownShellNames(), ", "), policyFileName)
+		}
+	}
+	if value == "" {
+		value = policyShell
+	}
+	if value == "" {
+		return runShell{}, nil
+	}
+	fields := strings.Fields(value)
+	name := strings.ToLower(strings.TrimSuffix(filepath.Base(fields[0]), ".exe"))
+	flags, known := shellScriptFlags[name]
+	if !known && len(fields) == 1 {
+		return runShell{}, fmt.Errorf("unknown shell %q: give the arguments that precede the command, e.g. %q", value, value+" -c")
+	}
+	if _, err := exec.LookPath(fields[0]); err != nil {
+		return runShell{}, fmt.Errorf("shell %q not found: %w", fields[0], err)
+	}
+	argv := fields
+	if known && !hasScriptFlag(fields[1:], flags) {
+		argv = append(argv, flags...)
+	}
+	return runShell{Name: name, Argv: argv}, nil
+}
+
+func knownShellNames() []string {
+	names := make([]string, 0, len(shellScriptFlags))
+	for name := range shellScriptFlags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func hasScriptFlag(args []string, flags []string) bool {
+	scriptFlag := flags[len(flags)-1]
+	for _, arg := range args {
+		if strings.EqualFold(arg, scriptFlag) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BegaDeveloper/smartsh/internal/security"
+)
+
+const (
+	defaultShellSessionIdleSec = 1800
+	defaultMaxShellSessions    = 32
+)
+
+// sessionStateArg marks a re-exec of the smartshd binary from a session's
+// EXIT trap: it writes the shell's final cwd and environment to a file. Like
+// sandboxExecArg it is checked from init so test binaries can host it.
+const sessionStateArg = "__smartsh-session-state"
+
+func init() {
+	if len(os.Args) > 2 && os.Args[1] == sessionStateArg {
+		os.Exit(writeSessionState(os.Args[2]))
+	}
+}
+
+// sessionIgnoredEnv are variables the shell maintains itself; carrying them
+// between runs would only confuse the next shell.
+var sessionIgnoredEnv = map[string]bool{"PWD": true, "OLDPWD": true, "SHLVL": true, "_": true}
+
+// shellSession carries the working directory and exported environment of a
+// named session from one run to the next. Every run is still a fresh,
+// non-PTY shell; an EXIT trap records where it ended up. Sessions live in
+// memory, run one command at a time and expire after
+// SMARTSH_SHELL_SESSION_IDLE_SEC without a run.
+type shellSession struct {
+	ID         string
+	Cwd        string
+	Env        map[string]string
+	Unset      map[string]bool
+	Runs       int
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	busy       chan struct{}
+	mu         sync.Mutex
+}
+
+type shellSessionStatus struct {
+	SessionID  string    `json:"session_id"`
+	Cwd        string    `json:"cwd,omitempty"`
+	EnvKeys    []string  `json:"env_keys,omitempty"`
+	UnsetKeys  []string  `json:"unset_keys,omitempty"`
+	Runs       int       `json:"runs"`
+	Busy       bool      `json:"busy,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type sessionState struct {
+	Cwd string   `json:"cwd"`
+	Env []string `json:"env"`
+}
+
+func shellSessionIdleTimeout() time.Duration {
+	return time.Duration(parsePositiveIntEnv("SMARTSH_SHELL_SESSION_IDLE_SEC", defaultShellSessionIdleSec)) * time.Second
+}
+
+func (server *daemonServer) handleShellSessions(writer http.ResponseWriter, request *http.Request) {
+	if !server.authorize(request) {
+		writeJSON(writer, http.StatusUnauthorized, map[string]any{"must_use_smartsh": true, "error": "unauthorized"})
+		return
+	}
+	if request.Method != http.MethodGet {
+		writeJSON(writer, http.StatusMethodNotAllowed, map[string]any{"must_use_smartsh": true, "error": "method not allowed"})
+		return
+	}
+	server.shellSessionsMutex.Lock()
+	server.pruneShellSessionsLocked(time.Now())
+	sessions := make([]*shellSession, 0, len(server.shellSessions))
+	for _, session := range server.shellSessions {
+		sessions = append(sessions, session)
+	}
+	server.shellSessionsMutex.Unlock()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedAt.Before(sessions[j].CreatedAt) })
+	statuses := make([]shellSessionStatus, 0, len(sessions))
+	for _, session := range sessions {
+		statuses = append(statuses, session.status())
+	}
+	writeJSON(writer, http.StatusOK, map[string]any{"must_use_smartsh": true, "sessions": statuses})
+}
+
+// handleShellSessionRoutes serves GET /shell-sessions/{id} and
+// POST /shell-sessions/{id}/close.
+func (server *daemonServer) handleShellSessionRoutes(writer http.ResponseWriter, request *http.Request) {
+	if !server.authorize(request) {
+		writeJSON(writer, http.StatusUnauthorized, map[string]any{"must_use_smartsh": true, "error": "unauthorized"})
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(request.URL.Path, "/shell-sessions/"), "/"), "/")
+	if len(parts) < 1 || parts[0] == "" {
+		writeJSON(writer, http.StatusBadRequest, map[string]any{"must_use_smartsh": true, "error": "session id is required"})
+		return
+	}
+	server.shellSessionsMutex.Lock()
+	server.pruneShellSessionsLocked(time.Now())
+	session := server.shellSessions[parts[0]]
+	server.shellSessionsMutex.Unlock()
+	if session == nil {
+		writeJSON(writer, http.StatusNotFound, map[string]any{"must_use_smartsh": true, "error": "shell session not found"})
+		return
+	}
+	if len(parts) > 1 && parts[1] == "close" {
+		if request.Method != http.MethodPost {
+			writeJSON(writer, http.StatusMethodNotAllowed, map[string]any{"must_use_smartsh": true, "error": "method not allowed"})
+			return
+		}
+		server.shellSessionsMutex.Lock()
+		delete(server.shellSessions, session.ID)
+		server.shellSessionsMutex.Unlock()
+		writeJSON(writer, http.StatusOK, map[string]any{"must_use_smartsh": true, "closed": true, "session": session.status()})
+		return
+	}
+	if request.Method != http.MethodGet {
+		writeJSON(writer, http.StatusMethodNotAllowed, map[string]any{"must_use_smartsh": true, "error": "method not allowed"})
+		return
+	}
+	writeJSON(writer, http.StatusOK, session.status())
+}
+
+// acquireShellSession returns the named session, creating it on first use,
+// and waits until no other run holds it. The caller must call release.
+func (server *daemonServer) acquireShellSession(ctx context.Context, sessionID string) (*shellSession, func(), error) {
+	if strings.ContainsAny(sessionID, "/ ") {
+		return nil, nil, fmt.Errorf("invalid session_id %q", sessionID)
+	}
+	server.shellSessionsMutex.Lock()
+	now := time.Now()
+	server.pruneShellSessionsLocked(now)
+	session := server.shellSessions[sessionID]
+	if session == nil {
+		if len(server.shellSessions) >= parsePositiveIntEnv("SMARTSH_MAX_SHELL_SESSIONS", defaultMaxShellSessions) {
+			server.shellSessionsMutex.Unlock()
+			return nil, nil, errors.New("too many shell sessions; close one or wait for idle sessions to expire")
+		}
+		session = &shellSession{ID: sessionID, Env: map[string]string{}, Unset: map[string]bool{}, CreatedAt: now, LastUsedAt: now, busy: make(chan struct{}, 1)}
+		server.shellSessions[sessionID] = session
+	}
+	server.shellSessionsMutex.Unlock()
+
+	select {
+	case session.busy <- struct{}{}:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+	session.touch()
+	return session, func() {
+		session.touch()
+		<-session.busy
+	}, nil
+}
+
+// pruneShellSessionsLocked drops idle sessions. A session with a run in
+// progress is never idle.
+func (server *daemonServer) pruneShellSessionsLocked(now time.Time) {
+	idle := shellSessionIdleTimeout()
+	for id, session := range server.shellSessions {
+		session.mu.Lock()
+		expired := now.Sub(session.LastUsedAt) > idle && len(session.busy) == 0
+		session.mu.Unlock()
+		if expired {
+			delete(server.shellSessions, id)
+		}
+	}
+}
+
+func (session *shellSession) touch() {
+	session.mu.Lock()
+	session.LastUsedAt = time.Now()
+	session.mu.Unlock()
+}
+
+func (session *shellSession) status() shellSessionStatus {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	status := shellSessionStatus{
+		SessionID:  session.ID,
+		Cwd:        session.Cwd,
+		Runs:       session.Runs,
+		Busy:       len(session.busy) > 0,
+		CreatedAt:  session.CreatedAt,
+		LastUsedAt: session.LastUsedAt,
+		ExpiresAt:  session.LastUsedAt.Add(shellSessionIdleTimeout()),
+	}
+	for key := range session.Env {
+		status.EnvKeys = append(status.EnvKeys, key)
+	}
+	for key := range session.Unset {
+		status.UnsetKeys = append(status.UnsetKeys, key)
+	}
+	sort.Strings(status.EnvKeys)
+	sort.Strings(status.UnsetKeys)
+	return status
+}
+
+func (session *shellSession) cwd() string {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.Cwd
+}
+
+// applyEnv layers the session's exported and unset variables over env.
+// Variables the request sets explicitly keep the request's value.
+func (session *shellSession) applyEnv(env []string, requested map[string]string) []string {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	result := make([]string, 0, len(env)+len(session.Env))
+	for _, entry := range env {
+		key, _, _ := strings.Cut(entry, "=")
+		if _, explicit := requested[key]; explicit {
+			result = append(result, entry)
+			continue
+		}
+		if _, exported := session.Env[key]; exported || session.Unset[key] {
+			continue
+		}
+		result = append(result, entry)
+	}
+	for key, value := range session.Env {
+		if _, explicit := requested[key]; !explicit {
+			result = append(result, key+"="+value)
+		}
+	}
+	return result
+}
+
+// record reads the state file written by the EXIT trap and folds the run's
+// cwd and environment changes, relative to the env it started with, into
+// the session. A run killed before its trap ran leaves the session as it was.
+func (session *shellSession) record(stateFile string, startEnv []string) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.Runs++
+	payload, err := os.ReadFile(stateFile)
+	if err != nil || len(payload) == 0 {
+		return
+	}
+	state := sessionState{}
+	if json.Unmarshal(payload, &state) != nil {
+		return
+	}
+	if state.Cwd != "" {
+		session.Cwd = state.Cwd
+	}
+	before := envMap(startEnv)
+	after := envMap(state.Env)
+	for key, value := range after {
+		if sessionIgnoredEnv[key] {
+			continue
+		}
+		if previous, existed := before[key]; !existed || previous != value {
+			session.Env[key] = value
+			delete(session.Unset, key)
+		}
+	}
+	for key := range before {
+		if _, kept := after[key]; !kept && !sessionIgnoredEnv[key] {
+			delete(session.Env, key)
+			session.Unset[key] = true
+		}
+	}
+}
+
+func envMap(env []string) map[string]string {
+	result := make(map[string]string, len(env))
+	for _, entry := range env {
+		if key, value, ok := strings.Cut(entry, "="); ok {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+// sessionShellSupported reports whether the run's shell understands the
+// POSIX trap used to record session state.
+func sessionShellSupported(shell runShell) bool {
+	switch shell.Name {
+	case "":
+		return runtime.GOOS != "windows"
+	case "sh", "bash", "zsh", "dash", "ksh", "mksh":
+		return true
+	default:
+		return false
+	}
+}
+
+// wrapForShellSession installs an EXIT trap that re-executes smartshd to dump
+// the shell's final cwd and environment, preserving the command's exit status.
+func wrapForShellSession(command string, stateFile string) string {
+	self, err := os.Executable()
+	if err != nil {
+		return command
+	}
+	save := security.QuoteArgv([]string{self, sessionStateArg, stateFile})
+	return "__smartsh_save_session() { __smartsh_status=$?; " + save + "; exit $__smartsh_status; }\n" +
+		"trap __smartsh_save_session EXIT\n" + command
+}
+
+func writeSessionState(path string) int {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return 1
+	}
+	payload, err := json.Marshal(sessionState{Cwd: cwd, Env: os.Environ()})
+	if err != nil {
+		return 1
+	}
+	if os.WriteFile(path, payload, 0o600) != nil {
+		return 1
+	}
+	return 0
+}
@@ -12,6 +12,8 @@ import (
 
 var jobsBucket = []byte("jobs")
 var approvalsBucket = []byte("approvals")
+var runCacheBucket = []byte("run_cache")
+var jobChunksBucket = []byte("job_chunks")
 
 type jobStore struct {
 	db *bolt.DB
@@ -42,7 +44,15 @@ func newJobStore(path string) (*jobStore, error) {
 			return createErr
 		}
 		_, createApprovalErr := tx.CreateBucketIfNotExists(approvalsBucket)
-		return createApprovalErr
+		if createApprovalErr != nil {
+			return createApprovalErr
+		}
+		_, createCacheErr := tx.CreateBucketIfNotExists(runCacheBucket)
+		if createCacheErr != nil {
+			return createCacheErr
+		}
+		_, createChunksErr := tx.CreateBucketIfNotExists(jobChunksBucket)
+		return createChunksErr
 	}); err != nil {
 		_ = db.Close()
 		return nil, err
@@ -57,15 +67,76 @@ func (store *jobStore) Close() error {
 	return store.db.Close()
 }
 
+// Save stores job. Its output chunks, when set, go to a bucket of their own
+// so that listing jobs does not load them.
 func (store *jobStore) Save(job daemonJob) error {
 	return store.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(jobsBucket)
-		payload, err := json.Marshal(job)
-		if err != nil {
-			return err
+		return putJob(tx, job)
+	})
+}
+
+// Update loads a job and, if modify returns true, saves the modified job in
+// the same transaction, so that a status check and the write that depends on
+// it cannot interleave with another writer. It returns the job as stored
+// afterwards, nil if there is none, and whether it was modified.
+func (store *jobStore) Update(jobID string, modify func(job *daemonJob) bool) (*daemonJob, bool, error) {
+	var job *daemonJob
+	modified := false
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(jobsBucket).Get([]byte(jobID))
+		if raw == nil {
+			return nil
+		}
+		parsed := daemonJob{}
+		if decodeErr := json.Unmarshal(raw, &parsed); decodeErr != nil {
+			return decodeErr
+		}
+		job = &parsed
+		if !modify(job) {
+			return nil
+		}
+		modified = true
+		return putJob(tx, *job)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return job, modified, nil
+}
+
+func putJob(tx *bolt.Tx, job daemonJob) error {
+	payload, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(jobsBucket).Put([]byte(job.ID), payload); err != nil {
+		return err
+	}
+	if job.OutputChunks == nil {
+		return nil
+	}
+	chunks, err := json.Marshal(job.OutputChunks)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(jobChunksBucket).Put([]byte(job.ID), chunks)
+}
+
+// GetOutputChunks returns the timestamped output chunks stored for a job, or
+// nil if it has none.
+func (store *jobStore) GetOutputChunks(jobID string) ([]outputChunk, error) {
+	var chunks []outputChunk
+	err := store.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(jobChunksBucket).Get([]byte(jobID))
+		if raw == nil {
+			return nil
 		}
-		return bucket.Put([]byte(job.ID), payload)
+		return json.Unmarshal(raw, &chunks)
 	})
+	if err != nil {
+		return nil, err
+	}
+	return chunks, nil
 }
 
 func (store *jobStore) Get(jobID string) (*daemonJob, error) {
@@ -112,6 +183,29 @@ func (store *jobStore) List(limit int) ([]daemonJob, error) {
 	return result, err
 }
 
+// ListByStatus scans every stored job and returns those whose result status is
+// one of statuses.
+func (store *jobStore) ListByStatus(statuses ...string) ([]daemonJob, error) {
+	wanted := map[string]bool{}
+	for _, status := range statuses {
+		wanted[status] = true
+	}
+	result := make([]daemonJob, 0)
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(key []byte, value []byte) error {
+			job := daemonJob{}
+			if decodeErr := json.Unmarshal(value, &job); decodeErr != nil {
+				return nil
+			}
+			if wanted[job.Result.Status] {
+				result = append(result, job)
+			}
+			return nil
+		})
+	})
+	return result, err
+}
+
 func (store *jobStore) SaveApproval(approval commandApproval) error {
 	return store.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(approvalsBucket)
@@ -143,3 +237,20 @@ func (store *jobStore) GetApproval(approvalID string) (*commandApproval, error)
 	}
 	return approval, nil
 }
+
+func (store *jobStore) ListApprovalsByStatus(status string) ([]commandApproval, error) {
+	result := make([]commandApproval, 0)
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(approvalsBucket).ForEach(func(key []byte, value []byte) error {
+			approval := commandApproval{}
+			if decodeErr := json.Unmarshal(value, &approval); decodeErr != nil {
+				return nil
+			}
+			if approval.Status == status {
+				result = append(result, approval)
+			}
+			return nil
+		})
+	})
+	return result, err
+}
@@ -16,12 +16,29 @@ type parsedSummary struct {
 	TopIssues    []string
 }
 
-func deterministicSummary(command string, exitCode int, output string, runErr error) parsedSummary {
+// summaryParsers are the tool-specific parsers a task can name as its parser
+// hint, which is tried before the others.
+var summaryParsers = map[string]func([]string, *parsedSummary) bool{
+	"go":         parseGoTest,
+	"jest":       parseJestVitest,
+	"vitest":     parseJestVitest,
+	"typescript": parseTypeScript,
+	"tsc":        parseTypeScript,
+	"maven":      parseMaven,
+	"gradle":     parseGradle,
+	"dotnet":     parseDotNet,
+}
+
+func deterministicSummary(command string, exitCode int, output string, stderr string, runErr error) parsedSummary {
+	return deterministicSummaryWithParser(command, "", exitCode, output, stderr, runErr)
+}
+
+func deterministicSummaryWithParser(command string, parser string, exitCode int, output string, stderr string, runErr error) parsedSummary {
 	if exitCode == 0 && runErr == nil {
 		return parsedSummary{Summary: "command completed successfully", ErrorType: "none"}
 	}
 	lines := splitNonEmptyLines(output)
-	issueLines := pickIssueLines(lines, 5)
+	issueLines := pickStderrWeightedIssueLines(lines, splitNonEmptyLines(stderr), 5)
 
 	summary := parsedSummary{
 		Summary:   fmt.Sprintf("command failed (exit code %d)", exitCode),
@@ -33,22 +50,16 @@ func deterministicSummary(command string, exitCode int, output string, runErr er
 		summary.Summary = fmt.Sprintf("command failed (exit code %d): %s", exitCode, issueLines[0])
 	}
 
-	switch {
-	case parseGoTest(lines, &summary):
-		return summary
-	case parseJestVitest(lines, &summary):
-		return summary
-	case parseTypeScript(lines, &summary):
-		return summary
-	case parseMaven(lines, &summary):
-		return summary
-	case parseGradle(lines, &summary):
-		return summary
-	case parseDotNet(lines, &summary):
-		return summary
-	default:
-		return summary
-	}
+	hinted := summaryParsers[strings.ToLower(strings.TrimSpace(parser))]
+	_ = (hinted != nil && hinted(lines, &summary)) ||
+		parseGoTest(lines, &summary) ||
+		parseJestVitest(lines, &summary) ||
+		parseTypeScript(lines, &summary) ||
+		parseMaven(lines, &summary) ||
+		parseGradle(lines, &summary) ||
+		parseDotNet(lines, &summary)
+	applyTerminationSummary(&summary, runErr)
+	return summary
 }
 
 func parseJestVitest(lines []string, summary *parsedSummary) bool {
@@ -180,6 +191,20 @@ func parseDotNet(lines []string, summary *parsedSummary) bool {
 	return matched
 }
 
+// pickStderrWeightedIssueLines prefers issue lines from stderr, where most
+// tools report the failure, before falling back to the combined output. When
+// nothing looks like an error, the last stderr line is the best remaining hint.
+func pickStderrWeightedIssueLines(lines []string, stderrLines []string, max int) []string {
+	issues := pickIssueLines(stderrLines, max)
+	for _, line := range pickIssueLines(lines, max) {
+		issues = appendUnique(issues, strings.TrimSpace(line), max)
+	}
+	if len(issues) == 0 && len(stderrLines) > 0 && max > 0 {
+		issues = append(issues, strings.TrimSpace(stderrLines[len(stderrLines)-1]))
+	}
+	return issues
+}
+
 func pickIssueLines(lines []string, max int) []string {
 	if max <= 0 {
 		return nil
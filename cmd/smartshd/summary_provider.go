@@ -17,8 +17,8 @@ type summaryProviderResult struct {
 	Source  string
 }
 
-func resolveSummary(command string, exitCode int, output string, runErr error, client *http.Client) summaryProviderResult {
-	deterministic := deterministicSummary(command, exitCode, output, runErr)
+func resolveSummary(command string, parser string, exitCode int, output string, stderr string, runErr error, client *http.Client) summaryProviderResult {
+	deterministic := deterministicSummaryWithParser(command, parser, exitCode, output, stderr, runErr)
 	successfulRun := exitCode == 0 && runErr == nil
 	provider := strings.ToLower(strings.TrimSpace(os.Getenv("SMARTSH_SUMMARY_PROVIDER")))
 	if provider == "" {
@@ -34,12 +34,13 @@ func resolveSummary(command string, exitCode int, output string, runErr error, c
 	case "deterministic":
 		return summaryProviderResult{Summary: deterministic, Source: "deterministic"}
 	case "ollama":
-		ollamaSummary, ok, failureReason := ollamaSummaryForOutput(command, exitCode, output, deterministic, client)
+		ollamaSummary, ok, failureReason := ollamaSummaryForOutput(command, exitCode, output, stderr, deterministic, client)
 		if ok {
 			if successfulRun {
 				ollamaSummary.ErrorType = "none"
 				ollamaSummary.PrimaryError = ""
 			}
+			applyTerminationSummary(&ollamaSummary, runErr)
 			return summaryProviderResult{Summary: ollamaSummary, Source: "ollama"}
 		}
 		if ollamaRequired {
@@ -51,8 +52,9 @@ func resolveSummary(command string, exitCode int, output string, runErr error, c
 		return summaryProviderResult{Summary: deterministic, Source: "deterministic"}
 	case "hybrid":
 		if shouldUseOllamaFallback(deterministic, exitCode) {
-			ollamaSummary, ok, _ := ollamaSummaryForOutput(command, exitCode, output, deterministic, client)
+			ollamaSummary, ok, _ := ollamaSummaryForOutput(command, exitCode, output, stderr, deterministic, client)
 			if ok {
+				applyTerminationSummary(&ollamaSummary, runErr)
 				return summaryProviderResult{Summary: ollamaSummary, Source: "hybrid_ollama"}
 			}
 		}
@@ -75,7 +77,7 @@ func shouldUseOllamaFallback(summary parsedSummary, exitCode int) bool {
 	return false
 }
 
-func ollamaSummaryForOutput(command string, exitCode int, output string, deterministic parsedSummary, client *http.Client) (parsedSummary, bool, string) {
+func ollamaSummaryForOutput(command string, exitCode int, output string, stderr string, deterministic parsedSummary, client *http.Client) (parsedSummary, bool, string) {
 	url := strings.TrimSpace(os.Getenv("SMARTSH_OLLAMA_URL"))
 	if url == "" {
 		url = "http://127.0.0.1:11434"
@@ -86,9 +88,10 @@ func ollamaSummaryForOutput(command string, exitCode int, output string, determi
 	}
 	maxChars := parsePositiveIntEnv("SMARTSH_OLLAMA_MAX_INPUT_CHARS", 3500)
 	timeoutSec := parsePositiveIntEnv("SMARTSH_OLLAMA_TIMEOUT_SEC", 8)
-	boundedOutput := tailString(output, maxChars)
-	redactedOutput := redactForModel(boundedOutput)
-	prompt := buildOllamaPrompt(command, exitCode, redactedOutput)
+	// Stderr usually holds the failure, so give it up to half of the budget.
+	boundedStderr := tailString(stderr, maxChars/2)
+	boundedOutput := tailString(output, maxChars-len(boundedStderr))
+	prompt := buildOllamaPrompt(command, exitCode, redactForModel(boundedOutput), redactForModel(boundedStderr))
 
 	requestBody := map[string]any{
 		"model":  model,
@@ -139,16 +142,21 @@ func ollamaSummaryForOutput(command string, exitCode int, output string, determi
 	return mergeSummary(deterministic, normalized), true, ""
 }
 
-func buildOllamaPrompt(command string, exitCode int, outputTail string) string {
-	return "You are summarizing terminal command results for an AI coding agent.\n" +
+func buildOllamaPrompt(command string, exitCode int, outputTail string, stderrTail string) string {
+	prompt := "You are summarizing terminal command results for an AI coding agent.\n" +
 		"Return ONLY compact JSON with keys: summary,error_type,primary_error,next_action,failed_files.\n" +
 		"error_type must be one of: none,compile,test,dependency,runtime,policy.\n" +
 		"failed_files must be an array of file path strings (or empty array).\n" +
 		"If exit_code is 0, set error_type to none and keep summary concise.\n" +
+		"When stderr_tail is present, prefer it when choosing primary_error.\n" +
 		"Do not include markdown.\n\n" +
 		"command: " + command + "\n" +
 		"exit_code: " + strconv.Itoa(exitCode) + "\n" +
 		"output_tail:\n" + outputTail + "\n"
+	if strings.TrimSpace(stderrTail) != "" {
+		prompt += "stderr_tail:\n" + stderrTail + "\n"
+	}
+	return prompt
 }
 
 func parseOllamaSummaryJSON(text string) (parsedSummary, bool) {
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/BegaDeveloper/smartsh/internal/security"
+	"gopkg.in/yaml.v3"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+const taskCatalogFile = ".smartsh-tasks.yaml"
+
+var taskArgPlaceholder = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_-]*)\s*\}\}`)
+
+// taskCatalog is a project's .smartsh-tasks.yaml: vetted commands that agents
+// run by name through /run {"task": ...} instead of composing shell.
+type taskCatalog struct {
+	Version int                    `yaml:"version"`
+	Tasks   map[string]projectTask `yaml:"tasks"`
+}
+
+type projectTask struct {
+	Description string             `yaml:"description" json:"description,omitempty"`
+	Command     string             `yaml:"command" json:"command,omitempty"`
+	Argv        []string           `yaml:"argv" json:"argv,omitempty"`
+	Cwd         string             `yaml:"cwd" json:"cwd,omitempty"`
+	Env         map[string]string  `yaml:"env" json:"env,omitempty"`
+	TimeoutSec  int                `yaml:"timeout_sec" json:"timeout_sec,omitempty"`
+	Sandbox     string             `yaml:"sandbox" json:"sandbox,omitempty"`
+	Shell       string             `yaml:"shell" json:"shell,omitempty"`
+	Parser      string             `yaml:"parser" json:"parser,omitempty"`
+	Args        map[string]taskArg `yaml:"args" json:"args,omitempty"`
+	// Trusted tasks skip the risk-approval flow. Blocked commands, the
+	// allowlist and .smartsh-policy.yaml still apply.
+	Trusted bool `yaml:"trusted" json:"trusted,omitempty"`
+}
+
+// taskArg declares a {{name}} placeholder. Values must match Pattern in
+// full when one is given.
+type taskArg struct {
+	Description string `yaml:"description" json:"description,omitempty"`
+	Default     string `yaml:"default" json:"default,omitempty"`
+	Required    bool   `yaml:"required" json:"required,omitempty"`
+	Pattern     string `yaml:"pattern" json:"pattern,omitempty"`
+}
+
+type taskListing struct {
+	projectTask
+	Name string `json:"name"`
+}
+
+func findTaskFile(cwd string) string {
+	return findProjectFile(cwd, taskCatalogFile)
+}
+
+// loadTaskCatalog returns the catalog found from cwd and its path, or a nil
+// catalog when there is none.
+func loadTaskCatalog(cwd string) (*taskCatalog, string, error) {
+	path := findTaskFile(cwd)
+	if path == "" {
+		return nil, "", nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, path, err
+	}
+	catalog := taskCatalog{}
+	if err := yaml.Unmarshal(raw, &catalog); err != nil {
+		return nil, path, fmt.Errorf("invalid %s: %w", taskCatalogFile, err)
+	}
+	for name, task := range catalog.Tasks {
+		if strings.TrimSpace(task.Command) == "" && len(task.Argv) == 0 {
+			return nil, path, fmt.Errorf("invalid %s: task %q needs command or argv", taskCatalogFile, name)
+		}
+		if strings.TrimSpace(task.Command) != "" && len(task.Argv) > 0 {
+			return nil, path, fmt.Errorf("invalid %s: task %q sets both command and argv", taskCatalogFile, name)
+		}
+		if err := checkTaskPlaceholders(task.Command, task.Shell); err != nil {
+			return nil, path, fmt.Errorf("invalid %s: task %q %w", taskCatalogFile, name, err)
+		}
+		if err := checkTaskArgvPlaceholders(task.Argv); err != nil {
+			return nil, path, fmt.Errorf("invalid %s: task %q %w", taskCatalogFile, name, err)
+		}
+	}
+	return &catalog, path, nil
+}
+
+// taskArgSentinel stands in for placeholders while a command is parsed.
+const taskArgSentinel = "__smartsh_task_arg__"
+
+// checkTaskPlaceholders makes sure every {{name}} in a command task stands
+// unquoted in a command word, assignment or redirect target, where the
+// single-quoted value is inert. Inside double quotes, a here-document or a
+// ${...} expansion those quotes are literal text and the shell would still
+// expand $(...) in the value, so such placeholders are rejected when the
+// catalog loads. The quoting is POSIX, so other shells need argv tasks.
+func checkTaskPlaceholders(command string, shell string) error {
+	count := 0
+	marked := taskArgPlaceholder.ReplaceAllStringFunc(command, func(string) string {
+		count++
+		return taskArgSentinel
+	})
+	if count == 0 {
+		return nil
+	}
+	if fields := strings.Fields(shell); len(fields) > 0 {
+		switch strings.ToLower(filepath.Base(fields[0])) {
+		case "sh", "bash", "zsh", "dash", "ksh", "mksh":
+		default:
+			return fmt.Errorf("uses {{...}} arguments in a %s command; use argv instead", fields[0])
+		}
+	}
+	file, err := syntax.NewParser().Parse(strings.NewReader(marked), "")
+	if err != nil {
+		return fmt.Errorf("command does not parse: %w", err)
+	}
+	bare := 0
+	syntax.Walk(file, func(node syntax.Node) bool {
+		var words []*syntax.Word
+		var assigns []*syntax.Assign
+		switch typedNode := node.(type) {
+		case *syntax.CallExpr:
+			words, assigns = typedNode.Args, typedNode.Assigns
+		case *syntax.DeclClause:
+			assigns = typedNode.Args
+		case *syntax.Redirect:
+			if typedNode.Hdoc == nil && typedNode.Word != nil {
+				words = []*syntax.Word{typedNode.Word}
+			}
+		}
+		for _, assign := range assigns {
+			if assign.Value != nil {
+				words = append(words, assign.Value)
+			}
+		}
+		for _, word := range words {
+			for _, part := range word.Parts {
+				if literal, ok := part.(*syntax.Lit); ok {
+					bare += strings.Count(literal.Value, taskArgSentinel)
+				}
+			}
+		}
+		return true
+	})
+	if bare != count {
+		return fmt.Errorf("puts a {{...}} argument inside quotes, a here-document or an expansion; write it as a bare word, e.g. echo {{msg}}")
+	}
+	return nil
+}
+
+// checkTaskArgvPlaceholders keeps {{name}} out of the script of an argv task
+// that launches a shell, where argv substitutes the value raw and the shell
+// would parse it as code. Such tasks pass values as positional parameters.
+func checkTaskArgvPlaceholders(argv []string) error {
+	script, launchesShell := security.ShellScriptFromArgv(argv)
+	if !launchesShell {
+		return nil
+	}
+	for _, word := range argv {
+		if taskArgPlaceholder.MatchString(word) && strings.Contains(script, word) {
+			return fmt.Errorf(`puts a {{...}} argument into a shell script; pass it as a positional parameter instead, e.g. ["bash", "-c", "make \"$1\"", "_", "{{target}}"]`)
+		}
+	}
+	return nil
+}
+
+// handleTasks serves GET /tasks?cwd=..., the catalog that applies to cwd.
+func (server *daemonServer) handleTasks(writer http.ResponseWriter, request *http.Request) {
+	if !server.authorize(request) {
+		writeJSON(writer, http.StatusUnauthorized, map[string]any{"must_use_smartsh": true, "error": "unauthorized"})
+		return
+	}
+	if request.Method != http.MethodGet {
+		writeJSON(writer, http.StatusMethodNotAllowed, map[string]any{"must_use_smartsh": true, "error": "method not allowed"})
+		return
+	}
+	cwd, err := resolveWorkingDirectory(request.URL.Query().Get("cwd"))
+	if err != nil {
+		writeJSON(writer, http.StatusBadRequest, map[string]any{"must_use_smartsh": true, "error": err.Error()})
+		return
+	}
+	catalog, path, err := loadTaskCatalog(cwd)
+	if err != nil {
+		writeJSON(writer, http.StatusBadRequest, map[string]any{"must_use_smartsh": true, "catalog": path, "error": err.Error()})
+		return
+	}
+	tasks := make([]taskListing, 0)
+	if catalog != nil {
+		for name, task := range catalog.Tasks {
+			tasks = append(tasks, taskListing{projectTask: task, Name: name})
+		}
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].Name < tasks[j].Name })
+	writeJSON(writer, http.StatusOK, map[string]any{"must_use_smartsh": true, "catalog": path, "tasks": tasks})
+}
+
+// resolveTaskRequest replaces request.Task with the task's command or argv,
+// filled in with task_args, and its settings. The task's env wins over the
+// request's, and its cwd is relative to the catalog. Timeout, sandbox and
+// shell come from the task unless the request sets them. The second result
+// reports whether the task is trusted.
+func resolveTaskRequest(request runRequest) (runRequest, bool, error) {
+	name := strings.TrimSpace(request.Task)
+	if strings.TrimSpace(request.Command) != "" || len(request.Argv) > 0 {
+		return request, false, fmt.Errorf("task cannot be combined with command or argv")
+	}
+	cwd, err := resolveWorkingDirectory(request.Cwd)
+	if err != nil {
+		return request, false, err
+	}
+	catalog, path, err := loadTaskCatalog(cwd)
+	if err != nil {
+		return request, false, err
+	}
+	if catalog == nil {
+		return request, false, fmt.Errorf("no %s found from %s", taskCatalogFile, cwd)
+	}
+	task, exists := catalog.Tasks[name]
+	if !exists {
+		names := make([]string, 0, len(catalog.Tasks))
+		for taskName := range catalog.Tasks {
+			names = append(names, taskName)
+		}
+		sort.Strings(names)
+		return request, false, fmt.Errorf("unknown task %q in %s (available: %s)", name, path, strings.Join(names, ", "))
+	}
+
+	values, err := resolveTaskArgs(name, task.Args, request.TaskArgs)
+	if err != nil {
+		return request, false, err
+	}
+	var substituteError error
+	substitute := func(text string, quote bool) string {
+		return taskArgPlaceholder.ReplaceAllStringFunc(text, func(placeholder string) string {
+			argName := taskArgPlaceholder.FindStringSubmatch(placeholder)[1]
+			value, declared := values[argName]
+			if !declared {
+				substituteError = fmt.Errorf("task %q uses undeclared argument {{%s}}", name, argName)
+				return placeholder
+			}
+			if quote {
+				return security.QuoteArgv([]string{value})
+			}
+			return value
+		})
+	}
+	if len(task.Argv) > 0 {
+		request.Argv = make([]string, 0, len(task.Argv))
+		for _, word := range task.Argv {
+			request.Argv = append(request.Argv, substitute(word, false))
+		}
+	} else {
+		request.Command = substitute(task.Command, true)
+	}
+	if substituteError != nil {
+		return request, false, substituteError
+	}
+
+	request.Cwd = filepath.Dir(path)
+	if task.Cwd != "" {
+		if filepath.IsAbs(task.Cwd) {
+			request.Cwd = task.Cwd
+		} else {
+			request.Cwd = filepath.Join(filepath.Dir(path), task.Cwd)
+		}
+	}
+	if len(task.Env) > 0 {
+		env := make(map[string]string, len(request.Env)+len(task.Env))
+		for key, value := range request.Env {
+			env[key] = value
+		}
+		for key, value := range task.Env {
+			env[key] = value
+		}
+		request.Env = env
+	}
+	if request.TimeoutSec <= 0 {
+		request.TimeoutSec = task.TimeoutSec
+	}
+	if strings.TrimSpace(request.Sandbox) == "" {
+		request.Sandbox = task.Sandbox
+	}
+	if strings.TrimSpace(request.Shell) == "" {
+		request.Shell = task.Shell
+	}
+	if strings.TrimSpace(request.Parser) == "" {
+		request.Parser = task.Parser
+	}
+	return request, task.Trusted, nil
+}
+
+func resolveTaskArgs(taskName string, declared map[string]taskArg, given map[string]string) (map[string]string, error) {
+	for argName := range given {
+		if _, exists := declared[argName]; !exists {
+			return nil, fmt.Errorf("task %q has no argument %q", taskName, argName)
+		}
+	}
+	values := make(map[string]string, len(declared))
+	for argName, spec := range declared {
+		value, exists := given[argName]
+		if !exists {
+			value = spec.Default
+		}
+		if spec.Required && value == "" {
+			return nil, fmt.Errorf("task %q requires argument %q", taskName, argName)
+		}
+		if spec.Pattern != "" && value != "" {
+			pattern, err := regexp.Compile(`^(?:` + spec.Pattern + `)$`)
+			if err != nil {
+				return nil, fmt.Errorf("task %q argument %q has an invalid pattern: %w", taskName, argName, err)
+			}
+			if !pattern.MatchString(value) {
+				return nil, fmt.Errorf("task %q argument %q must match %s", taskName, argName, spec.Pattern)
+			}
+		}
+		values[argName] = value
+	}
+	return values, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+const (
+	terminationExited    = "exited"
+	terminationSignaled  = "signaled"
+	terminationTimeout   = "timeout"
+	terminationCancelled = "cancelled"
+	terminationOOM       = "oom"
+)
+
+// termination says why a command stopped: it exited on its own, died from a
+// signal, was killed by smartshd on timeout or cancellation, or was killed by
+// the OOM killer in its cgroup.
+type termination struct {
+	Reason     string `json:"reason"`
+	Signal     string `json:"signal,omitempty"`
+	TimeoutSec int    `json:"timeout_sec,omitempty"`
+}
+
+// terminationError replaces the bare wait error of a command that did not
+// exit on its own, so the summary can name the cause.
+type terminationError struct {
+	termination termination
+	err         error
+}
+
+func (err *terminationError) Error() string {
+	if err.termination.Reason == terminationTimeout {
+		return "command timed out: " + err.termination.describe()
+	}
+	return "command " + err.termination.describe()
+}
+
+func (err *terminationError) Unwrap() error {
+	return err.err
+}
+
+func (value termination) describe() string {
+	suffix := ""
+	if value.Signal != "" {
+		suffix = " (" + value.Signal + ")"
+	}
+	switch value.Reason {
+	case terminationTimeout:
+		if value.TimeoutSec > 0 {
+			return fmt.Sprintf("killed by timeout after %ds%s", value.TimeoutSec, suffix)
+		}
+		return "killed by timeout" + suffix
+	case terminationOOM:
+		return "killed by the OOM killer" + suffix
+	case terminationSignaled:
+		return "killed by signal " + value.Signal
+	case terminationCancelled:
+		return "cancelled" + suffix
+	default:
+		return "exited"
+	}
+}
+
+// describeTermination works out the reason from the command's own context,
+// the signal in its wait status, the last signal smartshd sent its group and
+// the cgroup OOM counter.
+func describeTermination(runContext context.Context, runError error, kernelSignal string, sentSignal string, cgroup *cgroupUsage) termination {
+	signal := firstNonEmpty(kernelSignal, sentSignal)
+	switch {
+	case runError == nil:
+		return termination{Reason: terminationExited}
+	case errors.Is(runContext.Err(), context.DeadlineExceeded):
+		return termination{Reason: terminationTimeout, Signal: signal}
+	case runContext.Err() != nil:
+		return termination{Reason: terminationCancelled, Signal: signal}
+	case cgroup != nil && cgroup.OOMKills > 0:
+		return termination{Reason: terminationOOM, Signal: signal}
+	case kernelSignal != "":
+		return termination{Reason: terminationSignaled, Signal: kernelSignal}
+	default:
+		return termination{Reason: terminationExited}
+	}
+}
+
+// applyTerminationSummary makes timeouts, OOM kills and crashes the headline
+// of a failure summary instead of whatever the truncated output suggests.
+func applyTerminationSummary(summary *parsedSummary, runErr error) {
+	var terminated *terminationError
+	if !errors.As(runErr, &terminated) {
+		return
+	}
+	description := terminated.termination.describe()
+	switch terminated.termination.Reason {
+	case terminationTimeout:
+		summary.ErrorType = "timeout"
+		summary.PrimaryError = description
+		summary.NextAction = "Raise timeout_sec, narrow the command, or run it with async=true."
+	case terminationOOM:
+		summary.ErrorType = "oom"
+		summary.PrimaryError = description
+		summary.NextAction = "Raise max_memory_mb or reduce the command's parallelism."
+	case terminationSignaled:
+		if summary.PrimaryError == "" {
+			summary.PrimaryError = description
+		}
+		if terminated.termination.Signal == "SIGKILL" && summary.NextAction == "" {
+			summary.NextAction = "An unexpected SIGKILL is usually the system OOM killer; check memory use."
+		}
+	default:
+		return
+	}
+	summary.Summary = "command " + description
+	if summary.PrimaryError != description {
+		summary.Summary += ": " + summary.PrimaryError
+	}
+}
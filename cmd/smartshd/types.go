@@ -4,6 +4,12 @@ import "time"
 
 type runRequest struct {
 	Command              string            `json:"command,omitempty"`
+	Argv                 []string          `json:"argv,omitempty"`
+	Shell                string            `json:"shell,omitempty"`
+	SessionID            string            `json:"session_id,omitempty"`
+	Task                 string            `json:"task,omitempty"`
+	TaskArgs             map[string]string `json:"task_args,omitempty"`
+	Parser               string            `json:"parser,omitempty"`
 	Cwd                  string            `json:"cwd,omitempty"`
 	OpenExternalTerminal bool              `json:"open_external_terminal,omitempty"`
 	TerminalApp          string            `json:"terminal_app,omitempty"`
@@ -12,50 +18,178 @@ type runRequest struct {
 	RequireApproval      bool              `json:"require_approval,omitempty"`
 	DryRun               bool              `json:"dry_run,omitempty"`
 	Async                bool              `json:"async,omitempty"`
+	Priority             string            `json:"priority,omitempty"`
+	ResumeOnRestart      bool              `json:"resume_on_restart,omitempty"`
 	TimeoutSec           int               `json:"timeout_sec,omitempty"`
 	AllowlistMode        string            `json:"allowlist_mode,omitempty"`
 	AllowlistFile        string            `json:"allowlist_file,omitempty"`
 	Isolated             bool              `json:"isolated,omitempty"`
 	MaxOutputKB          int               `json:"max_output_kb,omitempty"`
+	OutputHeadKB         int               `json:"output_head_kb,omitempty"`
 	MaxMemoryMB          int               `json:"max_memory_mb,omitempty"`
 	MaxCPUSeconds        int               `json:"max_cpu_seconds,omitempty"`
+	MaxCPUPercent        int               `json:"max_cpu_percent,omitempty"`
+	MaxPids              int               `json:"max_pids,omitempty"`
+	Sandbox              string            `json:"sandbox,omitempty"`
+	Retry                *retryPolicy      `json:"retry,omitempty"`
+	Stdin                string            `json:"stdin,omitempty"`
+	Cache                bool              `json:"cache,omitempty"`
+	CacheInputs          []string          `json:"cache_inputs,omitempty"`
 	AllowedEnv           []string          `json:"allowed_env,omitempty"`
 	Env                  map[string]string `json:"env,omitempty"`
 }
 
 type runResponse struct {
-	MustUseSmartsh   bool     `json:"must_use_smartsh"`
-	JobID            string   `json:"job_id,omitempty"`
-	Status           string   `json:"status,omitempty"`
-	Executed         bool     `json:"executed"`
-	ResolvedCommand  string   `json:"resolved_command,omitempty"`
-	ExitCode         int      `json:"exit_code"`
-	Summary          string   `json:"summary,omitempty"`
-	SummarySource    string   `json:"summary_source,omitempty"`
-	ErrorType        string   `json:"error_type,omitempty"`
-	PrimaryError     string   `json:"primary_error,omitempty"`
-	NextAction       string   `json:"next_action,omitempty"`
-	FailingTests     []string `json:"failing_tests,omitempty"`
-	FailedFiles      []string `json:"failed_files,omitempty"`
-	TopIssues        []string `json:"top_issues,omitempty"`
-	BlockedReason    string   `json:"blocked_reason,omitempty"`
-	RequiresApproval bool     `json:"requires_approval,omitempty"`
-	ApprovalID       string   `json:"approval_id,omitempty"`
-	ApprovalMessage  string   `json:"approval_message,omitempty"`
-	ApprovalHowTo    string   `json:"approval_howto,omitempty"`
-	RiskReason       string   `json:"risk_reason,omitempty"`
-	RiskTargets      []string `json:"risk_targets,omitempty"`
-	Error            string   `json:"error,omitempty"`
-	DurationMS       int64    `json:"duration_ms,omitempty"`
-	OutputTail       string   `json:"output_tail,omitempty"`
+	MustUseSmartsh   bool           `json:"must_use_smartsh"`
+	JobID            string         `json:"job_id,omitempty"`
+	Status           string         `json:"status,omitempty"`
+	QueuePosition    int            `json:"queue_position,omitempty"`
+	EstimatedWaitMS  int64          `json:"estimated_wait_ms,omitempty"`
+	Executed         bool           `json:"executed"`
+	ResolvedCommand  string         `json:"resolved_command,omitempty"`
+	ExitCode         int            `json:"exit_code"`
+	Summary          string         `json:"summary,omitempty"`
+	SummarySource    string         `json:"summary_source,omitempty"`
+	ErrorType        string         `json:"error_type,omitempty"`
+	PrimaryError     string         `json:"primary_error,omitempty"`
+	NextAction       string         `json:"next_action,omitempty"`
+	FailingTests     []string       `json:"failing_tests,omitempty"`
+	FailedFiles      []string       `json:"failed_files,omitempty"`
+	TopIssues        []string       `json:"top_issues,omitempty"`
+	BlockedReason    string         `json:"blocked_reason,omitempty"`
+	RequiresApproval bool           `json:"requires_approval,omitempty"`
+	ApprovalID       string         `json:"approval_id,omitempty"`
+	ApprovalMessage  string         `json:"approval_message,omitempty"`
+	ApprovalHowTo    string         `json:"approval_howto,omitempty"`
+	RiskReason       string         `json:"risk_reason,omitempty"`
+	RiskTargets      []string       `json:"risk_targets,omitempty"`
+	Error            string         `json:"error,omitempty"`
+	DurationMS       int64          `json:"duration_ms,omitempty"`
+	OutputTail       string         `json:"output_tail,omitempty"`
+	StderrTail       string         `json:"stderr_tail,omitempty"`
+	OmittedLines     int64          `json:"omitted_lines,omitempty"`
+	OmittedBytes     int64          `json:"omitted_bytes,omitempty"`
+	Signal           string         `json:"signal,omitempty"`
+	Termination      *termination   `json:"termination,omitempty"`
+	Shell            string         `json:"shell,omitempty"`
+	SessionID        string         `json:"session_id,omitempty"`
+	SessionCwd       string         `json:"session_cwd,omitempty"`
+	Task             string         `json:"task,omitempty"`
+	Cgroup           *cgroupUsage   `json:"cgroup,omitempty"`
+	Usage            *resourceUsage `json:"usage,omitempty"`
+	Sandbox          string         `json:"sandbox,omitempty"`
+	SandboxViolation string         `json:"sandbox_violation,omitempty"`
+	SandboxRequested string         `json:"sandbox_requested,omitempty"`
+	Attempts         []runAttempt   `json:"attempts,omitempty"`
+	Flaky            bool           `json:"flaky,omitempty"`
+	CacheHit         bool           `json:"cache_hit,omitempty"`
+	CacheAgeSec      int64          `json:"cache_age_sec,omitempty"`
+	ChangedFiles     []changedFile  `json:"changed_files,omitempty"`
+	ChangedOmitted   int            `json:"changed_files_omitted,omitempty"`
+	Diffstat         string         `json:"diffstat,omitempty"`
+	InputPrompt      string         `json:"input_prompt,omitempty"`
+
+	// outputChunks carries the timestamped per-stream capture from
+	// executeRequest to the stored job; it is not part of the API response.
+	outputChunks []outputChunk
+}
+
+// changedFile is one path the command added, modified or deleted inside its
+// git work tree, with insertions and deletions as in git diff --numstat.
+type changedFile struct {
+	Path       string `json:"path"`
+	Change     string `json:"change"`
+	Insertions int    `json:"insertions,omitempty"`
+	Deletions  int    `json:"deletions,omitempty"`
+	Binary     bool   `json:"binary,omitempty"`
+}
+
+type retryPolicy struct {
+	MaxAttempts int      `json:"max_attempts"`
+	BackoffSec  int      `json:"backoff_sec,omitempty"`
+	RetryOn     []string `json:"retry_on,omitempty"`
+}
+
+type runAttempt struct {
+	Attempt    int    `json:"attempt"`
+	Status     string `json:"status"`
+	ExitCode   int    `json:"exit_code"`
+	ErrorType  string `json:"error_type,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+type batchRequest struct {
+	Steps           []runRequest      `json:"steps"`
+	Mode            string            `json:"mode,omitempty"`
+	MaxParallel     int               `json:"max_parallel,omitempty"`
+	Command         string            `json:"command,omitempty"`
+	Cwds            []string          `json:"cwds,omitempty"`
+	Cwd             string            `json:"cwd,omitempty"`
+	TimeoutSec      int               `json:"timeout_sec,omitempty"`
+	Env             map[string]string `json:"env,omitempty"`
+	Unsafe          bool              `json:"unsafe,omitempty"`
+	RequireApproval bool              `json:"require_approval,omitempty"`
+	AllowlistMode   string            `json:"allowlist_mode,omitempty"`
+	AllowlistFile   string            `json:"allowlist_file,omitempty"`
+	Sandbox         string            `json:"sandbox,omitempty"`
+	Priority        string            `json:"priority,omitempty"`
+}
+
+type batchStepResult struct {
+	Step int `json:"step"`
+	runResponse
+	cwd string
+}
+
+// batchFailureGroup is the parsed summary of one sub-run that did not
+// complete, keyed by a label naming the sub-run.
+type batchFailureGroup struct {
+	Step         int      `json:"step"`
+	Label        string   `json:"label"`
+	Status       string   `json:"status"`
+	ErrorType    string   `json:"error_type,omitempty"`
+	PrimaryError string   `json:"primary_error,omitempty"`
+	FailingTests []string `json:"failing_tests,omitempty"`
+	FailedFiles  []string `json:"failed_files,omitempty"`
+}
+
+type batchResponse struct {
+	MustUseSmartsh bool                `json:"must_use_smartsh"`
+	Status         string              `json:"status"`
+	Mode           string              `json:"mode"`
+	Summary        string              `json:"summary"`
+	FailedStep     int                 `json:"failed_step,omitempty"`
+	FailingTests   []string            `json:"failing_tests,omitempty"`
+	FailedFiles    []string            `json:"failed_files,omitempty"`
+	Failures       []batchFailureGroup `json:"failures,omitempty"`
+	Steps          []batchStepResult   `json:"steps"`
+	DurationMS     int64               `json:"duration_ms"`
+	Error          string              `json:"error,omitempty"`
 }
 
 type daemonJob struct {
-	ID        string      `json:"id"`
-	Request   runRequest  `json:"request"`
-	Result    runResponse `json:"result"`
-	CreatedAt time.Time   `json:"created_at"`
-	UpdatedAt time.Time   `json:"updated_at"`
+	ID           string        `json:"id"`
+	Request      runRequest    `json:"request"`
+	Result       runResponse   `json:"result"`
+	OutputChunks []outputChunk `json:"-"`
+	ResumeCount  int           `json:"resume_count,omitempty"`
+	WatchID      string        `json:"watch_id,omitempty"`
+	CreatedAt    time.Time     `json:"created_at"`
+	UpdatedAt    time.Time     `json:"updated_at"`
+}
+
+type jobOutputChunk struct {
+	JobID  string `json:"job_id"`
+	Seq    int64  `json:"seq"`
+	Stream string `json:"stream"`
+	Data   string `json:"data"`
+}
+
+// jobEvent is delivered to job stream subscribers; exactly one of Status or
+// Output is meaningful, with Output set for incremental command output.
+type jobEvent struct {
+	Status runResponse
+	Output *jobOutputChunk
 }
 
 type commandApproval struct {
@@ -74,8 +208,24 @@ type commandApproval struct {
 type isolationOptions struct {
 	Isolated      bool
 	MaxOutputKB   int
+	OutputHeadKB  int
 	MaxMemoryMB   int
 	MaxCPUSeconds int
-	AllowedEnv    []string
-	Env           map[string]string
+	MaxCPUPercent int
+	MaxPids       int
+	Sandbox       string
+	WritablePaths []string
+	DeniedPaths   []string
+	Stdin         string
+	// Argv, when set, is executed directly instead of the command string,
+	// without a shell.
+	Argv []string
+	// Shell, when set, replaces the default sh -c or cmd /C: it is the
+	// interpreter and the arguments that precede the command string.
+	Shell []string
+	// SessionStateFile, when set, makes the shell record its final cwd and
+	// environment there for a shell session.
+	SessionStateFile string
+	AllowedEnv       []string
+	Env              map[string]string
 }
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWatchDebounceMS = 300
+	defaultWatchPollMS     = 500
+	defaultMaxWatches      = 8
+	maxWatchedFiles        = 20000
+)
+
+type watchRequest struct {
+	runRequest
+	Patterns   []string `json:"patterns"`
+	DebounceMS int      `json:"debounce_ms,omitempty"`
+	RunOnStart bool     `json:"run_on_start,omitempty"`
+}
+
+// watchSession reruns a command as a background job whenever a file matching
+// its patterns changes. Watches live in memory and stop with the daemon; the
+// jobs they start are stored like any other job, linked by watch_id.
+type watchSession struct {
+	ID          string
+	Request     watchRequest
+	Cwd         string
+	Status      string
+	RunCount    int
+	Pending     bool
+	LastTrigger []string
+	LastJobID   string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	ctx         context.Context
+	cancel      context.CancelFunc
+	mu          sync.Mutex
+}
+
+type watchStatus struct {
+	MustUseSmartsh bool         `json:"must_use_smartsh"`
+	WatchID        string       `json:"watch_id,omitempty"`
+	Status         string       `json:"status,omitempty"`
+	Command        string       `json:"command,omitempty"`
+	Cwd            string       `json:"cwd,omitempty"`
+	Patterns       []string     `json:"patterns,omitempty"`
+	RunCount       int          `json:"run_count"`
+	Pending        bool         `json:"pending,omitempty"`
+	LastTrigger    []string     `json:"last_trigger,omitempty"`
+	LastRun        *runResponse `json:"last_run,omitempty"`
+	CreatedAt      time.Time    `json:"created_at,omitempty"`
+	UpdatedAt      time.Time    `json:"updated_at,omitempty"`
+	Error          string       `json:"error,omitempty"`
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func (server *daemonServer) handleWatches(writer http.ResponseWriter, request *http.Request) {
+	if !server.authorize(request) {
+		writeJSON(writer, http.StatusUnauthorized, watchStatus{MustUseSmartsh: true, Error: "unauthorized"})
+		return
+	}
+	switch request.Method {
+	case http.MethodGet:
+		server.watchesMutex.Lock()
+		watches := make([]*watchSession, 0, len(server.watches))
+		for _, watch := range server.watches {
+			watches = append(watches, watch)
+		}
+		server.watchesMutex.Unlock()
+		sort.Slice(watches, func(i, j int) bool { return watches[i].CreatedAt.Before(watches[j].CreatedAt) })
+		statuses := make([]watchStatus, 0, len(watches))
+		for _, watch := range watches {
+			statuses = append(statuses, server.watchStatusOf(watch))
+		}
+		writeJSON(writer, http.StatusOK, map[string]any{"must_use_smartsh": true, "watches": statuses})
+	case http.MethodPost:
+		payload := watchRequest{}
+		if err := json.NewDecoder(request.Body).Decode(&payload); err != nil {
+			writeJSON(writer, http.StatusBadRequest, watchStatus{MustUseSmartsh: true, Error: fmt.Sprintf("invalid request body: %v", err)})
+			return
+		}
+		watch, statusCode, err := server.createWatch(request.Context(), payload)
+		if err != nil {
+			writeJSON(writer, statusCode, watchStatus{MustUseSmartsh: true, Error: err.Error()})
+			return
+		}
+		writeJSON(writer, statusCode, server.watchStatusOf(watch))
+	default:
+		writeJSON(writer, http.StatusMethodNotAllowed, watchStatus{MustUseSmartsh: true, Error: "method not allowed"})
+	}
+}
+
+func (server *daemonServer) handleWatchRoutes(writer http.ResponseWriter, request *http.Request) {
+	if !server.authorize(request) {
+		writeJSON(writer, http.StatusUnauthorized, watchStatus{MustUseSmartsh: true, Error: "unauthorized"})
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(request.URL.Path, "/watches/"), "/"), "/")
+	if len(parts) < 1 || parts[0] == "" {
+		writeJSON(writer, http.StatusBadRequest, watchStatus{MustUseSmartsh: true, Error: "watch id is required"})
+		return
+	}
+	server.watchesMutex.Lock()
+	watch := server.watches[parts[0]]
+	server.watchesMutex.Unlock()
+	if watch == nil {
+		writeJSON(writer, http.StatusNotFound, watchStatus{MustUseSmartsh: true, Error: "watch not found"})
+		return
+	}
+	if len(parts) > 1 && parts[1] == "stop" {
+		if request.Method != http.MethodPost {
+			writeJSON(writer, http.StatusMethodNotAllowed, watchStatus{MustUseSmartsh: true, Error: "method not allowed"})
+			return
+		}
+		server.stopWatch(watch)
+		writeJSON(writer, http.StatusOK, server.watchStatusOf(watch))
+		return
+	}
+	if request.Method != http.MethodGet {
+		writeJSON(writer, http.StatusMethodNotAllowed, watchStatus{MustUseSmartsh: true, Error: "method not allowed"})
+		return
+	}
+	writeJSON(writer, http.StatusOK, server.watchStatusOf(watch))
+}
+
+// createWatch validates the command up front, so that a watch never starts
+// for a command that policy blocks or that needs approval.
+func (server *daemonServer) createWatch(ctx context.Context, payload watchRequest) (*watchSession, int, error) {
+	if strings.TrimSpace(payload.Command) == "" {
+		return nil, http.StatusBadRequest, fmt.Errorf("command is required")
+	}
+	if len(payload.Patterns) == 0 {
+		return nil, http.StatusBadRequest, fmt.Errorf("patterns is required")
+	}
+	cwd, err := resolveWorkingDirectory(payload.Cwd)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	payload.Cwd = cwd
+	payload.Async = false
+	payload.OpenExternalTerminal = false
+	if payload.DebounceMS <= 0 {
+		payload.DebounceMS = defaultWatchDebounceMS
+	}
+	if _, err := parseJobPriority(payload.Priority, priorityBackground); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	baseline, err := scanWatchedFiles(cwd, payload.Patterns)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if _, err := server.validateBackgroundCommand(ctx, payload.runRequest); err != nil {
+		return nil, http.StatusUnprocessableEntity, fmt.Errorf("watch %w", err)
+	}
+
+	server.watchesMutex.Lock()
+	defer server.watchesMutex.Unlock()
+	active := 0
+	for _, existing := range server.watches {
+		existing.mu.Lock()
+		if existing.Status == "watching" {
+			active++
+		}
+		existing.mu.Unlock()
+	}
+	if active >= parsePositiveIntEnv("SMARTSH_MAX_WATCHES", defaultMaxWatches) {
+		return nil, http.StatusTooManyRequests, fmt.Errorf("too many active watches; stop one first")
+	}
+	watchContext, cancel := context.WithCancel(context.Background())
+	watch := &watchSession{
+		ID:        fmt.Sprintf("watch_%d", time.Now().UnixNano()),
+		Request:   payload,
+		Cwd:       cwd,
+		Status:    "watching",
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+		ctx:       watchContext,
+		cancel:    cancel,
+	}
+	server.watches[watch.ID] = watch
+	go server.runWatch(watch, baseline)
+	return watch, http.StatusCreated, nil
+}
+
+func (server *daemonServer) stopWatch(watch *watchSession) {
+	watch.mu.Lock()
+	watch.Status = "stopped"
+	watch.Pending = false
+	watch.UpdatedAt = time.Now()
+	lastJobID := watch.LastJobID
+	watch.mu.Unlock()
+	watch.cancel()
+	if lastJobID != "" {
+		server.cancelTrackedJob(lastJobID)
+	}
+}
+
+// runWatch polls the watched files and starts a run once changes have been
+// quiet for the debounce interval. Files that change while a run is in
+// progress trigger another run, except those the command writes itself: a
+// path that changes again during a run it alone triggered is taken as the
+// command's own output and is ignored in later runs.
+func (server *daemonServer) runWatch(watch *watchSession, previous map[string]fileStamp) {
+	pollInterval := time.Duration(parsePositiveIntEnv("SMARTSH_WATCH_POLL_MS", defaultWatchPollMS)) * time.Millisecond
+	debounce := time.Duration(watch.Request.DebounceMS) * time.Millisecond
+	changed := make([]string, 0)
+	lastChangeAt := time.Time{}
+	ownWrites := map[string]bool{}
+	changedDuringRun := make([]string, 0)
+	run := func(trigger []string) {
+		server.runWatchJob(watch, trigger)
+		current, err := scanWatchedFiles(watch.Cwd, watch.Request.Patterns)
+		if err != nil {
+			return
+		}
+		during := diffFileStamps(previous, current)
+		previous = current
+		if len(trigger) > 0 && containsAllStrings(changedDuringRun, trigger) {
+			for _, path := range during {
+				if containsString(trigger, path) {
+					ownWrites[path] = true
+				}
+			}
+		}
+		changedDuringRun = make([]string, 0)
+		for _, path := range during {
+			if !ownWrites[path] {
+				changedDuringRun = append(changedDuringRun, path)
+			}
+		}
+		if len(changedDuringRun) > 0 {
+			changed = appendUniqueStrings(changed, changedDuringRun...)
+			lastChangeAt = time.Now()
+			watch.mu.Lock()
+			watch.Pending = true
+			watch.mu.Unlock()
+		}
+	}
+	if watch.Request.RunOnStart {
+		run(nil)
+	}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-watch.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		current, err := scanWatchedFiles(watch.Cwd, watch.Request.Patterns)
+		if err != nil {
+			continue
+		}
+		if diff := diffFileStamps(previous, current); len(diff) > 0 {
+			changed = appendUniqueStrings(changed, diff...)
+			lastChangeAt = time.Now()
+			watch.mu.Lock()
+			watch.Pending = true
+			watch.mu.Unlock()
+		}
+		previous = current
+		if len(changed) == 0 || time.Since(lastChangeAt) < debounce {
+			continue
+		}
+		trigger := changed
+		changed = make([]string, 0)
+		run(trigger)
+	}
+}
+
+// runWatchJob records one run as a normal job linked to the watch and waits
+// for it to finish.
+func (server *daemonServer) runWatchJob(watch *watchSession, trigger []string) {
+	if watch.ctx.Err() != nil {
+		return
+	}
+	priority, _ := parseJobPriority(watch.Request.Priority, priorityBackground)
+	job := daemonJob{
+		ID:        fmt.Sprintf("job_%d", time.Now().UnixNano()),
+		Request:   watch.Request.runRequest,
+		WatchID:   watch.ID,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+		Result: runResponse{
+			MustUseSmartsh: true,
+			Status:         "queued",
+			Summary:        "job accepted",
+		},
+	}
+	job.Result.JobID = job.ID
+	watch.mu.Lock()
+	watch.RunCount++
+	watch.Pending = false
+	watch.LastTrigger = trigger
+	watch.LastJobID = job.ID
+	watch.UpdatedAt = time.Now()
+	watch.mu.Unlock()
+
+	jobContext := server.trackJob(job.ID)
+	ticket := server.scheduler.enqueue(job.ID, resolveWorkspaceKey(watch.Cwd), priority)
+	_ = server.store.Save(job)
+	server.executeJob(jobContext, job.ID, ticket)
+}
+
+func (server *daemonServer) watchStatusOf(watch *watchSession) watchStatus {
+	watch.mu.Lock()
+	status := watchStatus{
+		MustUseSmartsh: true,
+		WatchID:        watch.ID,
+		Status:         watch.Status,
+		Command:        watch.Request.Command,
+		Cwd:            watch.Cwd,
+		Patterns:       watch.Request.Patterns,
+		RunCount:       watch.RunCount,
+		Pending:        watch.Pending,
+		LastTrigger:    watch.LastTrigger,
+		CreatedAt:      watch.CreatedAt,
+		UpdatedAt:      watch.UpdatedAt,
+	}
+	lastJobID := watch.LastJobID
+	watch.mu.Unlock()
+	if lastJobID != "" {
+		if job, err := server.store.Get(lastJobID); err == nil && job != nil {
+			lastRun := job.Result
+			status.LastRun = &lastRun
+		}
+	}
+	return status
+}
+
+func scanWatchedFiles(cwd string, patterns []string) (map[string]fileStamp, error) {
+	stamps := map[string]fileStamp{}
+	for _, pattern := range patterns {
+		matches, err := expandCacheInputGlob(cwd, pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			info, statErr := os.Stat(match)
+			if statErr != nil || info.IsDir() {
+				continue
+			}
+			stamps[match] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+			if len(stamps) > maxWatchedFiles {
+				return nil, fmt.Errorf("patterns match more than %d files", maxWatchedFiles)
+			}
+		}
+	}
+	return stamps, nil
+}
+
+func diffFileStamps(previous map[string]fileStamp, current map[string]fileStamp) []string {
+	changed := make([]string, 0)
+	for path, stamp := range current {
+		if old, exists := previous[path]; !exists || !old.modTime.Equal(stamp.modTime) || old.size != stamp.size {
+			changed = append(changed, path)
+		}
+	}
+	for path := range previous {
+		if _, exists := current[path]; !exists {
+			changed = append(changed, path)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func appendUniqueStrings(values []string, additions ...string) []string {
+	for _, addition := range additions {
+		if !containsString(values, addition) {
+			values = append(values, addition)
+		}
+	}
+	return values
+}
+
+func containsAllStrings(values []string, wanted []string) bool {
+	for _, value := range wanted {
+		if !containsString(values, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if strings.TrimSpace(value) != "" {
+			return value
+		}
+	}
+	return ""
+}
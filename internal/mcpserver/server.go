@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -55,30 +56,137 @@ type initializeParams struct {
 }
 
 type daemonRunResponse struct {
-	MustUseSmartsh   bool     `json:"must_use_smartsh"`
-	JobID            string   `json:"job_id,omitempty"`
-	Status           string   `json:"status,omitempty"`
-	Executed         bool     `json:"executed"`
-	ResolvedCommand  string   `json:"resolved_command,omitempty"`
-	ExitCode         int      `json:"exit_code"`
-	Summary          string   `json:"summary,omitempty"`
-	SummarySource    string   `json:"summary_source,omitempty"`
-	ErrorType        string   `json:"error_type,omitempty"`
-	PrimaryError     string   `json:"primary_error,omitempty"`
-	NextAction       string   `json:"next_action,omitempty"`
-	FailingTests     []string `json:"failing_tests,omitempty"`
-	FailedFiles      []string `json:"failed_files,omitempty"`
-	TopIssues        []string `json:"top_issues,omitempty"`
-	BlockedReason    string   `json:"blocked_reason,omitempty"`
-	RequiresApproval bool     `json:"requires_approval,omitempty"`
-	ApprovalID       string   `json:"approval_id,omitempty"`
-	ApprovalMessage  string   `json:"approval_message,omitempty"`
-	ApprovalHowTo    string   `json:"approval_howto,omitempty"`
-	RiskReason       string   `json:"risk_reason,omitempty"`
-	RiskTargets      []string `json:"risk_targets,omitempty"`
-	Error            string   `json:"error,omitempty"`
-	DurationMS       int64    `json:"duration_ms,omitempty"`
-	OutputTail       string   `json:"output_tail,omitempty"`
+	MustUseSmartsh   bool                 `json:"must_use_smartsh"`
+	JobID            string               `json:"job_id,omitempty"`
+	Status           string               `json:"status,omitempty"`
+	QueuePosition    int                  `json:"queue_position,omitempty"`
+	EstimatedWaitMS  int64                `json:"estimated_wait_ms,omitempty"`
+	Executed         bool                 `json:"executed"`
+	ResolvedCommand  string               `json:"resolved_command,omitempty"`
+	ExitCode         int                  `json:"exit_code"`
+	Summary          string               `json:"summary,omitempty"`
+	SummarySource    string               `json:"summary_source,omitempty"`
+	ErrorType        string               `json:"error_type,omitempty"`
+	PrimaryError     string               `json:"primary_error,omitempty"`
+	NextAction       string               `json:"next_action,omitempty"`
+	FailingTests     []string             `json:"failing_tests,omitempty"`
+	FailedFiles      []string             `json:"failed_files,omitempty"`
+	TopIssues        []string             `json:"top_issues,omitempty"`
+	BlockedReason    string               `json:"blocked_reason,omitempty"`
+	RequiresApproval bool                 `json:"requires_approval,omitempty"`
+	ApprovalID       string               `json:"approval_id,omitempty"`
+	ApprovalMessage  string               `json:"approval_message,omitempty"`
+	ApprovalHowTo    string               `json:"approval_howto,omitempty"`
+	RiskReason       string               `json:"risk_reason,omitempty"`
+	RiskTargets      []string             `json:"risk_targets,omitempty"`
+	Error            string               `json:"error,omitempty"`
+	DurationMS       int64                `json:"duration_ms,omitempty"`
+	OutputTail       string               `json:"output_tail,omitempty"`
+	StderrTail       string               `json:"stderr_tail,omitempty"`
+	OmittedLines     int64                `json:"omitted_lines,omitempty"`
+	OmittedBytes     int64                `json:"omitted_bytes,omitempty"`
+	Signal           string               `json:"signal,omitempty"`
+	Termination      *daemonTermination   `json:"termination,omitempty"`
+	Sandbox          string               `json:"sandbox,omitempty"`
+	SandboxViolation string               `json:"sandbox_violation,omitempty"`
+	Attempts         []daemonRunAttempt   `json:"attempts,omitempty"`
+	Flaky            bool                 `json:"flaky,omitempty"`
+	CacheHit         bool                 `json:"cache_hit,omitempty"`
+	CacheAgeSec      int64                `json:"cache_age_sec,omitempty"`
+	ChangedFiles     []daemonChangedFile  `json:"changed_files,omitempty"`
+	ChangedOmitted   int                  `json:"changed_files_omitted,omitempty"`
+	Diffstat         string               `json:"diffstat,omitempty"`
+	InputPrompt      string               `json:"input_prompt,omitempty"`
+	Usage            *daemonResourceUsage `json:"usage,omitempty"`
+}
+
+type daemonTermination struct {
+	Reason     string `json:"reason"`
+	Signal     string `json:"signal,omitempty"`
+	TimeoutSec int    `json:"timeout_sec,omitempty"`
+}
+
+type daemonResourceUsage struct {
+	WallMS       int64 `json:"wall_ms"`
+	UserCPUMS    int64 `json:"user_cpu_ms"`
+	SystemCPUMS  int64 `json:"system_cpu_ms"`
+	PeakRSSBytes int64 `json:"peak_rss_bytes,omitempty"`
+	OutputBytes  int64 `json:"output_bytes"`
+}
+
+type daemonChangedFile struct {
+	Path       string `json:"path"`
+	Change     string `json:"change"`
+	Insertions int    `json:"insertions,omitempty"`
+	Deletions  int    `json:"deletions,omitempty"`
+	Binary     bool   `json:"binary,omitempty"`
+}
+
+type daemonRunAttempt struct {
+	Attempt    int    `json:"attempt"`
+	Status     string `json:"status"`
+	ExitCode   int    `json:"exit_code"`
+	ErrorType  string `json:"error_type,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+type daemonBatchStepResult struct {
+	Step int `json:"step"`
+	daemonRunResponse
+}
+
+type daemonBatchFailureGroup struct {
+	Step         int      `json:"step"`
+	Label        string   `json:"label"`
+	Status       string   `json:"status"`
+	ErrorType    string   `json:"error_type,omitempty"`
+	PrimaryError string   `json:"primary_error,omitempty"`
+	FailingTests []string `json:"failing_tests,omitempty"`
+	FailedFiles  []string `json:"failed_files,omitempty"`
+}
+
+type daemonBatchResponse struct {
+	MustUseSmartsh bool                      `json:"must_use_smartsh"`
+	Status         string                    `json:"status"`
+	Mode           string                    `json:"mode"`
+	Summary        string                    `json:"summary"`
+	FailedStep     int                       `json:"failed_step,omitempty"`
+	FailingTests   []string                  `json:"failing_tests,omitempty"`
+	FailedFiles    []string                  `json:"failed_files,omitempty"`
+	Failures       []daemonBatchFailureGroup `json:"failures,omitempty"`
+	Steps          []daemonBatchStepResult   `json:"steps"`
+	DurationMS     int64                     `json:"duration_ms"`
+	Error          string                    `json:"error,omitempty"`
+}
+
+type daemonWatchStatus struct {
+	MustUseSmartsh bool               `json:"must_use_smartsh"`
+	WatchID        string             `json:"watch_id,omitempty"`
+	Status         string             `json:"status,omitempty"`
+	Command        string             `json:"command,omitempty"`
+	RunCount       int                `json:"run_count"`
+	Pending        bool               `json:"pending,omitempty"`
+	LastTrigger    []string           `json:"last_trigger,omitempty"`
+	LastRun        *daemonRunResponse `json:"last_run,omitempty"`
+	Error          string             `json:"error,omitempty"`
+}
+
+type daemonJobOutputLine struct {
+	Line int    `json:"line"`
+	Text string `json:"text"`
+}
+
+type daemonJobOutputPage struct {
+	MustUseSmartsh bool                  `json:"must_use_smartsh"`
+	JobID          string                `json:"job_id"`
+	Offset         int                   `json:"offset"`
+	Limit          int                   `json:"limit"`
+	Grep           string                `json:"grep,omitempty"`
+	TotalLines     int                   `json:"total_lines"`
+	HasMore        bool                  `json:"has_more"`
+	NextOffset     int                   `json:"next_offset,omitempty"`
+	Lines          []daemonJobOutputLine `json:"lines"`
+	Error          string                `json:"error,omitempty"`
 }
 
 type mcpServer struct {
@@ -188,8 +296,25 @@ func (server *mcpServer) handleRequest(request rpcRequest) rpcResponse {
 					"inputSchema": map[string]interface{}{
 						"type": "object",
 						"properties": map[string]interface{}{
-							"command":                map[string]string{"type": "string"},
-							"async":                  map[string]string{"type": "boolean"},
+							"command":           map[string]string{"type": "string"},
+							"argv":              map[string]interface{}{"type": "array", "items": map[string]string{"type": "string"}, "description": "Program and arguments executed directly without a shell; use instead of command."},
+							"shell":             map[string]interface{}{"type": "string", "description": "Shell for command by name: sh, bash, zsh, dash, ksh, fish, pwsh or cmd. Custom shells and flags come from .smartsh-policy.yaml."},
+							"session_id":        map[string]interface{}{"type": "string", "description": "Named shell session: cd and exported env carry over to later runs with the same session_id."},
+							"async":             map[string]string{"type": "boolean"},
+							"priority":          map[string]interface{}{"type": "string", "enum": []string{"interactive", "normal", "background"}},
+							"resume_on_restart": map[string]string{"type": "boolean"},
+							"sandbox":           map[string]interface{}{"type": "string", "enum": []string{"strict", "landlock", "off"}},
+							"retry": map[string]interface{}{
+								"type": "object",
+								"properties": map[string]interface{}{
+									"max_attempts": map[string]string{"type": "integer"},
+									"backoff_sec":  map[string]string{"type": "integer"},
+									"retry_on":     map[string]interface{}{"type": "array", "items": map[string]string{"type": "string"}},
+								},
+							},
+							"stdin":                  map[string]string{"type": "string"},
+							"cache":                  map[string]string{"type": "boolean"},
+							"cache_inputs":           map[string]interface{}{"type": "array", "items": map[string]string{"type": "string"}},
 							"cwd":                    map[string]string{"type": "string"},
 							"dry_run":                map[string]string{"type": "boolean"},
 							"unsafe":                 map[string]string{"type": "boolean"},
@@ -219,6 +344,134 @@ func (server *mcpServer) handleRequest(request rpcRequest) rpcResponse {
 						},
 					},
 				},
+				{
+					"name":        "smartsh_cancel",
+					"description": "Cancel a queued or running smartsh job by job_id and kill its process.",
+					"inputSchema": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"job_id": map[string]string{"type": "string"},
+						},
+						"required": []string{"job_id"},
+					},
+				},
+				{
+					"name":        "smartsh_run_batch",
+					"description": "Run an ordered list of commands through smartshd (instead of chaining with &&) and return per-step status plus one combined summary naming the first failing step. mode=parallel fans out (e.g. one command across many cwds) and merges failing tests/files by sub-run.",
+					"inputSchema": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"steps": map[string]interface{}{
+								"type": "array",
+								"items": map[string]interface{}{
+									"type": "object",
+									"properties": map[string]interface{}{
+										"command":     map[string]string{"type": "string"},
+										"cwd":         map[string]string{"type": "string"},
+										"timeout_sec": map[string]string{"type": "integer"},
+										"env":         map[string]interface{}{"type": "object", "additionalProperties": map[string]string{"type": "string"}},
+									},
+									"required": []string{"command"},
+								},
+							},
+							"mode":             map[string]interface{}{"type": "string", "enum": []string{"stop_on_failure", "continue", "parallel"}},
+							"max_parallel":     map[string]string{"type": "integer"},
+							"command":          map[string]string{"type": "string"},
+							"cwds":             map[string]interface{}{"type": "array", "items": map[string]string{"type": "string"}},
+							"cwd":              map[string]string{"type": "string"},
+							"timeout_sec":      map[string]string{"type": "integer"},
+							"env":              map[string]interface{}{"type": "object", "additionalProperties": map[string]string{"type": "string"}},
+							"unsafe":           map[string]string{"type": "boolean"},
+							"require_approval": map[string]string{"type": "boolean"},
+							"allowlist_mode":   map[string]interface{}{"type": "string", "enum": []string{"off", "warn", "enforce"}},
+							"sandbox":          map[string]interface{}{"type": "string", "enum": []string{"strict", "landlock", "off"}},
+							"priority":         map[string]interface{}{"type": "string", "enum": []string{"interactive", "normal", "background"}},
+						},
+					},
+				},
+				{
+					"name":        "smartsh_job_output",
+					"description": "Page through the full retained output of a smartsh job. Negative offset reads from the end; grep filters lines by regex.",
+					"inputSchema": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"job_id": map[string]string{"type": "string"},
+							"offset": map[string]string{"type": "integer"},
+							"limit":  map[string]string{"type": "integer"},
+							"grep":   map[string]string{"type": "string"},
+						},
+						"required": []string{"job_id"},
+					},
+				},
+				{
+					"name":        "smartsh_run_task",
+					"description": "Run a vetted task from the project's .smartsh-tasks.yaml (found by walking up from cwd) by name instead of composing shell. args fill the task's {{placeholders}}; tasks marked trusted skip risk approval. Returns the same summary JSON as smartsh_run.",
+					"inputSchema": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"name":             map[string]string{"type": "string"},
+							"args":             map[string]interface{}{"type": "object", "additionalProperties": map[string]string{"type": "string"}},
+							"cwd":              map[string]string{"type": "string"},
+							"async":            map[string]string{"type": "boolean"},
+							"session_id":       map[string]string{"type": "string"},
+							"timeout_sec":      map[string]string{"type": "integer"},
+							"mcp_max_wait_sec": map[string]string{"type": "integer"},
+						},
+						"required": []string{"name"},
+					},
+				},
+				{
+					"name":        "smartsh_list_tasks",
+					"description": "List the tasks in the project's .smartsh-tasks.yaml for cwd: name, description, command, args with defaults and patterns, and whether each is trusted.",
+					"inputSchema": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"cwd": map[string]string{"type": "string"},
+						},
+					},
+				},
+				{
+					"name":        "smartsh_watch_status",
+					"description": "Return the latest run of a smartshd watch (POST /watches): its status, run count, the files that triggered it and the summary of the most recent run only.",
+					"inputSchema": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"watch_id": map[string]string{"type": "string"},
+						},
+						"required": []string{"watch_id"},
+					},
+				},
+				{
+					"name":        "smartsh_service",
+					"description": "Manage long-running dev servers under smartshd instead of blocking /run. action=start launches command and waits for the readiness probe (ready.tcp, ready.http or ready.log_regex), returning ready plus url; list, status, logs (offset/limit/grep), restart and stop take service_id or name.",
+					"inputSchema": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"action":     map[string]interface{}{"type": "string", "enum": []string{"start", "list", "status", "logs", "restart", "stop"}},
+							"service_id": map[string]string{"type": "string"},
+							"name":       map[string]string{"type": "string"},
+							"command":    map[string]string{"type": "string"},
+							"shell":      map[string]interface{}{"type": "string", "description": "Shell for command by name: sh, bash, zsh, dash, ksh, fish, pwsh or cmd. Custom shells and flags come from .smartsh-policy.yaml."},
+							"cwd":        map[string]string{"type": "string"},
+							"env":        map[string]interface{}{"type": "object", "additionalProperties": map[string]string{"type": "string"}},
+							"unsafe":     map[string]string{"type": "boolean"},
+							"sandbox":    map[string]interface{}{"type": "string", "enum": []string{"strict", "landlock", "off"}},
+							"ready": map[string]interface{}{
+								"type": "object",
+								"properties": map[string]interface{}{
+									"tcp":       map[string]string{"type": "string"},
+									"http":      map[string]string{"type": "string"},
+									"log_regex": map[string]string{"type": "string"},
+								},
+							},
+							"ready_timeout_sec": map[string]string{"type": "integer"},
+							"offset":            map[string]string{"type": "integer"},
+							"limit":             map[string]string{"type": "integer"},
+							"grep":              map[string]string{"type": "string"},
+						},
+						"required": []string{"action"},
+					},
+				},
 			},
 		}
 		return response
@@ -228,34 +481,71 @@ func (server *mcpServer) handleRequest(request rpcRequest) rpcResponse {
 			response.Error = &rpcError{Code: -32602, Message: "invalid tool call params"}
 			return response
 		}
-		if params.Name != "smartsh_run" && params.Name != "smartsh_approve" {
-			response.Error = &rpcError{Code: -32601, Message: "unknown tool"}
+		if params.Name == "smartsh_run_batch" {
+			batch, callErr := server.callSmartshRunBatch(params.Arguments)
+			if callErr != nil {
+				response.Result = toolErrorResult(callErr)
+				return response
+			}
+			response.Result = toolResult(batch, batch.Status != "completed")
+			return response
+		}
+		if params.Name == "smartsh_job_output" {
+			page, callErr := server.callSmartshJobOutput(params.Arguments)
+			if callErr != nil {
+				response.Result = toolErrorResult(callErr)
+				return response
+			}
+			response.Result = toolResult(page, false)
+			return response
+		}
+		if params.Name == "smartsh_list_tasks" {
+			result, callErr := server.callSmartshListTasks(params.Arguments)
+			if callErr != nil {
+				response.Result = toolErrorResult(callErr)
+				return response
+			}
+			response.Result = toolResult(result, false)
+			return response
+		}
+		if params.Name == "smartsh_watch_status" {
+			watch, callErr := server.callSmartshWatchStatus(params.Arguments)
+			if callErr != nil {
+				response.Result = toolErrorResult(callErr)
+				return response
+			}
+			response.Result = toolResult(watch, watch.LastRun != nil && watch.LastRun.ExitCode != 0)
+			return response
+		}
+		if params.Name == "smartsh_service" {
+			result, isError, callErr := server.callSmartshService(params.Arguments)
+			if callErr != nil {
+				response.Result = toolErrorResult(callErr)
+				return response
+			}
+			response.Result = toolResult(result, isError)
 			return response
 		}
 		var runResult daemonRunResponse
 		var callErr error
-		if params.Name == "smartsh_run" {
+		switch params.Name {
+		case "smartsh_run":
 			runResult, callErr = server.callSmartshRun(params.Arguments)
-		} else {
+		case "smartsh_run_task":
+			runResult, callErr = server.callSmartshRunTask(params.Arguments)
+		case "smartsh_approve":
 			runResult, callErr = server.callSmartshApprove(params.Arguments)
+		case "smartsh_cancel":
+			runResult, callErr = server.callSmartshCancel(params.Arguments)
+		default:
+			response.Error = &rpcError{Code: -32601, Message: "unknown tool"}
+			return response
 		}
 		if callErr != nil {
-			response.Result = map[string]interface{}{
-				"isError": true,
-				"content": []map[string]string{
-					{"type": "text", "text": fmt.Sprintf(`{"executed":false,"exit_code":1,"error":"%s"}`, sanitizeError(callErr))},
-				},
-			}
+			response.Result = toolErrorResult(callErr)
 			return response
 		}
-		resultJSON, _ := json.Marshal(runResult)
-		response.Result = map[string]interface{}{
-			"content": []map[string]string{
-				{"type": "text", "text": string(resultJSON)},
-			},
-			"structuredContent": runResult,
-			"isError":           runResult.ExitCode != 0,
-		}
+		response.Result = toolResult(runResult, runResult.ExitCode != 0)
 		return response
 	default:
 		response.Error = &rpcError{Code: -32601, Message: "method not found"}
@@ -273,7 +563,7 @@ func (server *mcpServer) callSmartshRun(arguments map[string]interface{}) (daemo
 	}
 
 	requestBody := map[string]interface{}{}
-	for _, key := range []string{"command", "async", "cwd", "dry_run", "unsafe", "require_approval", "allowlist_mode", "allowlist_file", "open_external_terminal", "terminal_app", "terminal_session_key"} {
+	for _, key := range []string{"command", "argv", "shell", "session_id", "task", "task_args", "async", "priority", "resume_on_restart", "sandbox", "retry", "stdin", "cache", "cache_inputs", "cwd", "dry_run", "unsafe", "require_approval", "allowlist_mode", "allowlist_file", "open_external_terminal", "terminal_app", "terminal_session_key"} {
 		if value, exists := arguments[key]; exists {
 			requestBody[key] = value
 		}
@@ -305,10 +595,13 @@ func (server *mcpServer) callSmartshRun(arguments map[string]interface{}) (daemo
 		requestBody["terminal_session_key"] = "cursor-main"
 	}
 	timeoutSec := toInt(arguments["timeout_sec"])
-	if timeoutSec <= 0 {
+	if timeoutSec <= 0 && requestBody["task"] == nil {
+		// Tasks bring their own timeout_sec from the catalog.
 		timeoutSec = defaultRunTimeoutSec
 	}
-	requestBody["timeout_sec"] = timeoutSec
+	if timeoutSec > 0 {
+		requestBody["timeout_sec"] = timeoutSec
+	}
 	maxWaitSec := toInt(arguments["mcp_max_wait_sec"])
 	if maxWaitSec <= 0 {
 		maxWaitSec = defaultMCPMaxWaitSec
@@ -321,6 +614,62 @@ func (server *mcpServer) callSmartshRun(arguments map[string]interface{}) (daemo
 	return server.waitForJobIfNeeded(initial, maxWaitSec)
 }
 
+// callSmartshRunTask runs a catalog task through the same path as
+// smartsh_run, so async waiting, approvals and compaction behave the same.
+func (server *mcpServer) callSmartshRunTask(arguments map[string]interface{}) (daemonRunResponse, error) {
+	name := strings.TrimSpace(toString(arguments["name"]))
+	if name == "" {
+		return daemonRunResponse{}, fmt.Errorf("name is required")
+	}
+	runArguments := map[string]interface{}{"task": name}
+	for _, key := range []string{"cwd", "async", "session_id", "timeout_sec", "mcp_max_wait_sec"} {
+		if value, exists := arguments[key]; exists {
+			runArguments[key] = value
+		}
+	}
+	if args, ok := arguments["args"].(map[string]interface{}); ok && len(args) > 0 {
+		taskArgs := map[string]string{}
+		for key, value := range args {
+			taskArgs[key] = fmt.Sprint(value)
+		}
+		runArguments["task_args"] = taskArgs
+	}
+	return server.callSmartshRun(runArguments)
+}
+
+// callSmartshListTasks returns the daemon's GET /tasks JSON as is.
+func (server *mcpServer) callSmartshListTasks(arguments map[string]interface{}) (map[string]interface{}, error) {
+	if err := server.ensureDaemon(); err != nil {
+		return nil, err
+	}
+	query := url.Values{}
+	if cwd := strings.TrimSpace(toString(arguments["cwd"])); cwd != "" {
+		query.Set("cwd", cwd)
+	}
+	request, err := http.NewRequest(http.MethodGet, server.daemonURL+"/tasks?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	server.applyAuthHeaders(request)
+	response, err := server.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]interface{}{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 400 {
+		return nil, fmt.Errorf("%v", result["error"])
+	}
+	return result, nil
+}
+
 func (server *mcpServer) callSmartshApprove(arguments map[string]interface{}) (daemonRunResponse, error) {
 	if err := server.ensureDaemon(); err != nil {
 		return daemonRunResponse{}, err
@@ -349,6 +698,278 @@ func (server *mcpServer) callSmartshApprove(arguments map[string]interface{}) (d
 	return server.waitForJobIfNeeded(initial, maxWaitSec)
 }
 
+func (server *mcpServer) callSmartshCancel(arguments map[string]interface{}) (daemonRunResponse, error) {
+	if err := server.ensureDaemon(); err != nil {
+		return daemonRunResponse{}, err
+	}
+	jobID := strings.TrimSpace(toString(arguments["job_id"]))
+	if jobID == "" {
+		return daemonRunResponse{}, fmt.Errorf("job_id is required")
+	}
+	request, err := http.NewRequest(http.MethodPost, server.daemonURL+"/jobs/"+jobID+"/cancel", nil)
+	if err != nil {
+		return daemonRunResponse{}, err
+	}
+	server.applyAuthHeaders(request)
+	response, err := server.httpClient.Do(request)
+	if err != nil {
+		return daemonRunResponse{}, err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return daemonRunResponse{}, err
+	}
+	cancelResponse := daemonRunResponse{}
+	if err := json.Unmarshal(body, &cancelResponse); err != nil {
+		return daemonRunResponse{}, err
+	}
+	if response.StatusCode >= 400 && cancelResponse.Error != "" {
+		return daemonRunResponse{}, fmt.Errorf(cancelResponse.Error)
+	}
+	server.compactRunResponse(&cancelResponse)
+	return cancelResponse, nil
+}
+
+func (server *mcpServer) callSmartshRunBatch(arguments map[string]interface{}) (daemonBatchResponse, error) {
+	if err := server.ensureDaemon(); err != nil {
+		return daemonBatchResponse{}, err
+	}
+	steps, _ := arguments["steps"].([]interface{})
+	cwds, _ := arguments["cwds"].([]interface{})
+	if len(steps) == 0 && (strings.TrimSpace(toString(arguments["command"])) == "" || len(cwds) == 0) {
+		return daemonBatchResponse{}, fmt.Errorf("steps, or command with cwds, is required")
+	}
+	requestBody := map[string]interface{}{}
+	for _, key := range []string{"steps", "mode", "max_parallel", "command", "cwds", "cwd", "env", "unsafe", "require_approval", "allowlist_mode", "sandbox", "priority"} {
+		if value, exists := arguments[key]; exists {
+			requestBody[key] = value
+		}
+	}
+	if _, exists := requestBody["unsafe"]; !exists {
+		requestBody["unsafe"] = mcpDefaultUnsafe()
+	}
+	if _, exists := requestBody["allowlist_mode"]; !exists {
+		requestBody["allowlist_mode"] = mcpDefaultAllowlistMode()
+	}
+	if _, exists := requestBody["require_approval"]; !exists {
+		requestBody["require_approval"] = mcpDefaultRequireApproval()
+	}
+	timeoutSec := toInt(arguments["timeout_sec"])
+	if timeoutSec <= 0 {
+		timeoutSec = defaultRunTimeoutSec
+	}
+	requestBody["timeout_sec"] = timeoutSec
+
+	requestBytes, err := json.Marshal(requestBody)
+	if err != nil {
+		return daemonBatchResponse{}, err
+	}
+	request, err := http.NewRequest(http.MethodPost, server.daemonURL+"/batch", bytes.NewReader(requestBytes))
+	if err != nil {
+		return daemonBatchResponse{}, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	server.applyAuthHeaders(request)
+	response, err := server.httpClient.Do(request)
+	if err != nil {
+		return daemonBatchResponse{}, err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return daemonBatchResponse{}, err
+	}
+	batch := daemonBatchResponse{}
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return daemonBatchResponse{}, err
+	}
+	if response.StatusCode >= 400 && batch.Error != "" {
+		return daemonBatchResponse{}, fmt.Errorf(batch.Error)
+	}
+	for index := range batch.Steps {
+		server.compactRunResponse(&batch.Steps[index].daemonRunResponse)
+	}
+	return batch, nil
+}
+
+func (server *mcpServer) callSmartshJobOutput(arguments map[string]interface{}) (daemonJobOutputPage, error) {
+	if err := server.ensureDaemon(); err != nil {
+		return daemonJobOutputPage{}, err
+	}
+	jobID := strings.TrimSpace(toString(arguments["job_id"]))
+	if jobID == "" {
+		return daemonJobOutputPage{}, fmt.Errorf("job_id is required")
+	}
+	query := url.Values{}
+	if _, exists := arguments["offset"]; exists {
+		query.Set("offset", strconv.Itoa(toInt(arguments["offset"])))
+	}
+	if limit := toInt(arguments["limit"]); limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	if grep := strings.TrimSpace(toString(arguments["grep"])); grep != "" {
+		query.Set("grep", grep)
+	}
+	requestURL := server.daemonURL + "/jobs/" + url.PathEscape(jobID) + "/output"
+	if encoded := query.Encode(); encoded != "" {
+		requestURL += "?" + encoded
+	}
+	request, err := http.NewRequest(http.MethodGet, requestURL, nil)
+	if err != nil {
+		return daemonJobOutputPage{}, err
+	}
+	server.applyAuthHeaders(request)
+	response, err := server.httpClient.Do(request)
+	if err != nil {
+		return daemonJobOutputPage{}, err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return daemonJobOutputPage{}, err
+	}
+	page := daemonJobOutputPage{}
+	if err := json.Unmarshal(body, &page); err != nil {
+		return daemonJobOutputPage{}, err
+	}
+	if response.StatusCode >= 400 && page.Error != "" {
+		return daemonJobOutputPage{}, fmt.Errorf(page.Error)
+	}
+	return page, nil
+}
+
+func (server *mcpServer) callSmartshWatchStatus(arguments map[string]interface{}) (daemonWatchStatus, error) {
+	if err := server.ensureDaemon(); err != nil {
+		return daemonWatchStatus{}, err
+	}
+	watchID := strings.TrimSpace(toString(arguments["watch_id"]))
+	if watchID == "" {
+		return daemonWatchStatus{}, fmt.Errorf("watch_id is required")
+	}
+	request, err := http.NewRequest(http.MethodGet, server.daemonURL+"/watches/"+url.PathEscape(watchID), nil)
+	if err != nil {
+		return daemonWatchStatus{}, err
+	}
+	server.applyAuthHeaders(request)
+	response, err := server.httpClient.Do(request)
+	if err != nil {
+		return daemonWatchStatus{}, err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return daemonWatchStatus{}, err
+	}
+	watch := daemonWatchStatus{}
+	if err := json.Unmarshal(body, &watch); err != nil {
+		return daemonWatchStatus{}, err
+	}
+	if response.StatusCode >= 400 && watch.Error != "" {
+		return daemonWatchStatus{}, fmt.Errorf(watch.Error)
+	}
+	server.compactRunResponse(watch.LastRun)
+	return watch, nil
+}
+
+// callSmartshService maps an action onto the /services endpoints and returns
+// the daemon's JSON as is. The result is flagged as an error when a started or
+// restarted service did not become ready.
+func (server *mcpServer) callSmartshService(arguments map[string]interface{}) (map[string]interface{}, bool, error) {
+	if err := server.ensureDaemon(); err != nil {
+		return nil, false, err
+	}
+	action := strings.TrimSpace(toString(arguments["action"]))
+	serviceKey := strings.TrimSpace(toString(arguments["service_id"]))
+	if serviceKey == "" {
+		serviceKey = strings.TrimSpace(toString(arguments["name"]))
+	}
+	method := http.MethodGet
+	path := "/services"
+	var requestBody io.Reader
+	switch action {
+	case "start":
+		if strings.TrimSpace(toString(arguments["command"])) == "" {
+			return nil, false, fmt.Errorf("command is required")
+		}
+		startBody := map[string]interface{}{}
+		for _, key := range []string{"name", "command", "shell", "cwd", "env", "unsafe", "sandbox", "ready", "ready_timeout_sec"} {
+			if value, exists := arguments[key]; exists {
+				startBody[key] = value
+			}
+		}
+		if _, exists := startBody["unsafe"]; !exists {
+			startBody["unsafe"] = mcpDefaultUnsafe()
+		}
+		startBody["allowlist_mode"] = mcpDefaultAllowlistMode()
+		encoded, err := json.Marshal(startBody)
+		if err != nil {
+			return nil, false, err
+		}
+		method = http.MethodPost
+		requestBody = bytes.NewReader(encoded)
+	case "list":
+	case "status", "logs", "restart", "stop":
+		if serviceKey == "" {
+			return nil, false, fmt.Errorf("service_id or name is required")
+		}
+		path += "/" + url.PathEscape(serviceKey)
+		if action != "status" {
+			path += "/" + action
+		}
+		if action == "restart" || action == "stop" {
+			method = http.MethodPost
+		}
+		if action == "logs" {
+			query := url.Values{}
+			if _, exists := arguments["offset"]; exists {
+				query.Set("offset", strconv.Itoa(toInt(arguments["offset"])))
+			}
+			if limit := toInt(arguments["limit"]); limit > 0 {
+				query.Set("limit", strconv.Itoa(limit))
+			}
+			if grep := strings.TrimSpace(toString(arguments["grep"])); grep != "" {
+				query.Set("grep", grep)
+			}
+			if encoded := query.Encode(); encoded != "" {
+				path += "?" + encoded
+			}
+		}
+	default:
+		return nil, false, fmt.Errorf("action must be one of start, list, status, logs, restart, stop")
+	}
+
+	request, err := http.NewRequest(method, server.daemonURL+path, requestBody)
+	if err != nil {
+		return nil, false, err
+	}
+	if requestBody != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	server.applyAuthHeaders(request)
+	response, err := server.httpClient.Do(request)
+	if err != nil {
+		return nil, false, err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	result := map[string]interface{}{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, false, err
+	}
+	if message := toString(result["error"]); response.StatusCode >= 400 && message != "" {
+		return nil, false, fmt.Errorf(message)
+	}
+	if tail := toString(result["output_tail"]); tail != "" && mcpCompactOutputEnabled() && mcpMaxOutputTailChars() > 0 {
+		result["output_tail"] = compactTail(tail, mcpMaxOutputTailChars())
+	}
+	notReady := (action == "start" || action == "restart") && result["ready"] != true
+	return result, notReady, nil
+}
+
 func (server *mcpServer) waitForJobIfNeeded(initial daemonRunResponse, maxWaitSec int) (daemonRunResponse, error) {
 	if initial.JobID == "" || isTerminalJobStatus(initial.Status) {
 		server.decorateApprovalPrompt(&initial)
@@ -375,6 +996,9 @@ func (server *mcpServer) waitForJobIfNeeded(initial daemonRunResponse, maxWaitSe
 		strings.EqualFold(strings.TrimSpace(lastKnown.Summary), "job accepted") ||
 		strings.EqualFold(strings.TrimSpace(lastKnown.Summary), "job running") {
 		lastKnown.Summary = "job still running; use job_id to poll status"
+		if lastKnown.QueuePosition > 0 {
+			lastKnown.Summary = fmt.Sprintf("job queued at position %d; use job_id to poll status", lastKnown.QueuePosition)
+		}
 	}
 	server.decorateApprovalPrompt(&lastKnown)
 	server.compactRunResponse(&lastKnown)
@@ -469,10 +1093,18 @@ func (server *mcpServer) compactRunResponse(response *daemonRunResponse) {
 		return
 	}
 	maxChars := mcpMaxOutputTailChars()
-	if maxChars <= 0 || len(response.OutputTail) <= maxChars {
+	if maxChars <= 0 {
 		return
 	}
-	response.OutputTail = response.OutputTail[len(response.OutputTail)-maxChars:] + "\n[truncated by smartsh mcp compact mode]\n"
+	response.OutputTail = compactTail(response.OutputTail, maxChars)
+	response.StderrTail = compactTail(response.StderrTail, maxChars)
+}
+
+func compactTail(tail string, maxChars int) string {
+	if len(tail) <= maxChars {
+		return tail
+	}
+	return tail[len(tail)-maxChars:] + "\n[truncated by smartsh mcp compact mode]\n"
 }
 
 func (server *mcpServer) postRun(requestBody map[string]interface{}) (daemonRunResponse, error) {
@@ -790,6 +1422,26 @@ func (server *mcpServer) writeResponse(response rpcResponse) error {
 	return server.writer.Flush()
 }
 
+func toolResult(payload any, isError bool) map[string]interface{} {
+	resultJSON, _ := json.Marshal(payload)
+	return map[string]interface{}{
+		"content": []map[string]string{
+			{"type": "text", "text": string(resultJSON)},
+		},
+		"structuredContent": payload,
+		"isError":           isError,
+	}
+}
+
+func toolErrorResult(err error) map[string]interface{} {
+	return map[string]interface{}{
+		"isError": true,
+		"content": []map[string]string{
+			{"type": "text", "text": fmt.Sprintf(`{"executed":false,"exit_code":1,"error":"%s"}`, sanitizeError(err))},
+		},
+	}
+}
+
 func decodeID(raw json.RawMessage) any {
 	if len(raw) == 0 {
 		return nil
@@ -811,7 +1463,7 @@ func decodeID(raw json.RawMessage) any {
 
 func isTerminalJobStatus(status string) bool {
 	switch strings.ToLower(strings.TrimSpace(status)) {
-	case "completed", "failed", "blocked", "needs_approval":
+	case "completed", "failed", "blocked", "needs_approval", "cancelled", "interrupted", "waiting_for_input":
 		return true
 	default:
 		return false
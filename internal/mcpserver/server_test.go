@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -583,3 +584,293 @@ func TestCallSmartshRunApprovalYesShortcutUsesLastApprovalID(t *testing.T) {
 		t.Fatalf("expected completed approval response, got status=%q exit=%d", approvedResponse.Status, approvedResponse.ExitCode)
 	}
 }
+
+func TestCallSmartshCancelUsesCancelEndpoint(t *testing.T) {
+	var cancelMethod string
+	mockDaemon := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/health":
+			writer.WriteHeader(http.StatusOK)
+			_, _ = writer.Write([]byte(`{"ok":true}`))
+		case "/jobs/job-123/cancel":
+			cancelMethod = request.Method
+			_ = json.NewEncoder(writer).Encode(map[string]any{
+				"must_use_smartsh": true,
+				"job_id":           "job-123",
+				"status":           "cancelled",
+				"executed":         false,
+				"exit_code":        1,
+				"summary":          "job cancelled",
+			})
+		default:
+			http.NotFound(writer, request)
+		}
+	}))
+	defer mockDaemon.Close()
+
+	server := &mcpServer{
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+		daemonURL:  mockDaemon.URL,
+	}
+	response, err := server.callSmartshCancel(map[string]interface{}{"job_id": "job-123"})
+	if err != nil {
+		t.Fatalf("callSmartshCancel returned error: %v", err)
+	}
+	if cancelMethod != http.MethodPost {
+		t.Fatalf("expected POST to cancel endpoint, got %q", cancelMethod)
+	}
+	if response.Status != "cancelled" {
+		t.Fatalf("expected cancelled status, got %q", response.Status)
+	}
+	if !isTerminalJobStatus(response.Status) {
+		t.Fatalf("expected cancelled to be a terminal status")
+	}
+}
+
+func TestCallSmartshJobOutputForwardsPagingQuery(t *testing.T) {
+	var receivedQuery map[string]string
+	mockDaemon := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/health":
+			writer.WriteHeader(http.StatusOK)
+			_, _ = writer.Write([]byte(`{"ok":true}`))
+		case "/jobs/job-123/output":
+			receivedQuery = map[string]string{
+				"offset": request.URL.Query().Get("offset"),
+				"limit":  request.URL.Query().Get("limit"),
+				"grep":   request.URL.Query().Get("grep"),
+			}
+			_ = json.NewEncoder(writer).Encode(map[string]any{
+				"must_use_smartsh": true,
+				"job_id":           "job-123",
+				"offset":           -20,
+				"limit":            20,
+				"total_lines":      1,
+				"lines":            []map[string]any{{"line": 42, "text": "error TS2322: bad type"}},
+			})
+		default:
+			http.NotFound(writer, request)
+		}
+	}))
+	defer mockDaemon.Close()
+
+	server := &mcpServer{
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+		daemonURL:  mockDaemon.URL,
+	}
+	page, err := server.callSmartshJobOutput(map[string]interface{}{
+		"job_id": "job-123",
+		"offset": float64(-20),
+		"limit":  float64(20),
+		"grep":   "error",
+	})
+	if err != nil {
+		t.Fatalf("callSmartshJobOutput returned error: %v", err)
+	}
+	if receivedQuery["offset"] != "-20" || receivedQuery["limit"] != "20" || receivedQuery["grep"] != "error" {
+		t.Fatalf("expected paging query to be forwarded, got %+v", receivedQuery)
+	}
+	if len(page.Lines) != 1 || page.Lines[0].Line != 42 {
+		t.Fatalf("expected one output line from daemon, got %+v", page.Lines)
+	}
+}
+
+func TestCallSmartshRunBatchPostsStepsAndDecodesSteps(t *testing.T) {
+	var batchRequestBody map[string]interface{}
+	mockDaemon := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/health":
+			writer.WriteHeader(http.StatusOK)
+			_, _ = writer.Write([]byte(`{"ok":true}`))
+		case "/batch":
+			_ = json.NewDecoder(request.Body).Decode(&batchRequestBody)
+			_ = json.NewEncoder(writer).Encode(map[string]any{
+				"must_use_smartsh": true,
+				"status":           "failed",
+				"mode":             "stop_on_failure",
+				"summary":          "step 2/2 failed (go vet ./...)",
+				"failed_step":      2,
+				"steps": []map[string]any{
+					{"step": 1, "status": "completed", "resolved_command": "go build ./...", "executed": true, "exit_code": 0},
+					{"step": 2, "status": "failed", "resolved_command": "go vet ./...", "executed": true, "exit_code": 1},
+				},
+			})
+		default:
+			http.NotFound(writer, request)
+		}
+	}))
+	defer mockDaemon.Close()
+
+	server := &mcpServer{
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+		daemonURL:  mockDaemon.URL,
+	}
+	response, err := server.callSmartshRunBatch(map[string]interface{}{
+		"steps": []interface{}{
+			map[string]interface{}{"command": "go build ./..."},
+			map[string]interface{}{"command": "go vet ./...", "timeout_sec": 60},
+		},
+		"cwd": "/tmp/project",
+	})
+	if err != nil {
+		t.Fatalf("callSmartshRunBatch returned error: %v", err)
+	}
+	if steps, ok := batchRequestBody["steps"].([]interface{}); !ok || len(steps) != 2 {
+		t.Fatalf("expected two steps forwarded, got %v", batchRequestBody["steps"])
+	}
+	if batchRequestBody["cwd"] != "/tmp/project" {
+		t.Fatalf("expected batch cwd forwarded, got %v", batchRequestBody["cwd"])
+	}
+	if response.FailedStep != 2 || len(response.Steps) != 2 || response.Steps[1].ResolvedCommand != "go vet ./..." {
+		t.Fatalf("unexpected batch response: %+v", response)
+	}
+}
+
+func TestCallSmartshWatchStatusReturnsLatestRun(t *testing.T) {
+	mockDaemon := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/health":
+			writer.WriteHeader(http.StatusOK)
+			_, _ = writer.Write([]byte(`{"ok":true}`))
+		case "/watches/watch-1":
+			_ = json.NewEncoder(writer).Encode(map[string]any{
+				"must_use_smartsh": true,
+				"watch_id":         "watch-1",
+				"status":           "watching",
+				"run_count":        3,
+				"last_trigger":     []string{"/repo/src/app.ts"},
+				"last_run": map[string]any{
+					"job_id":        "job-9",
+					"status":        "failed",
+					"exit_code":     1,
+					"summary":       "1 test failed",
+					"failing_tests": []string{"app renders"},
+				},
+			})
+		default:
+			http.NotFound(writer, request)
+		}
+	}))
+	defer mockDaemon.Close()
+
+	server := &mcpServer{
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+		daemonURL:  mockDaemon.URL,
+	}
+	watch, err := server.callSmartshWatchStatus(map[string]interface{}{"watch_id": "watch-1"})
+	if err != nil {
+		t.Fatalf("callSmartshWatchStatus returned error: %v", err)
+	}
+	if watch.RunCount != 3 || watch.LastRun == nil || watch.LastRun.JobID != "job-9" {
+		t.Fatalf("expected latest run of watch, got %+v", watch)
+	}
+	if len(watch.LastRun.FailingTests) != 1 || watch.LastRun.Summary != "1 test failed" {
+		t.Fatalf("expected latest run summary, got %+v", watch.LastRun)
+	}
+	if _, err := server.callSmartshWatchStatus(map[string]interface{}{}); err == nil {
+		t.Fatalf("expected missing watch_id to be rejected")
+	}
+}
+
+func TestCallSmartshServiceMapsActionsToEndpoints(t *testing.T) {
+	var startBody map[string]interface{}
+	requests := []string{}
+	mockDaemon := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == "/health" {
+			writer.WriteHeader(http.StatusOK)
+			_, _ = writer.Write([]byte(`{"ok":true}`))
+			return
+		}
+		requests = append(requests, request.Method+" "+request.URL.RequestURI())
+		switch request.URL.Path {
+		case "/services":
+			_ = json.NewDecoder(request.Body).Decode(&startBody)
+			writer.WriteHeader(http.StatusCreated)
+			_ = json.NewEncoder(writer).Encode(map[string]any{"service_id": "svc-1", "status": "ready", "ready": true, "url": "http://127.0.0.1:5173"})
+		case "/services/web/stop":
+			_ = json.NewEncoder(writer).Encode(map[string]any{"service_id": "svc-1", "status": "stopped", "ready": false})
+		case "/services/web/logs":
+			_ = json.NewEncoder(writer).Encode(map[string]any{"service_id": "svc-1", "total_lines": 1})
+		default:
+			writer.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(writer).Encode(map[string]any{"error": "service not found"})
+		}
+	}))
+	defer mockDaemon.Close()
+
+	server := &mcpServer{
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+		daemonURL:  mockDaemon.URL,
+	}
+	started, notReady, err := server.callSmartshService(map[string]interface{}{
+		"action":  "start",
+		"name":    "web",
+		"command": "npm run dev",
+		"shell":   "bash",
+		"ready":   map[string]interface{}{"http": "http://127.0.0.1:5173"},
+	})
+	if err != nil || notReady || started["url"] != "http://127.0.0.1:5173" {
+		t.Fatalf("expected ready service with url, got %+v notReady=%v err=%v", started, notReady, err)
+	}
+	if startBody["command"] != "npm run dev" || startBody["shell"] != "bash" || startBody["ready"] == nil {
+		t.Fatalf("expected command, shell and probe to be forwarded, got %+v", startBody)
+	}
+	if _, _, err := server.callSmartshService(map[string]interface{}{"action": "logs", "name": "web", "grep": "error"}); err != nil {
+		t.Fatalf("logs returned error: %v", err)
+	}
+	if _, _, err := server.callSmartshService(map[string]interface{}{"action": "stop", "service_id": "web"}); err != nil {
+		t.Fatalf("stop returned error: %v", err)
+	}
+	if _, _, err := server.callSmartshService(map[string]interface{}{"action": "status", "name": "missing"}); err == nil || err.Error() != "service not found" {
+		t.Fatalf("expected daemon error to surface, got %v", err)
+	}
+	expected := []string{"POST /services", "GET /services/web/logs?grep=error", "POST /services/web/stop", "GET /services/missing"}
+	if strings.Join(requests, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected requests %v, got %v", expected, requests)
+	}
+}
+
+func TestCallSmartshRunTaskAndListTasks(t *testing.T) {
+	var runBody map[string]interface{}
+	listedCwd := ""
+	mockDaemon := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/health":
+			writer.WriteHeader(http.StatusOK)
+			_, _ = writer.Write([]byte(`{"ok":true}`))
+		case "/run":
+			_ = json.NewDecoder(request.Body).Decode(&runBody)
+			_ = json.NewEncoder(writer).Encode(map[string]any{"must_use_smartsh": true, "status": "completed", "executed": true, "exit_code": 0, "task": "test"})
+		case "/tasks":
+			listedCwd = request.URL.Query().Get("cwd")
+			_ = json.NewEncoder(writer).Encode(map[string]any{"must_use_smartsh": true, "catalog": "/repo/.smartsh-tasks.yaml", "tasks": []map[string]any{{"name": "test", "trusted": true}}})
+		default:
+			http.NotFound(writer, request)
+		}
+	}))
+	defer mockDaemon.Close()
+
+	server := &mcpServer{
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+		daemonURL:  mockDaemon.URL,
+	}
+	result, err := server.callSmartshRunTask(map[string]interface{}{"name": "test", "cwd": "/repo", "args": map[string]interface{}{"pkg": "./api/...", "count": 2.0}})
+	if err != nil || result.Status != "completed" {
+		t.Fatalf("callSmartshRunTask returned %+v, %v", result, err)
+	}
+	taskArgs, _ := runBody["task_args"].(map[string]interface{})
+	if runBody["task"] != "test" || runBody["command"] != nil || taskArgs["pkg"] != "./api/..." || taskArgs["count"] != "2" {
+		t.Fatalf("expected task request body, got %+v", runBody)
+	}
+	if _, exists := runBody["timeout_sec"]; exists {
+		t.Fatalf("expected task timeout to come from the catalog, got %+v", runBody["timeout_sec"])
+	}
+	if _, err := server.callSmartshRunTask(map[string]interface{}{}); err == nil {
+		t.Fatalf("expected missing name to be rejected")
+	}
+
+	listed, err := server.callSmartshListTasks(map[string]interface{}{"cwd": "/repo/sub"})
+	if err != nil || listedCwd != "/repo/sub" || listed["catalog"] != "/repo/.smartsh-tasks.yaml" {
+		t.Fatalf("expected task listing for cwd, got %+v (cwd %q, err %v)", listed, listedCwd, err)
+	}
+}
@@ -103,7 +103,59 @@ func (allowlist *Allowlist) Matches(command string) bool {
 	return false
 }
 
+// MatchesArgv matches an argv that is executed without a shell. exact and
+// prefix entries are split into words and compared word by word, so
+// "prefix:go test" allows ["go","test","./..."] but not ["go","testify"];
+// re entries match the quoted argv.
+func (allowlist *Allowlist) MatchesArgv(argv []string) bool {
+	if allowlist == nil {
+		return false
+	}
+
+	for _, entry := range allowlist.entries {
+		switch entry.kind {
+		case "exact":
+			if ArgvHasWords(argv, entry.value, true) {
+				return true
+			}
+		case "prefix":
+			if ArgvHasWords(argv, entry.value, false) {
+				return true
+			}
+		case "re":
+			if entry.regex != nil && entry.regex.MatchString(QuoteArgv(argv)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ArgvHasWords reports whether argv starts with the whitespace-separated
+// words of rule, or consists of exactly those words when exact is set.
+func ArgvHasWords(argv []string, rule string, exact bool) bool {
+	words := strings.Fields(rule)
+	if len(words) == 0 || len(words) > len(argv) || (exact && len(words) != len(argv)) {
+		return false
+	}
+	for index, word := range words {
+		if argv[index] != word {
+			return false
+		}
+	}
+	return true
+}
+
 func ValidateAllowlist(command string, allowlist *Allowlist, mode AllowlistMode) (string, error) {
+	return validateAllowlist(func() bool { return allowlist.Matches(command) }, allowlist, mode)
+}
+
+// ValidateAllowlistArgv is ValidateAllowlist for an argv run.
+func ValidateAllowlistArgv(argv []string, allowlist *Allowlist, mode AllowlistMode) (string, error) {
+	return validateAllowlist(func() bool { return allowlist.MatchesArgv(argv) }, allowlist, mode)
+}
+
+func validateAllowlist(matches func() bool, allowlist *Allowlist, mode AllowlistMode) (string, error) {
 	if mode == AllowlistModeOff {
 		return "", nil
 	}
@@ -113,7 +165,7 @@ func ValidateAllowlist(command string, allowlist *Allowlist, mode AllowlistMode)
 		}
 		return "", fmt.Errorf("allowlist enforcement enabled but allowlist is empty")
 	}
-	if allowlist.Matches(command) {
+	if matches() {
 		return "", nil
 	}
 
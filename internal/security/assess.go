@@ -2,6 +2,8 @@ package security
 
 import (
 	"fmt"
+	"path/filepath"
+	"regexp"
 	"strings"
 
 	"mvdan.cc/sh/v3/syntax"
@@ -14,12 +16,52 @@ type CommandAssessment struct {
 }
 
 func AssessCommand(command string, risk string, allowUnsafe bool) (CommandAssessment, error) {
+	return AssessShellCommand(command, "", risk, allowUnsafe)
+}
+
+// AssessShellCommand assesses a command string that runs under shell, a
+// program name or path such as "sh", "bash" or "/usr/bin/zsh". The shell picks
+// the parser dialect; an empty shell parses as bash.
+func AssessShellCommand(command string, shell string, risk string, allowUnsafe bool) (CommandAssessment, error) {
 	normalizedCommand := strings.TrimSpace(command)
 	if normalizedCommand == "" {
 		return CommandAssessment{}, fmt.Errorf("empty command")
 	}
+	return assessCommand(normalizedCommand, shell, risk, allowUnsafe, true)
+}
+
+// AssessArgv assesses a command that is executed directly, without a shell.
+// The blocked and suspicious patterns run against the quoted argv, but the
+// pipe, redirect and substitution heuristics are skipped because argv cannot
+// contain shell structure. An argv that starts a shell, directly or through a
+// wrapper such as env or nice, is also assessed as that shell's script.
+func AssessArgv(argv []string, risk string, allowUnsafe bool) (CommandAssessment, error) {
+	if len(argv) == 0 || strings.TrimSpace(argv[0]) == "" {
+		return CommandAssessment{}, fmt.Errorf("empty argv")
+	}
+	assessment, assessmentError := assessCommand(QuoteArgv(argv), "", risk, allowUnsafe, false)
+	if assessmentError != nil {
+		return CommandAssessment{}, assessmentError
+	}
+	script, shell, ok := shellScriptFromArgv(argv)
+	if !ok || strings.TrimSpace(script) == "" {
+		return assessment, nil
+	}
+	scriptAssessment, assessmentError := AssessShellCommand(script, shell, risk, allowUnsafe)
+	if assessmentError != nil {
+		return CommandAssessment{}, assessmentError
+	}
+	if scriptAssessment.RequiresRiskConfirmation && (!assessment.RequiresRiskConfirmation || riskLevelRank(scriptAssessment.RiskLevel) > riskLevelRank(assessment.RiskLevel)) {
+		return scriptAssessment, nil
+	}
+	return assessment, nil
+}
 
+func assessCommand(normalizedCommand string, shell string, risk string, allowUnsafe bool, viaShell bool) (CommandAssessment, error) {
 	for _, blockedPattern := range blockedPatterns {
+		if blockedPattern.shellOnly && !viaShell {
+			continue
+		}
 		if blockedPattern.regex.MatchString(normalizedCommand) {
 			if allowUnsafe {
 				return CommandAssessment{}, nil
@@ -38,11 +80,13 @@ func AssessCommand(command string, risk string, allowUnsafe bool) (CommandAssess
 		}
 	}
 
-	if astRiskReason, astRiskLevel := detectASTRisk(normalizedCommand); astRiskReason != "" {
-		assessment.RequiresRiskConfirmation = true
-		assessment.RiskLevel = maxRiskLevel(assessment.RiskLevel, astRiskLevel)
-		if assessment.RiskReason == "" {
-			assessment.RiskReason = astRiskReason
+	if viaShell {
+		if astRiskReason, astRiskLevel := detectASTRisk(normalizedCommand, shell); astRiskReason != "" {
+			assessment.RequiresRiskConfirmation = true
+			assessment.RiskLevel = maxRiskLevel(assessment.RiskLevel, astRiskLevel)
+			if assessment.RiskReason == "" {
+				assessment.RiskReason = astRiskReason
+			}
 		}
 	}
 
@@ -66,11 +110,19 @@ func AssessCommand(command string, risk string, allowUnsafe bool) (CommandAssess
 	return assessment, nil
 }
 
-func detectASTRisk(command string) (string, string) {
-	parser := syntax.NewParser()
-	file, parseError := parser.Parse(strings.NewReader(command), "")
+// detectASTRisk parses command in the dialect of shell. A script that does
+// not parse in a narrower dialect is retried as bash, so a bash-ism sent to sh
+// is still inspected rather than waved through. A script that does not parse
+// at all, or that runs under a shell without a dialect, cannot be checked and
+// needs confirmation.
+func detectASTRisk(command string, shell string) (string, string) {
+	dialect, checkable := shellDialect(shellProgram(shell))
+	file, parseError := syntax.NewParser(syntax.Variant(dialect)).Parse(strings.NewReader(command), "")
+	if parseError != nil && dialect != syntax.LangBash {
+		file, parseError = syntax.NewParser(syntax.Variant(syntax.LangBash)).Parse(strings.NewReader(command), "")
+	}
 	if parseError != nil {
-		return "", ""
+		return "command could not be parsed for risk checks", "medium"
 	}
 
 	riskReason := ""
@@ -87,6 +139,11 @@ func detectASTRisk(command string) (string, string) {
 				riskReason = "subshell command detected"
 			}
 			riskLevel = maxRiskLevel(riskLevel, "medium")
+		case *syntax.ProcSubst:
+			if riskReason == "" {
+				riskReason = "process substitution detected"
+			}
+			riskLevel = maxRiskLevel(riskLevel, "medium")
 		case *syntax.CmdSubst:
 			if riskReason == "" {
 				riskReason = "command substitution detected"
@@ -104,9 +161,156 @@ func detectASTRisk(command string) (string, string) {
 		return true
 	})
 
+	if riskReason == "" && !checkable {
+		return fmt.Sprintf("%s scripts cannot be checked for substitutions and pipelines", shellProgram(shell)), "medium"
+	}
 	return riskReason, riskLevel
 }
 
+var safeShellWord = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// QuoteArgv renders argv as a POSIX shell command line, quoting only the
+// words that need it. It is used to display, log and pattern-match argv runs.
+func QuoteArgv(argv []string) string {
+	quoted := make([]string, 0, len(argv))
+	for _, word := range argv {
+		if safeShellWord.MatchString(word) {
+			quoted = append(quoted, word)
+			continue
+		}
+		quoted = append(quoted, "'"+strings.ReplaceAll(word, "'", `'\''`)+"'")
+	}
+	return strings.Join(quoted, " ")
+}
+
+// shellProgram returns the lower-case program name of a shell such as
+// "/usr/bin/bash -l", or "" for an empty shell.
+func shellProgram(shell string) string {
+	fields := strings.Fields(shell)
+	if len(fields) == 0 {
+		return ""
+	}
+	return argvProgram(fields[0])
+}
+
+// shellDialect maps a shell program name to the closest parser dialect. zsh
+// has no dialect of its own but shares bash's syntax for substitutions,
+// pipelines and redirects. Other shells, such as fish, PowerShell and cmd, are
+// parsed as bash too, but the second result is false: that parse says nothing
+// reliable about their scripts.
+func shellDialect(program string) (syntax.LangVariant, bool) {
+	switch program {
+	case "sh", "dash", "ash", "posix":
+		return syntax.LangPOSIX, true
+	case "ksh", "mksh":
+		return syntax.LangMirBSDKorn, true
+	case "", "bash", "zsh":
+		return syntax.LangBash, true
+	default:
+		return syntax.LangBash, false
+	}
+}
+
+var argvShellPrograms = map[string]bool{
+	"sh": true, "bash": true, "zsh": true, "dash": true, "ash": true, "ksh": true, "mksh": true,
+	"fish": true, "pwsh": true, "powershell": true, "cmd": true,
+}
+
+// argvWrapperPrograms run the rest of their arguments as another command.
+var argvWrapperPrograms = map[string]bool{
+	"env": true, "exec": true, "nice": true, "nohup": true, "timeout": true, "sudo": true, "doas": true,
+	"command": true, "time": true, "setsid": true, "stdbuf": true, "ionice": true, "xargs": true,
+}
+
+func argvProgram(word string) string {
+	return strings.ToLower(strings.TrimSuffix(filepath.Base(word), ".exe"))
+}
+
+// ShellScriptFromArgv reports whether argv hands a script to a shell, and the
+// script if so. See shellScriptFromArgv.
+func ShellScriptFromArgv(argv []string) (string, bool) {
+	if len(argv) == 0 {
+		return "", false
+	}
+	script, _, ok := shellScriptFromArgv(argv)
+	return script, ok
+}
+
+// shellScriptFromArgv returns the script of an argv that hands a string to a
+// shell, such as ["bash", "-ec", "..."] or ["env", "sh", "-c", "..."], and
+// the shell that runs it. Behind a wrapper the first word naming a shell is
+// taken as the shell. When a shell runs but its script cannot be picked out,
+// the remaining words are returned as the script so the shell heuristics
+// still see them.
+func shellScriptFromArgv(argv []string) (string, string, bool) {
+	start := -1
+	if program := argvProgram(argv[0]); argvShellPrograms[program] {
+		start = 0
+	} else if argvWrapperPrograms[program] {
+		for index := 1; index < len(argv); index++ {
+			if argvShellPrograms[argvProgram(argv[index])] {
+				start = index
+				break
+			}
+		}
+	}
+	if start < 0 {
+		return "", "", false
+	}
+	shell, args := argv[start], argv[start+1:]
+	if script, found := shellScriptArg(argvProgram(shell), args); found {
+		return script, shell, true
+	}
+	return strings.Join(args, " "), shell, true
+}
+
+// shellScriptArg finds the command string in a shell's arguments: the word
+// after /c for cmd, everything after -Command for PowerShell, and for POSIX
+// shells the first operand once a short option group containing c is seen.
+func shellScriptArg(program string, args []string) (string, bool) {
+	switch program {
+	case "cmd":
+		for index, arg := range args {
+			if lower := strings.ToLower(arg); (lower == "/c" || lower == "/k") && index+1 < len(args) {
+				return strings.Join(args[index+1:], " "), true
+			}
+		}
+		return "", false
+	case "pwsh", "powershell":
+		for index, arg := range args {
+			if lower := strings.ToLower(arg); (lower == "-c" || lower == "-command") && index+1 < len(args) {
+				return strings.Join(args[index+1:], " "), true
+			}
+		}
+		return "", false
+	}
+	command := false
+	for index := 0; index < len(args); index++ {
+		arg := args[index]
+		switch {
+		case arg == "-" || arg == "--":
+			if command && index+1 < len(args) {
+				return args[index+1], true
+			}
+			return "", false
+		case strings.HasPrefix(arg, "--"):
+			continue
+		case len(arg) > 1 && (arg[0] == '-' || arg[0] == '+'):
+			if arg[0] == '-' && strings.ContainsRune(arg[1:], 'c') {
+				command = true
+			}
+			if strings.ContainsAny(arg[1:], "oO") {
+				index++
+			}
+		case command:
+			return arg, true
+		default:
+			return "", false
+		}
+	}
+	return "", false
+}
+
 func maxRiskLevel(left string, right string) string {
 	if riskLevelRank(right) > riskLevelRank(left) {
 		return right
@@ -7,6 +7,9 @@ import (
 var blockedPatterns = []struct {
 	reason string
 	regex  *regexp.Regexp
+	// shellOnly patterns describe shell structure and cannot match an argv
+	// that is executed without a shell.
+	shellOnly bool
 }{
 	{reason: "system wipe command", regex: regexp.MustCompile(`(?i)\brm\s+-rf\s+/(\s|$)`)},
 	{reason: "system wipe command", regex: regexp.MustCompile(`(?i)\bmkfs(\.[a-z0-9]+)?\b`)},
@@ -14,8 +17,8 @@ var blockedPatterns = []struct {
 	{reason: "privilege escalation", regex: regexp.MustCompile(`(?i)\bsudo\b`)},
 	{reason: "privilege escalation", regex: regexp.MustCompile(`(?i)\bsu\b`)},
 	{reason: "shutdown or reboot command", regex: regexp.MustCompile(`(?i)\b(shutdown|reboot|halt|poweroff)\b`)},
-	{reason: "pipe-to-shell pattern", regex: regexp.MustCompile(`(?i)\|\s*(sh|bash|zsh|powershell|pwsh|cmd)(\s|$)`)},
-	{reason: "dangerous download and execute", regex: regexp.MustCompile(`(?i)\b(curl|wget).*\|\s*(sh|bash|zsh|powershell|pwsh|cmd)\b`)},
+	{reason: "pipe-to-shell pattern", regex: regexp.MustCompile(`(?i)\|\s*(sh|bash|zsh|powershell|pwsh|cmd)(\s|$)`), shellOnly: true},
+	{reason: "dangerous download and execute", regex: regexp.MustCompile(`(?i)\b(curl|wget).*\|\s*(sh|bash|zsh|powershell|pwsh|cmd)\b`), shellOnly: true},
 }
 
 var suspiciousPatterns = []struct {
@@ -36,6 +36,144 @@ func TestValidateCommand_HighRiskBlockedWithoutUnsafe(t *testing.T) {
 	}
 }
 
+func TestAssessArgv_SkipsShellHeuristics(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name             string
+		argv             []string
+		expectBlocked    bool
+		expectRiskReason string
+	}{
+		{name: "literal pipe and redirect arguments", argv: []string{"grep", "-e", "a|b", "-e", "> out"}},
+		{name: "literal pipe to shell", argv: []string{"echo", "|", "sh"}},
+		{name: "blocked program", argv: []string{"rm", "-rf", "/"}, expectBlocked: true},
+		{name: "suspicious program", argv: []string{"git", "reset", "--hard"}, expectRiskReason: "git hard reset"},
+		{name: "explicit shell script", argv: []string{"bash", "-c", "cat a > b"}, expectRiskReason: "shell redirection detected"},
+	}
+	for _, testCase := range testCases {
+		assessment, assessmentError := AssessArgv(testCase.argv, "low", false)
+		if testCase.expectBlocked {
+			if assessmentError == nil {
+				t.Fatalf("%s: expected argv to be blocked", testCase.name)
+			}
+			continue
+		}
+		if assessmentError != nil {
+			t.Fatalf("%s: unexpected error %v", testCase.name, assessmentError)
+		}
+		if assessment.RiskReason != testCase.expectRiskReason {
+			t.Fatalf("%s: expected risk reason %q, got %q", testCase.name, testCase.expectRiskReason, assessment.RiskReason)
+		}
+	}
+}
+
+func TestAssessArgv_FindsShellScripts(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name             string
+		argv             []string
+		expectBlocked    bool
+		expectRiskReason string
+	}{
+		{name: "combined flags", argv: []string{"bash", "-ec", "curl x | sh"}, expectBlocked: true},
+		{name: "trace and command flags", argv: []string{"sh", "-xc", "cat a > b"}, expectRiskReason: "shell redirection detected"},
+		{name: "option with value before -c", argv: []string{"bash", "-o", "pipefail", "-c", "cat a > b"}, expectRiskReason: "shell redirection detected"},
+		{name: "env wrapper", argv: []string{"env", "sh", "-c", "curl x | sh"}, expectBlocked: true},
+		{name: "env by path", argv: []string{"/usr/bin/env", "bash", "-c", "cat a > b"}, expectRiskReason: "shell redirection detected"},
+		{name: "env assignments and nested wrapper", argv: []string{"env", "FOO=1", "nice", "-n", "5", "bash", "-c", "echo $(id)"}, expectRiskReason: "command substitution detected"},
+		{name: "exec wrapper", argv: []string{"exec", "bash", "-c", "cat a > b"}, expectRiskReason: "shell redirection detected"},
+		{name: "nohup wrapper", argv: []string{"nohup", "sh", "-c", "cat a | sh"}, expectBlocked: true},
+		{name: "timeout wrapper", argv: []string{"timeout", "-s", "KILL", "5", "sh", "-c", "cat a > b"}, expectRiskReason: "shell redirection detected"},
+		{name: "sudo wrapper", argv: []string{"sudo", "-u", "build", "bash", "-c", "make"}, expectBlocked: true},
+		{name: "cmd", argv: []string{"cmd", "/c", "type a > b"}, expectRiskReason: "shell redirection detected"},
+		{name: "cmd without redirects", argv: []string{"cmd", "/c", "dir"}, expectRiskReason: "cmd scripts cannot be checked for substitutions and pipelines"},
+		{name: "script not found fails closed", argv: []string{"bash", "-s", "cat a > b"}, expectRiskReason: "shell redirection detected"},
+		{name: "script file fails closed", argv: []string{"sh", "run.sh", "|", "sh"}, expectBlocked: true},
+		{name: "wrapper without shell", argv: []string{"env", "FOO=1", "go", "test", "./..."}},
+	}
+	for _, testCase := range testCases {
+		assessment, assessmentError := AssessArgv(testCase.argv, "low", false)
+		if testCase.expectBlocked {
+			if assessmentError == nil {
+				t.Fatalf("%s: expected argv to be blocked", testCase.name)
+			}
+			continue
+		}
+		if assessmentError != nil {
+			t.Fatalf("%s: unexpected error %v", testCase.name, assessmentError)
+		}
+		if assessment.RiskReason != testCase.expectRiskReason {
+			t.Fatalf("%s: expected risk reason %q, got %q", testCase.name, testCase.expectRiskReason, assessment.RiskReason)
+		}
+		if testCase.expectRiskReason != "" && !assessment.RequiresRiskConfirmation {
+			t.Fatalf("%s: expected risk confirmation", testCase.name)
+		}
+	}
+}
+
+func TestAssessShellCommand_UsesShellDialect(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		command          string
+		shell            string
+		expectRiskReason string
+	}{
+		{command: "[[ -f go.mod ]] && go test ./...", shell: "bash"},
+		{command: "diff <(ls a) <(ls b)", shell: "bash", expectRiskReason: "process substitution detected"},
+		{command: "diff <(ls a) <(ls b)", shell: "/bin/sh", expectRiskReason: "process substitution detected"},
+		{command: "set -o pipefail; go test ./... | tee log", shell: "zsh", expectRiskReason: "pipeline command detected"},
+		{command: "echo $((1 + 2))", shell: "dash"},
+		{command: "go test ./...", shell: "pwsh", expectRiskReason: "pwsh scripts cannot be checked for substitutions and pipelines"},
+		{command: "go test ./...", shell: "/usr/bin/fish -l", expectRiskReason: "fish scripts cannot be checked for substitutions and pipelines"},
+		{command: "go test ./... | tee log", shell: "powershell.exe", expectRiskReason: "pipeline command detected"},
+		{command: "echo (", shell: "bash", expectRiskReason: "command could not be parsed for risk checks"},
+	}
+	for _, testCase := range testCases {
+		assessment, assessmentError := AssessShellCommand(testCase.command, testCase.shell, "low", false)
+		if assessmentError != nil {
+			t.Fatalf("%s: unexpected error %v", testCase.command, assessmentError)
+		}
+		if assessment.RiskReason != testCase.expectRiskReason {
+			t.Fatalf("%s under %s: expected risk reason %q, got %q", testCase.command, testCase.shell, testCase.expectRiskReason, assessment.RiskReason)
+		}
+		if testCase.expectRiskReason != "" && !assessment.RequiresRiskConfirmation {
+			t.Fatalf("%s under %s: expected risk confirmation", testCase.command, testCase.shell)
+		}
+	}
+}
+
+func TestAllowlistMatchesArgv(t *testing.T) {
+	t.Parallel()
+
+	allowlist := &Allowlist{
+		entries: []allowlistEntry{
+			{kind: "exact", value: "go test ./..."},
+			{kind: "prefix", value: "npm run"},
+		},
+	}
+	testCases := []struct {
+		argv     []string
+		expected bool
+	}{
+		{argv: []string{"go", "test", "./..."}, expected: true},
+		{argv: []string{"go", "test", "./...", "-run", "X"}, expected: false},
+		{argv: []string{"npm", "run", "dev"}, expected: true},
+		{argv: []string{"npm", "runner"}, expected: false},
+		{argv: []string{"npm run dev"}, expected: false},
+	}
+	for _, testCase := range testCases {
+		if matched := allowlist.MatchesArgv(testCase.argv); matched != testCase.expected {
+			t.Fatalf("expected MatchesArgv(%q) = %v", testCase.argv, testCase.expected)
+		}
+	}
+	if QuoteArgv([]string{"echo", "it's here", "a|b"}) != `echo 'it'\''s here' 'a|b'` {
+		t.Fatalf("unexpected quoting: %s", QuoteArgv([]string{"echo", "it's here", "a|b"}))
+	}
+}
+
 func TestAllowlistModes(t *testing.T) {
 	t.Parallel()
 